@@ -0,0 +1,280 @@
+// Package bot is a small framework for Chitty-Chat bots. A bot is a user of the Chat service like any other:
+// it joins a room, reads the messages of its rooms from the Join stream and answers them with Publish.
+// Messages starting with a slash, like "/roll 2d6", are commands and go to the handler registered for the command.
+// Every other message from a user goes to the message handlers.
+// The server must know the bot, every call carries its token as "authorization: Bearer <token>" metadata,
+// and the session the server sent when the bot joined.
+package bot
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/00kristian/MiniProject_2/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// How long answering a heartbeat may take. A late answer counts as a missed one anyway
+const heartbeatTimeout = 5 * time.Second
+
+// Metadata key of the session the server sends in the header of the Join stream
+const sessionKey = "chitty-session"
+
+type Config struct {
+	// Address of the Chitty-Chat server
+	Server string
+	// Id of the bot user, and the token the server knows it by
+	ID    string
+	Token string
+	// Room the bot joins. It can be invited to other rooms. Defaults to the lobby
+	Room string
+}
+
+// What a handler is given
+type Request struct {
+	// The message the handler was called for
+	Message *proto.Message
+	// For commands: the name of the command without the slash, and the words after it
+	Command string
+	Args    []string
+
+	bot *Bot
+}
+
+// Answers in the room the message was sent to
+func (r *Request) Reply(format string, args ...interface{}) error {
+	return r.bot.Say(r.Message.Room, fmt.Sprintf(format, args...))
+}
+
+// The bot the request was sent to
+func (r *Request) Bot() *Bot {
+	return r.bot
+}
+
+// Handles a command or a message. Handlers are called one at a time in the order the messages arrive,
+// so a handler that takes long should do its work in a goroutine
+type Handler func(r *Request)
+
+type command struct {
+	help    string
+	handler Handler
+}
+
+type Bot struct {
+	config Config
+	conn   *grpc.ClientConn
+	client proto.ChatClient
+
+	mu       sync.Mutex
+	commands map[string]command
+	handlers []Handler
+	lamport  uint64
+	features map[string]bool
+	session  string
+	// Longest message the server accepts, 0 if it does not tell
+	maxLength int
+}
+
+// Connects to the server. The bot joins when it is run
+func New(config Config) (*Bot, error) {
+	if config.ID == "" {
+		return nil, fmt.Errorf("a bot needs an id")
+	}
+	if config.Room == "" {
+		config.Room = "lobby"
+	}
+	// No https, so connect with grpc.WithInsecure()
+	conn, err := grpc.Dial(config.Server, grpc.WithInsecure())
+	if err != nil {
+		return nil, err
+	}
+	b := &Bot{
+		config:   config,
+		conn:     conn,
+		client:   proto.NewChatClient(conn),
+		commands: make(map[string]command),
+		features: make(map[string]bool),
+	}
+	// A help command listing the others, unless the bot has one of its own
+	b.commands["help"] = command{help: "Shows the commands of the bot", handler: b.help}
+	return b, nil
+}
+
+// Registers the handler of the command with the given name, without the slash
+func (b *Bot) Command(name string, help string, handler Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.commands[strings.TrimPrefix(name, "/")] = command{help: help, handler: handler}
+}
+
+// Registers a handler for the messages that are not commands
+func (b *Bot) Handle(handler Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, handler)
+}
+
+// Id of the bot user
+func (b *Bot) ID() string {
+	return b.config.ID
+}
+
+// Publishes a message to a room the bot is in
+func (b *Bot) Say(room string, text string) error {
+	_, err := b.client.Publish(b.auth(context.Background()), &proto.Message{Id: b.config.ID, Text: text, Lamport: b.tick(0), Room: room})
+	return err
+}
+
+// Joins the room and handles the messages until the context is done or the server ends the stream.
+// The bot leaves when the context is done, and nil is returned
+func (b *Bot) Run(ctx context.Context) error {
+	// Only use what the server supports. Older servers do not tell
+	info, err := b.client.GetServerInfo(ctx, &proto.Empty{})
+	if err != nil && status.Code(err) != codes.Unimplemented {
+		return err
+	}
+	b.mu.Lock()
+	for _, feature := range info.GetFeatures() {
+		b.features[feature] = true
+	}
+	b.maxLength = int(info.GetMaxMessageLength())
+	b.mu.Unlock()
+
+	streamCtx, cancel := context.WithCancel(b.auth(ctx))
+	defer cancel()
+	user := &proto.User{Id: b.config.ID, Name: b.config.ID, Active: true, Room: b.config.Room}
+	stream, err := b.client.Join(streamCtx, user)
+	if err != nil {
+		return err
+	}
+	// A server that does not let the bot join ends the stream without a header
+	header, err := stream.Header()
+	if err == nil && len(header) == 0 {
+		_, err = stream.Recv()
+	}
+	if err != nil {
+		return err
+	}
+	if sessions := header.Get(sessionKey); len(sessions) > 0 {
+		b.mu.Lock()
+		b.session = sessions[0]
+		b.mu.Unlock()
+	}
+	b.heartbeat()
+
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			if ctx.Err() != nil {
+				b.client.Leave(b.auth(context.Background()), &proto.Id{Id: b.config.ID, Lamport: b.tick(0)})
+				return nil
+			}
+			return err
+		}
+		b.tick(msg.Lamport)
+		if msg.Event == proto.EventType_EVENT_HEARTBEAT {
+			b.heartbeat()
+			continue
+		}
+		b.dispatch(msg)
+	}
+}
+
+// The number of characters a message may have at most, 0 if the server does not tell. Known once the bot runs
+func (b *Bot) MaxMessageLength() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.maxLength
+}
+
+// Disconnects from the server
+func (b *Bot) Close() error {
+	return b.conn.Close()
+}
+
+// Calls the handlers of a message. System messages, events and our own messages are not handled
+func (b *Bot) dispatch(msg *proto.Message) {
+	if msg.Id == "" || msg.Id == b.config.ID || msg.Event != proto.EventType_EVENT_MESSAGE {
+		return
+	}
+	req := &Request{Message: msg, bot: b}
+
+	b.mu.Lock()
+	handlers := b.handlers
+	var handler Handler
+	if strings.HasPrefix(msg.Text, "/") {
+		fields := strings.Fields(msg.Text)
+		req.Command, req.Args = strings.TrimPrefix(fields[0], "/"), fields[1:]
+		// Commands we do not know may be for another bot
+		handler = b.commands[req.Command].handler
+		handlers = nil
+	}
+	b.mu.Unlock()
+
+	if handler != nil {
+		handler(req)
+	}
+	for _, handler := range handlers {
+		handler(req)
+	}
+}
+
+// Lists the commands of the bot
+func (b *Bot) help(r *Request) {
+	b.mu.Lock()
+	var lines []string
+	for name, command := range b.commands {
+		lines = append(lines, fmt.Sprintf("/%s - %s", name, command.help))
+	}
+	b.mu.Unlock()
+	sort.Strings(lines)
+	for _, line := range lines {
+		if err := r.Reply("%s", line); err != nil {
+			return
+		}
+	}
+}
+
+// Answers a heartbeat from the server, so it knows the bot is still here
+func (b *Bot) heartbeat() {
+	if !b.features["presence"] {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(b.auth(context.Background()), heartbeatTimeout)
+		defer cancel()
+		b.client.Heartbeat(ctx, &proto.Id{Id: b.config.ID})
+	}()
+}
+
+// Adds the token and the session of the bot to the calls made with the context
+func (b *Bot) auth(ctx context.Context) context.Context {
+	if b.config.Token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+b.config.Token)
+	}
+	b.mu.Lock()
+	session := b.session
+	b.mu.Unlock()
+	if session != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, sessionKey, session)
+	}
+	return ctx
+}
+
+// Ticks the lamport time of the bot, merging it with the given time
+func (b *Bot) tick(other uint64) uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if other > b.lamport {
+		b.lamport = other
+	}
+	b.lamport++
+	return b.lamport
+}
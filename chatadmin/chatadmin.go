@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/00kristian/MiniProject_2/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Client for the admin service
+var admin proto.ChatAdminClient
+
+func main() {
+	address := flag.String("address", ":8080", "Address of the Chitty-Chat server")
+	token := flag.String("token", os.Getenv("CHITTY_ADMIN_TOKEN"), "Admin token of the server")
+	reason := flag.String("reason", "", "Reason shown to the users for kick, ban and mute")
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	// Connect to our server - no https, so connect with grpc.WithInsecure()
+	conn, err := grpc.Dial(*address, grpc.WithInsecure())
+	if err != nil {
+		log.Fatalf("Could not connect: %s", err)
+	}
+	defer conn.Close()
+	admin = proto.NewChatAdminClient(conn)
+
+	// Every call carries the admin token
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+*token)
+
+	if err := run(ctx, args[0], args[1:], *reason); err != nil {
+		log.Fatalf("%s failed: %v", args[0], err)
+	}
+}
+
+// Runs the given command against the admin service
+func run(ctx context.Context, command string, args []string, reason string) error {
+	// Every command except sessions and announce needs exactly one id, mute also needs a duration
+	switch command {
+	case "sessions":
+		return sessions(ctx)
+	case "announce":
+		if len(args) == 0 {
+			return fmt.Errorf("missing text")
+		}
+		_, err := admin.Announce(ctx, &proto.Message{Text: strings.Join(args, " ")})
+		return err
+	case "mute":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: mute <id> <duration>")
+		}
+		duration, err := time.ParseDuration(args[1])
+		if err != nil {
+			return err
+		}
+		// The server takes whole seconds, and would read less than a second as no mute at all
+		if duration < time.Second {
+			return fmt.Errorf("a mute must last at least 1s, not %v", duration)
+		}
+		_, err = admin.Mute(ctx, &proto.ModerationRequest{Id: args[0], Reason: reason, DurationSeconds: int64(duration.Seconds())})
+		return err
+	}
+
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s <id>", command)
+	}
+	req := &proto.ModerationRequest{Id: args[0], Reason: reason}
+	var err error
+	switch command {
+	case "kick":
+		_, err = admin.Kick(ctx, req)
+	case "ban":
+		_, err = admin.Ban(ctx, req)
+	case "unban":
+		_, err = admin.Unban(ctx, req)
+	case "disconnect":
+		_, err = admin.Disconnect(ctx, req)
+	default:
+		usage()
+		os.Exit(2)
+	}
+	return err
+}
+
+// Prints every session known by the server
+func sessions(ctx context.Context) error {
+	list, err := admin.ListSessions(ctx, &proto.Empty{})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%-20s %-20s %-8s %-22s %-20s %s\n", "ID", "NAME", "ACTIVE", "ADDRESS", "CONNECTED", "USER AGENT")
+	for _, s := range list.Sessions {
+		connected := time.Unix(s.ConnectedAt, 0).Format("2006-01-02 15:04:05")
+		fmt.Printf("%-20s %-20s %-8t %-22s %-20s %s\n", s.Id, s.Name, s.Active, s.Address, connected, s.UserAgent)
+	}
+	return nil
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: chatadmin [flags] <command> [arguments]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Commands:")
+	fmt.Fprintln(os.Stderr, "  sessions                 Lists every session on the server")
+	fmt.Fprintln(os.Stderr, "  kick <id>                Disconnects the user and tells everybody")
+	fmt.Fprintln(os.Stderr, "  ban <id>                 Disconnects the user and keeps the user out")
+	fmt.Fprintln(os.Stderr, "  unban <id>               Lets a banned user join again")
+	fmt.Fprintln(os.Stderr, "  mute <id> <duration>     Keeps the user from publishing, e.g. mute bob 10m")
+	fmt.Fprintln(os.Stderr, "  disconnect <id>          Silently ends the stream of the user")
+	fmt.Fprintln(os.Stderr, "  announce <text>          Broadcasts a system announcement")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Flags:")
+	flag.PrintDefaults()
+}
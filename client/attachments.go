@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/00kristian/MiniProject_2/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Size of the chunks files are uploaded in
+const chunkSize = 32 * 1024
+
+// Max size of an attachment - updated from the server on startup
+var maxAttachmentSize uint64 = 10 << 20
+
+// Runs "\send <path>" - uploads the file and sends a message with it attached
+func sendFile(msg *proto.Message) {
+	if !hasFeature("attachments") {
+		ui.Info("The server does not support attachments.")
+		return
+	}
+	path := strings.TrimSpace(strings.TrimPrefix(msg.Text, "\\send"))
+	if path == "" {
+		ui.Info("Wrong use of the command. Type \\help to see how to use it.")
+		return
+	}
+
+	attachment, err := upload(path)
+	if err == nil {
+		// The text of the message is the name of the file, cut to fit in a message
+		name := []rune(attachment.Name)
+		if len(name) > maxMessageLength {
+			name = name[:maxMessageLength]
+		}
+		msg.Text = string(name)
+		msg.Attachment = attachment
+		_, err = client.Publish(context.Background(), msg)
+	}
+	switch status.Code(err) {
+	case codes.OK:
+	case codes.ResourceExhausted, codes.PermissionDenied, codes.InvalidArgument:
+		ui.Info("Could not send %s: %s", path, status.Convert(err).Message())
+	case codes.Unknown:
+		// Errors from reading the file
+		ui.Info("Could not send %s: %v", path, err)
+	default:
+		fatalf("Error occured when sending %s: %v", path, err)
+	}
+}
+
+// Uploads the file in chunks, and returns the attachment the server made of it
+func upload(path string) (*proto.Attachment, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if uint64(info.Size()) > maxAttachmentSize {
+		return nil, status.Errorf(codes.ResourceExhausted, "the file is %d bytes, attachments can be at most %d bytes", info.Size(), maxAttachmentSize)
+	}
+
+	stream, err := client.Upload(withSession(context.Background()))
+	if err != nil {
+		return nil, err
+	}
+	// The first chunk says who we are and what the file is called
+	chunk := &proto.Chunk{Id: me, Attachment: &proto.Attachment{Name: filepath.Base(path)}}
+	buffer := make([]byte, chunkSize)
+	for {
+		n, err := file.Read(buffer)
+		if n > 0 || chunk.Attachment != nil {
+			chunk.Data = buffer[:n]
+			if err := stream.Send(chunk); err != nil {
+				// The server ended the upload, the reason comes with CloseAndRecv
+				break
+			}
+			chunk = &proto.Chunk{}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			stream.CloseSend()
+			return nil, err
+		}
+	}
+	return stream.CloseAndRecv()
+}
+
+// Runs "\get <number>" - downloads the attachment of the message with the number into the current directory
+func getFile(msg *proto.Message) {
+	if !hasFeature("attachments") {
+		ui.Info("The server does not support attachments.")
+		return
+	}
+	fields := strings.Fields(msg.Text)
+	if len(fields) != 2 {
+		ui.Info("Wrong use of the command. Type \\help to see how to use it.")
+		return
+	}
+	seq, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		ui.Info("%q is not a message number.", fields[1])
+		return
+	}
+	attachment := attachmentOf(seq)
+	if attachment == nil {
+		ui.Info("Message %d has no attachment.", seq)
+		return
+	}
+
+	path, err := download(attachment)
+	switch status.Code(err) {
+	case codes.OK:
+		ui.Info("Saved %s (%d bytes) as %s", attachment.Name, attachment.Size, path)
+	case codes.NotFound, codes.InvalidArgument, codes.Unknown:
+		ui.Info("Could not get %s: %s", attachment.Name, status.Convert(err).Message())
+	default:
+		fatalf("Error occured when getting %s: %v", attachment.Name, err)
+	}
+}
+
+// Downloads the attachment into the current directory, checking that it is what was sent. Returns where it was saved
+func download(attachment *proto.Attachment) (string, error) {
+	// Never trust the name from the server with a path, and never overwrite a file
+	path := filepath.Base(attachment.Name)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return "", err
+	}
+	stream, err := client.Download(context.Background(), &proto.Attachment{Hash: attachment.Hash})
+	if err == nil {
+		hash := sha256.New()
+		for {
+			var chunk *proto.Chunk
+			chunk, err = stream.Recv()
+			if err != nil {
+				break
+			}
+			hash.Write(chunk.Data)
+			if _, err = file.Write(chunk.Data); err != nil {
+				break
+			}
+		}
+		if err == io.EOF {
+			err = nil
+			if sum := hex.EncodeToString(hash.Sum(nil)); sum != attachment.Hash {
+				err = fmt.Errorf("the file is damaged, got content with hash %s", sum)
+			}
+		}
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
+
+// The attachment of a message we have received
+func attachmentOf(seq uint64) *proto.Attachment {
+	recent.Lock()
+	defer recent.Unlock()
+	if msg, found := recent.messages[seq]; found {
+		return msg.Attachment
+	}
+	return nil
+}
+
+// Describes an attachment, like "[notes.txt, 1234 bytes - \get 42]"
+func describeAttachment(msg *proto.Message) string {
+	return fmt.Sprintf("[%s, %d bytes - \\get %d]", msg.Attachment.Name, msg.Attachment.Size, msg.Seq)
+}
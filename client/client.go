@@ -1,16 +1,23 @@
 package main
 
 import (
-	"bufio"
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"strings"
 	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/00kristian/MiniProject_2/proto"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"golang.org/x/term"
 )
 
 // Global variable for our client
@@ -23,6 +30,22 @@ var mu sync.Mutex
 // lamport time for given client
 var lamport uint64 = 0
 
+// Our id
+var me string
+
+// The room we chat in - with the terminal UI the user can switch between rooms. Protected by mu
+var room string
+
+// Version of the protocol this client speaks
+const protocolVersion = 2
+
+// Limits of the server - updated from the server on startup
+var maxMessageLength = 128
+var maxNameLength = 32
+
+// Optional features supported by the server - updated from the server on startup
+var serverFeatures = make(map[string]bool)
+
 // Init func to initialize the wait group
 func init(){
 	wait = &sync.WaitGroup{}
@@ -37,6 +60,7 @@ func join(id string, name string) error {
 		Id: id,
 		Name: name,
 		Active: true,
+		Room: room,
 	}
 
 	// join event increments lamport by one
@@ -44,23 +68,42 @@ func join(id string, name string) error {
 	lamport += 1
 	mu.Unlock()
 
-	joinMessage := &proto.Message{
-		Id: "",
-		Text: user.Name + " joined Chitty-Chat at Lamport time ",
-		Lamport: lamport,
+	// Creates the stream, that is return when a user joins the server. The stream ends when we move to another server.
+	// Joining with our old session takes over our connection, in case the server has not noticed we lost it.
+	// The server publishes the join message. A server that is not the leader tells us where the leader is.
+	// While a new leader is elected there is nowhere to go, so we try again for a while
+	var ctx context.Context
+	var stream proto.Chat_JoinClient
+	var header metadata.MD
+	var err error
+	for start := time.Now(); ; time.Sleep(retryInterval) {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(context.Background())
+		endStream = cancel
+		stream, err = client.Join(withSession(ctx), user)
+		if err == nil {
+			header, err = joinHeader(stream)
+		}
+		if status.Code(err) != codes.Unavailable || time.Since(start) > failoverTimeout {
+			break
+		}
+		cancel()
+		if stream != nil && redirect(stream.Trailer()) {
+			return nil
+		}
 	}
-
-	// Creates the stream, that is return when a user joins the server
-	stream, err := client.Join(context.Background(), user)
-	// Publish the join message
-	_, joinMessageErr := client.Publish(context.Background(), joinMessage)
-
 	if err != nil {
-		log.Fatalf("Connection failed: %v", err)
+		fatalf("Connection failed: %v", err)
 	}
-	if joinMessageErr != nil {
-		log.Fatalf("Error occured when publishing join message: %v", joinMessageErr)
+	if sessions := header.Get(sessionKey); len(sessions) > 0 {
+		mu.Lock()
+		session = sessions[0]
+		mu.Unlock()
 	}
+	joined()
+	answerHeartbeat()
+	// If we came from another server, show what we missed in the meantime
+	shown := resume()
 
 	// Increments the wait group by one
 	wait.Add(1)
@@ -75,22 +118,42 @@ func join(id string, name string) error {
 		for{
 			// Wait until a message is recieved in the stream
 			msg, err := str.Recv()
-			mu.Lock()
-			lamport = max(lamport, msg.Lamport) + 1
-			mu.Unlock()
 
 			// If an error occurs, the goroutine and the for loop must terminate. 
 			// Error is passed to the local sError variable
 			if err != nil {
+				// A moderator kicked, banned or disconnected us - tell the user why and quit
+				if code := status.Code(err); code == codes.Aborted || code == codes.PermissionDenied {
+					fatalf("[%s: %d] %s", user.Id, lamport, status.Convert(err).Message())
+				}
+				// We moved to another server
+				if ctx.Err() != nil {
+					break
+				}
+				// The server went away - move to another one and join again
+				if status.Code(err) == codes.Unavailable && failover() {
+					break
+				}
 				sError = fmt.Errorf("Error occured when reading message: %v", err)
+				fatalf("%v", sError)
 				break;
 			}
-			// If id == "", it is a join message
-			if msg.Id == "" {
-				log.Printf("[%s: %d] %s", user.Id, lamport, msg.Text)
-			}else{
-				log.Printf("[%s: %d] %s: %s", user.Id, lamport, msg.Id, msg.Text)
+			// Messages we already got from the history of the new server
+			if msg.Uid != "" && shown[msg.Uid] {
+				continue
 			}
+			// Heartbeats are not events, they are only answered
+			if msg.Event == proto.EventType_EVENT_HEARTBEAT {
+				answerHeartbeat()
+				continue
+			}
+			mu.Lock()
+			lamport = max(lamport, msg.Lamport) + 1
+			received := lamport
+			mu.Unlock()
+			ui.Show(msg, received)
+			remember(msg)
+			deliver(msg)
 		}
 	}(stream)
 
@@ -98,30 +161,80 @@ func join(id string, name string) error {
 }
 
 func main(){
-	// Reader to read user input
-	reader := bufio.NewReader(os.Stdin)
+	flag.StringVar(&room, "room", "lobby", "The room to chat in")
+	useTUI := flag.Bool("tui", true, "Use the full-screen terminal UI (line mode is used anyway if stdout is not a terminal)")
+	addresses := flag.String("server", ":8080", "Comma separated addresses of the Chitty-Chat servers - if one goes down, the client moves to another")
+	// Keepalive of the connection to the server, it must not ping more often than the server's -keepalive-min-time
+	flag.DurationVar(&keepaliveParams.Time, "keepalive-time", 30*time.Second, "How long the connection can be quiet before the client pings the server")
+	flag.DurationVar(&keepaliveParams.Timeout, "keepalive-timeout", 10*time.Second, "How long the server has to answer a ping before the connection is considered dead")
+	// Serverless mode, where the clients send their messages to each other
+	p2p := flag.Bool("p2p", false, "Chat without a server, directly with the other peers")
+	listen := flag.String("listen", ":7070", "Address to listen on for the other peers in serverless mode")
+	peers := flag.String("peers", "", "Comma separated addresses of the other peers in serverless mode")
+	multicast := flag.String("multicast", "", "Multicast group to find the other peers on the local network in serverless mode, like 239.255.42.99:7099")
+	flag.Parse()
+	endpoints = parseEndpoints(*addresses)
+	if len(endpoints) == 0 {
+		log.Fatalf("No server address given")
+	}
+
+	// In serverless mode we run the Chat service ourselves, and the client talks to it like to any server
+	if *p2p {
+		node, err := startPeer(*listen, parseEndpoints(*peers))
+		if err != nil {
+			log.Fatalf("Could not start the peer: %v", err)
+		}
+		if *multicast != "" {
+			if err := discover(node, *multicast); err != nil {
+				log.Fatalf("Could not find peers with multicast: %v", err)
+			}
+		}
+		endpoints = []string{node.address}
+	}
 
 	// Dummy channel to ensure all go routines are finished
 	done := make(chan int)
 
-	// Reads and parse name into id and name, which is used to connect
-	fmt.Print("Please enter you name: ")
-	temp, _ := reader.ReadString('\n')
-	name := strings.TrimSpace(temp)
-	id := name
-
-	// Connect to our server - no https, so connect with grpc.WithInsecure()
-	conn, err := grpc.Dial(":8080", grpc.WithInsecure())
-	if err != nil{
+	// Connect to our server, and create the client on the connection
+	if err := connect(); err != nil{
 		log.Fatalf("Could not connect: %s", err)
 	}
 
 	// When method is done close the connection
-	defer conn.Close()
+	defer func() { conn.Close() }()
+
+	// Ask the server what it accepts, so we can tell the user before the server rejects it
+	checkServer()
+
+	// Reads and parse name into id and name, which is used to connect
+	var name string
+	for {
+		fmt.Print("Please enter you name: ")
+		temp, ok := ui.ReadLine()
+		if !ok {
+			return
+		}
+		name = strings.TrimSpace(temp)
+		if validateText(name, maxNameLength) {
+			break
+		}
+		ui.Info("Please type a valid name. A valid name is a non-empty UTF-8 encoded string consisting of max %d characters.", maxNameLength)
+	}
+	id := name
+	me = id
+	myName = name
+
+	// Switch to the terminal UI, unless the output is not a terminal
+	if *useTUI && term.IsTerminal(int(os.Stdout.Fd())) {
+		tui, err := newTUI()
+		if err != nil {
+			log.Printf("Could not start the terminal UI, using line mode: %v", err)
+		} else {
+			ui = tui
+			defer ui.Close()
+		}
+	}
 
-	// Creates the client on our connection
-	client = proto.NewChatClient(conn)
-	
 	// Show welcome message
 	welcome()
 
@@ -135,12 +248,15 @@ func main(){
 	go func(){
 		defer wait.Done()
 
-		// Create scanner in order to scan user messages
-		scanner := bufio.NewScanner(os.Stdin)
-		for scanner.Scan(){
-			msgContent := strings.TrimSpace(scanner.Text())
+		// Read user messages until the user leaves or the input ends
+		for {
+			line, ok := ui.ReadLine()
+			if !ok {
+				break
+			}
+			msgContent := strings.TrimSpace(line)
 			if !validateMsg(msgContent) {
-				fmt.Println("Please type a valid message. A valid message is a UTF-8 encoded string consisting of max 128 characters.")
+				ui.Info("Please type a valid message. A valid message is a non-empty UTF-8 encoded string consisting of max %d characters.", maxMessageLength)
 				continue 
 			}
 			mu.Lock()
@@ -150,26 +266,69 @@ func main(){
 				Id: id,
 				Text: msgContent,
 				Lamport: lamport,
+				Room: currentRoom(),
 			}
 			// Check if said message is a command
 			if strings.Contains(msg.Text, "\\leave"){
 				_ , errLeave := client.Leave(context.Background(), &proto.Id{Id: msg.Id, Lamport: msg.Lamport})
 				if errLeave != nil{
-					log.Fatalf("Error occured when trying to leave: %v", errLeave)
+					fatalf("Error occured when trying to leave: %v", errLeave)
 				}
 				wait.Done()
 				break
 			} else if strings.Contains(msg.Text, "\\help"){
-				fmt.Println("------------------------------------")
-				fmt.Println("Following commands are available:")
-				fmt.Println("\\leave - Exits Chitty-Chat.")
-				fmt.Println("\\help - Shows this menu again.")
-				fmt.Println("------------------------------------")
+				help()
+			} else if isRoomCommand(msg.Text){
+				roomCommand(msg)
+			} else if isEditCommand(msg.Text){
+				editCommand(msg)
+			} else if strings.HasPrefix(msg.Text, "\\thread"){
+				printThread(msg)
+			} else if strings.HasPrefix(msg.Text, "\\search"){
+				search(msg)
+			} else if strings.HasPrefix(msg.Text, "\\send"){
+				sendFile(msg)
+			} else if strings.HasPrefix(msg.Text, "\\get"){
+				getFile(msg)
 			} else{
+				// A reply is published like any other message, it just knows its parent
+				if strings.HasPrefix(msg.Text, "\\reply") && !parseReply(msg){
+					continue
+				}
+				// Messages sent while we move to another server are sent once we joined it
+				if !settled() {
+					fatalf("Could not reach any of the servers")
+				}
 				// Call the broadcast message and distibute the message through all active useres
-				_, err := client.Publish(context.Background(), msg)
+				// The trailer tells us how long to wait if the server rate limits us
+				var trailer metadata.MD
+				rejoined := nextJoin()
+				_, err := client.Publish(context.Background(), msg, grpc.Trailer(&trailer))
+				// Only the leader of a replicated cluster takes messages - move to the leader and try again
+				if status.Code(err) == codes.Unavailable && redirect(trailer) {
+					trailer = nil
+					_, err = client.Publish(context.Background(), msg, grpc.Trailer(&trailer))
+				}
+				// The server went away - try again once we joined another one
+				if status.Code(err) == codes.Unavailable {
+					select {
+					case <-rejoined:
+						trailer = nil
+						_, err = client.Publish(context.Background(), msg, grpc.Trailer(&trailer))
+					case <-time.After(failoverTimeout):
+					}
+				}
+				if status.Code(err) == codes.ResourceExhausted {
+					ui.Info("You are sending messages too fast. Please wait %s seconds before trying again.", retryAfter(trailer))
+					continue
+				}
+				// The server validates messages as well, and tells us why it rejected the message
+				if status.Code(err) == codes.InvalidArgument {
+					ui.Info("The server rejected your message: %s", status.Convert(err).Message())
+					continue
+				}
 				if err != nil {
-					log.Fatalf("Error sending message: %v", err)
+					fatalf("Error sending message: %v", err)
 					break
 				}
 			}
@@ -188,12 +347,49 @@ func main(){
 }
 
 func welcome(){
-	fmt.Println("Welcome to Chitty-chat! =^.^=")
-	fmt.Println("------------------------------------")
-	fmt.Println("Following commands are available:")
-	fmt.Println("\\leave - Exits Chitty-Chat.")
-	fmt.Println("\\help - Shows this menu again.")
-	fmt.Println("------------------------------------")
+	ui.Info("Welcome to Chitty-chat! =^.^=")
+	help()
+}
+
+func help(){
+	ui.Info("------------------------------------")
+	ui.Info("Following commands are available:")
+	ui.Info("\\leave - Exits Chitty-Chat.")
+	ui.Info("\\help - Shows this menu again.")
+	if hasFeature("roles") {
+		ui.Info("\\roles - Shows the topic of the room and the roles of its users.")
+		ui.Info("\\role <id> <role> - Gives a user a role (guest, member, moderator, admin or owner).")
+		ui.Info("\\topic <text> - Changes the topic of the room.")
+		ui.Info("\\invite <id> - Invites a user to the room.")
+		ui.Info("\\kick <id> - Kicks a user from the room.")
+	}
+	if hasFeature("edit") {
+		ui.Info("\\edit <number> <text> - Changes the text of one of your messages.")
+		ui.Info("\\delete <number> - Deletes a message.")
+		ui.Info("\\revisions <number> - Shows the earlier versions of a message (moderators only).")
+	}
+	if hasFeature("threads") {
+		ui.Info("\\reply <number> <text> - Replies to a message.")
+		ui.Info("\\thread <number> - Shows the thread a message is part of.")
+	}
+	if hasFeature("reactions") {
+		ui.Info("\\react <number> <emoji> - Reacts to a message, like \\react 42 :thumbsup:")
+		ui.Info("\\unreact <number> <emoji> - Takes back a reaction.")
+	}
+	if hasFeature("search") {
+		ui.Info("\\search <words> [from:<id>] [in:<room>] [lamport:<from>-<to>] [page:<n>] - Searches the history.")
+	}
+	if hasFeature("attachments") {
+		ui.Info("\\send <path> - Sends a file, at most %d bytes.", maxAttachmentSize)
+		ui.Info("\\get <number> - Saves the file attached to a message in the current directory.")
+	}
+	if hasFeature("mentions") {
+		ui.Info("@<name> - Mentions a user in a message, the user is notified even in another room.")
+	}
+	if _, isTUI := ui.(*tui); isTUI {
+		ui.Info("Tab/Shift+Tab - Switches room. PgUp/PgDn - Scrolls. Ctrl+C - Leaves.")
+	}
+	ui.Info("------------------------------------")
 }
 
 func max(x, y uint64) uint64{
@@ -204,6 +400,80 @@ func max(x, y uint64) uint64{
 	}
 }
 
+// Validates a message against the limits of the server
 func validateMsg(x string) bool {
-	return len(x) <= 128
-}
\ No newline at end of file
+	return validateText(x, maxMessageLength)
+}
+
+// A valid text is non-empty UTF-8 without control characters and at most max characters (not bytes) long
+func validateText(x string, max int) bool {
+	if x == "" || !utf8.ValidString(x) || utf8.RuneCountInString(x) > max {
+		return false
+	}
+	for _, r := range x {
+		if unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// Asks the server who it is and what it supports. Older servers do not know GetServerInfo,
+// in that case we keep the defaults and assume the server has no optional features
+func checkServer() {
+	info, err := client.GetServerInfo(context.Background(), &proto.Empty{})
+	if status.Code(err) == codes.Unimplemented {
+		ui.Info("The server is an older version of Chitty-Chat. Some features might not be available.")
+		return
+	}
+	if err != nil {
+		log.Fatalf("Could not get server info: %v", err)
+	}
+
+	// A server speaking a newer protocol might send us things we do not understand
+	if info.ProtocolVersion > protocolVersion {
+		ui.Info("The server speaks a newer protocol (version %d) than this client (version %d). Please consider updating your client.", info.ProtocolVersion, protocolVersion)
+	}
+
+	// Receiving the server info is an event
+	mu.Lock()
+	lamport = max(lamport, info.Lamport) + 1
+	mu.Unlock()
+
+	maxMessageLength = int(info.MaxMessageLength)
+	maxNameLength = int(info.MaxNameLength)
+	if info.MaxAttachmentSize > 0 {
+		maxAttachmentSize = info.MaxAttachmentSize
+	}
+	for _, feature := range info.Features {
+		serverFeatures[feature] = true
+	}
+	log.Printf("[Client: %d] Connected to Chitty-Chat server version %s", lamport, info.ServerVersion)
+}
+
+// The room we currently chat in
+func currentRoom() string {
+	mu.Lock()
+	defer mu.Unlock()
+	return room
+}
+
+// Switches the room we chat in
+func setRoom(name string) {
+	mu.Lock()
+	defer mu.Unlock()
+	room = name
+}
+
+// Checks if the server we are connected to supports the given feature
+func hasFeature(feature string) bool {
+	return serverFeatures[feature]
+}
+
+// Reads the number of seconds to wait from the trailer sent by the server when it rate limits us
+func retryAfter(trailer metadata.MD) string {
+	if values := trailer.Get("retry-after"); len(values) > 0 {
+		return values[0]
+	}
+	return "a few"
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How often a peer announces itself on the local network
+const announceInterval = time.Second
+
+// Prefix of the announcements, so other traffic on the group is ignored
+const announcePrefix = "chitty-chat"
+
+// Finds the other peers on the local network. Every peer sends "chitty-chat <instance> <port>" to the multicast group,
+// and connects to the peers it hears from, at the address the announcement came from. The instance is random,
+// so a peer can tell its own announcements apart
+func discover(n *p2pNode, group string) error {
+	address, err := net.ResolveUDPAddr("udp4", group)
+	if err != nil {
+		return err
+	}
+	listener, err := net.ListenMulticastUDP("udp4", nil, address)
+	if err != nil {
+		return err
+	}
+	sender, err := net.DialUDP("udp4", nil, address)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	instance := make([]byte, 8)
+	rand.Read(instance)
+	me := hex.EncodeToString(instance)
+
+	go func() {
+		announcement := []byte(fmt.Sprintf("%s %s %s", announcePrefix, me, n.port))
+		for range time.Tick(announceInterval) {
+			if _, err := sender.Write(announcement); err != nil {
+				log.Printf("[Peer] Could not announce ourselves: %v", err)
+			}
+		}
+	}()
+	go func() {
+		buffer := make([]byte, 256)
+		for {
+			size, from, err := listener.ReadFromUDP(buffer)
+			if err != nil {
+				log.Printf("[Peer] Stopped listening for other peers: %v", err)
+				return
+			}
+			fields := strings.Fields(string(buffer[:size]))
+			if len(fields) != 3 || fields[0] != announcePrefix || fields[1] == me {
+				continue
+			}
+			if _, err := strconv.Atoi(fields[2]); err != nil {
+				continue
+			}
+			n.addPeer(net.JoinHostPort(from.IP.String(), fields[2]))
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/00kristian/MiniProject_2/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Commands for changing messages that have already been sent, and the feature the server needs for them.
+// Messages are referred to by the number shown in front of them
+var editCommands = map[string]string{
+	"\\edit":      "edit",
+	"\\delete":    "edit",
+	"\\revisions": "edit",
+	"\\react":     "reactions",
+	"\\unreact":   "reactions",
+}
+
+// Checks if the text is one of the edit commands
+func isEditCommand(text string) bool {
+	_, found := editCommands[strings.Fields(text + " ")[0]]
+	return found
+}
+
+// Runs an edit command. The message carries who we are and the lamport time of the command
+func editCommand(msg *proto.Message) {
+	fields := strings.Fields(msg.Text)
+	command, args := fields[0], fields[1:]
+	if !hasFeature(editCommands[command]) {
+		ui.Info("The server does not support %s.", command)
+		return
+	}
+	if len(args) == 0 {
+		ui.Info("Wrong use of the command. Type \\help to see how to use it.")
+		return
+	}
+	ref, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		ui.Info("%q is not a message number.", args[0])
+		return
+	}
+	req := &proto.Message{Id: msg.Id, Lamport: msg.Lamport, Room: msg.Room, Ref: ref}
+
+	var trailer metadata.MD
+	switch {
+	case command == "\\edit" && len(args) > 1:
+		req.Text = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(strings.TrimPrefix(msg.Text, command)), args[0]))
+		_, err = client.Edit(context.Background(), req, grpc.Trailer(&trailer))
+	case command == "\\delete" && len(args) == 1:
+		_, err = client.Delete(context.Background(), req, grpc.Trailer(&trailer))
+	case command == "\\revisions" && len(args) == 1:
+		err = printRevisions(req)
+	case command == "\\react" && len(args) == 2:
+		req.Text, req.Event = args[1], proto.EventType_EVENT_REACT
+		_, err = client.React(context.Background(), req, grpc.Trailer(&trailer))
+	case command == "\\unreact" && len(args) == 2:
+		req.Text, req.Event = args[1], proto.EventType_EVENT_UNREACT
+		_, err = client.React(context.Background(), req, grpc.Trailer(&trailer))
+	default:
+		ui.Info("Wrong use of the command. Type \\help to see how to use it.")
+		return
+	}
+
+	// Being denied is not fatal, the user is just told why
+	switch status.Code(err) {
+	case codes.OK:
+	case codes.ResourceExhausted:
+		ui.Info("You are sending messages too fast. Please wait %s seconds before trying again.", retryAfter(trailer))
+	case codes.PermissionDenied, codes.NotFound, codes.InvalidArgument, codes.FailedPrecondition:
+		ui.Info("%s", status.Convert(err).Message())
+	default:
+		fatalf("Error occured when running %s: %v", command, err)
+	}
+}
+
+// Prints the earlier versions of a message, oldest first
+func printRevisions(req *proto.Message) error {
+	list, err := client.Revisions(context.Background(), req)
+	if err != nil {
+		return err
+	}
+	ui.Info("------------------------------------")
+	if len(list.Messages) == 0 {
+		ui.Info("Message %d has not been changed.", req.Ref)
+	}
+	for _, revision := range list.Messages {
+		ui.Info("[%d] %s: %s", revision.Lamport, revision.Id, revision.Text)
+	}
+	ui.Info("------------------------------------")
+	return nil
+}
+
+// The reactions on a message as a short tally, like ":thumbsup: 2  :tada: 1"
+func tally(reactions []*proto.Reaction) string {
+	var counts []string
+	for _, reaction := range reactions {
+		counts = append(counts, fmt.Sprintf("%s %d", reaction.Emoji, reaction.Count))
+	}
+	return strings.Join(counts, "  ")
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/00kristian/MiniProject_2/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/status"
+)
+
+// Scheme of the targets resolved by our resolver, like "chitty:///host1:8080,host2:8080"
+const endpointScheme = "chitty"
+
+// How often the servers are health checked, and how long a check may take
+const healthInterval = 2 * time.Second
+const healthTimeout = time.Second
+
+// How long we try to reach another server before giving up, and how long we wait between tries
+const failoverTimeout = 30 * time.Second
+const retryInterval = 200 * time.Millisecond
+
+// Resolves a list of server addresses to the ones that are healthy. grpc connects to the first of them,
+// and stays on it until it goes down, then it moves on to the next healthy server
+type endpointBuilder struct{}
+
+func (endpointBuilder) Scheme() string {
+	return endpointScheme
+}
+
+func (endpointBuilder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
+	r := &endpointResolver{
+		cc:     cc,
+		checks: make(map[string]*grpc.ClientConn),
+		now:    make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	for _, address := range strings.Split(target.Endpoint, ",") {
+		// The health checks use their own connections, so they do not disturb the chat connection
+		c, err := grpc.Dial(address, grpc.WithInsecure())
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.endpoints = append(r.endpoints, address)
+		r.checks[address] = c
+	}
+	go r.watch()
+	return r, nil
+}
+
+// Health checks the servers in the background and tells grpc which of them it can use
+type endpointResolver struct {
+	cc        resolver.ClientConn
+	endpoints []string
+	checks    map[string]*grpc.ClientConn
+	now       chan struct{}
+	done      chan struct{}
+	closing   sync.Once
+
+	// The addresses grpc was told about last
+	healthy []string
+}
+
+// Called by grpc when the connection broke - check the servers right away instead of waiting for the next round
+func (r *endpointResolver) ResolveNow(resolver.ResolveNowOptions) {
+	select {
+	case r.now <- struct{}{}:
+	default:
+	}
+}
+
+func (r *endpointResolver) Close() {
+	r.closing.Do(func() {
+		close(r.done)
+		for _, c := range r.checks {
+			c.Close()
+		}
+	})
+}
+
+// Checks the servers until the resolver is closed
+func (r *endpointResolver) watch() {
+	ticker := time.NewTicker(healthInterval)
+	defer ticker.Stop()
+	for {
+		r.update()
+		select {
+		case <-ticker.C:
+		case <-r.now:
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// Tells grpc about the healthy servers, in the order they were given. If none of them are healthy
+// grpc gets all of them, so it keeps trying until one of them comes back
+func (r *endpointResolver) update() {
+	var healthy []string
+	for _, address := range r.endpoints {
+		if r.isHealthy(address) {
+			healthy = append(healthy, address)
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = r.endpoints
+	}
+	if strings.Join(healthy, ",") == strings.Join(r.healthy, ",") {
+		return
+	}
+	r.healthy = healthy
+
+	state := resolver.State{}
+	for _, address := range healthy {
+		state.Addresses = append(state.Addresses, resolver.Address{Addr: address})
+	}
+	r.cc.UpdateState(state)
+}
+
+func (r *endpointResolver) isHealthy(address string) bool {
+	return isServing(r.checks[address])
+}
+
+// Asks the server if it is serving. Older servers do not have the health service, they are healthy if they answer at all
+func isServing(c *grpc.ClientConn) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), healthTimeout)
+	defer cancel()
+	reply, err := healthpb.NewHealthClient(c).Check(ctx, &healthpb.HealthCheckRequest{Service: "proto.Chat"})
+	if status.Code(err) == codes.Unimplemented {
+		return true
+	}
+	return err == nil && reply.Status == healthpb.HealthCheckResponse_SERVING
+}
+
+// The servers we were given with -server
+var endpoints []string
+
+// Parses the comma separated list of server addresses
+func parseEndpoints(list string) []string {
+	var parsed []string
+	for _, address := range strings.Split(list, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			parsed = append(parsed, address)
+		}
+	}
+	return parsed
+}
+
+// Moves the address to the front of the servers, so grpc connects to it first
+func prefer(address string) {
+	list := []string{address}
+	for _, endpoint := range endpoints {
+		if endpoint != address {
+			list = append(list, endpoint)
+		}
+	}
+	endpoints = list
+}
+
+// Number of messages we remember we were shown
+const deliveredRemembered = 10000
+
+// The messages we were shown, so we can resume from the last one on another server. Messages are known by their uid,
+// which every server keeps, unlike the sequence number and the lamport time they give a message
+var delivered = struct {
+	sync.Mutex
+	// The uid of the last message shown in each room
+	last map[string]string
+	// The uids of the messages shown most recently
+	seen  map[string]bool
+	order []string
+}{last: make(map[string]string), seen: make(map[string]bool)}
+
+// Records a message shown to the user. Messages without a uid are not in the history, so there is nothing to resume from
+func deliver(msg *proto.Message) {
+	if msg.Uid == "" {
+		return
+	}
+	delivered.Lock()
+	defer delivered.Unlock()
+	delivered.last[msg.Room] = msg.Uid
+	if delivered.seen[msg.Uid] {
+		return
+	}
+	delivered.seen[msg.Uid] = true
+	delivered.order = append(delivered.order, msg.Uid)
+	if len(delivered.order) > deliveredRemembered {
+		delete(delivered.seen, delivered.order[0])
+		delivered.order = delivered.order[1:]
+	}
+}
+
+// Checks if the message was shown to the user before
+func wasShown(msg *proto.Message) bool {
+	delivered.Lock()
+	defer delivered.Unlock()
+	return delivered.seen[msg.Uid]
+}
+
+// Every time we join a server the channel is closed and replaced, so calls that failed while we moved can wait for us to join again.
+// Moving is true from when we lost the server until we joined another one
+var joins = struct {
+	sync.Mutex
+	next   chan struct{}
+	moving bool
+}{next: make(chan struct{})}
+
+// Tells whoever waits that we joined a server
+func joined() {
+	joins.Lock()
+	defer joins.Unlock()
+	close(joins.next)
+	joins.next = make(chan struct{})
+	joins.moving = false
+}
+
+// Waits until we joined another server, if we are moving. Returns false if that takes too long
+func settled() bool {
+	joins.Lock()
+	next, moving := joins.next, joins.moving
+	joins.Unlock()
+	if !moving {
+		return true
+	}
+	select {
+	case <-next:
+		return true
+	case <-time.After(failoverTimeout):
+		return false
+	}
+}
+
+// A channel that is closed the next time we join a server. Take it before the call that might fail,
+// so a join that happens while the call fails is not missed
+func nextJoin() chan struct{} {
+	joins.Lock()
+	defer joins.Unlock()
+	return joins.next
+}
+
+// Waits for the connection to get to another server after the one we used went away, and joins again.
+// Returns false if no server could be reached
+func failover() bool {
+	ui.Info("Lost the connection to the server, trying the other servers...")
+	joins.Lock()
+	joins.moving = true
+	joins.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), failoverTimeout)
+	defer cancel()
+
+	// Waiting for the server info makes grpc pick a healthy server
+	var server peer.Peer
+	if _, err := client.GetServerInfo(ctx, &proto.Empty{}, grpc.WaitForReady(true), grpc.Peer(&server)); err != nil {
+		return false
+	}
+	checkServer()
+	ui.Info("Connected to the server at %s", server.Addr)
+	join(me, myName)
+	return true
+}
+
+// Shows the messages we missed while we moved to another server: those after the last one we were shown in the history of the room.
+// Returns the uids of the messages shown, so they are not shown again when they also come through the new stream
+func resume() map[string]bool {
+	room := currentRoom()
+	delivered.Lock()
+	last := delivered.last[room]
+	delivered.Unlock()
+	if last == "" || !hasFeature("history") {
+		return nil
+	}
+
+	list, err := client.History(context.Background(), &proto.HistoryRequest{Room: room, Limit: 1000})
+	if err != nil {
+		ui.Info("Could not get the messages we missed: %s", status.Convert(err).Message())
+		return nil
+	}
+	start := -1
+	for i, msg := range list.Messages {
+		if msg.Uid == last {
+			start = i
+		}
+	}
+	if start < 0 {
+		ui.Info("The last message we got is not in the history of this server, messages sent while we moved may be missing")
+		return nil
+	}
+	shown := make(map[string]bool)
+	for _, msg := range list.Messages[start+1:] {
+		if wasShown(msg) {
+			continue
+		}
+		mu.Lock()
+		lamport = max(lamport, msg.Lamport) + 1
+		received := lamport
+		mu.Unlock()
+		ui.Show(msg, received)
+		remember(msg)
+		deliver(msg)
+		shown[msg.Uid] = true
+	}
+	return shown
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/00kristian/MiniProject_2/proto"
+	"golang.org/x/term"
+)
+
+// The terminal bell
+const bell = "\a"
+
+// Checks if the message mentions us
+func mentionsMe(msg *proto.Message) bool {
+	for _, id := range msg.Mentions {
+		if id == me {
+			return true
+		}
+	}
+	return false
+}
+
+// Highlights text in line mode - bold if the log goes to a terminal, otherwise marked with stars
+func highlight(text string) string {
+	if term.IsTerminal(int(os.Stderr.Fd())) {
+		return "\x1b[1m" + text + "\x1b[0m"
+	}
+	return "*" + text + "*"
+}
+
+// The text telling us that we were mentioned in another room
+func mentionNotice(msg *proto.Message) string {
+	return fmt.Sprintf("%s mentioned you in #%s (%d): %s", msg.Id, msg.Room, msg.Ref, msg.Text)
+}
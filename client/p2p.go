@@ -0,0 +1,481 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/00kristian/MiniProject_2/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+// Metadata keys peers send with every message: who sent it to us, the port to reach them on, who published it,
+// and the run of the peer that published it
+const (
+	hopKey    = "chitty-peer"
+	portKey   = "chitty-port"
+	originKey = "chitty-origin"
+	epochKey  = "chitty-epoch"
+)
+
+// How often peers tell each other their lamport time, and how long a peer can be quiet before it is gone
+const heartbeatInterval = 250 * time.Millisecond
+const peerTimeout = 3 * time.Second
+
+// Number of messages waiting to be sent to a peer before new messages are dropped
+const outboxSize = 1000
+
+// How long we wait before sending a message to a peer again, and how long leaving waits for the messages to go out
+const resendInterval = 500 * time.Millisecond
+const flushTimeout = 2 * time.Second
+
+// A peer in serverless mode. It serves the Chat service to our own client, which uses it just like a server,
+// and to the other peers, which publish their messages on it.
+//
+// Messages are broadcast with the lamport algorithm for totally ordered multicast: every peer stamps its messages
+// with its lamport time and a sequence number of its own, and sends them to every other peer, in order and again
+// until they got it. Peers regularly send their lamport time, and a message is delivered once it has the lowest
+// time of the waiting messages, and every other peer has been heard from at a later time. Since the lamport time
+// of a message is higher than that of every message it could have seen, messages are delivered in causal order,
+// and every peer delivers them in the same order. Messages are passed on by the peers that get them, so
+// a message reaches everybody even if its sender goes away halfway through sending it.
+//
+// Peers that join later, or only hear from a peer through others, start with the first message they get from it.
+// A peer that restarts numbers its messages from 1 again, so every run of a peer has an epoch, the time it started,
+// and messages from a later run replace what we knew about the earlier one
+type p2pNode struct {
+	// Has to be implemented, otherwise the grpc cannot register
+	proto.UnimplementedChatServer
+	address string
+	port    string
+	// The run of this peer
+	epoch uint64
+
+	// Delivering is done by one goroutine at a time, so messages reach our client in order
+	delivering sync.Mutex
+	// Only one message is sent to our client at a time
+	showing sync.Mutex
+
+	mu sync.Mutex
+	// Our id, known once our client joined. Messages and heartbeats are only sent after that.
+	// Joined is closed when our client joined
+	joined  chan struct{}
+	id      string
+	user    *proto.User
+	stream  proto.Chat_JoinServer
+	lamport uint64
+	// Sequence number of the last message we published, and the messages we published most recently
+	seq  uint64
+	sent []*pendingMessage
+
+	// The peers we send to, by address
+	peers map[string]*p2pPeer
+	// The latest lamport time each peer sent us itself, and when we last heard from it, by id
+	clocks   map[string]uint64
+	lastSeen map[string]time.Time
+	// The run of every peer we know
+	epochs map[string]uint64
+	// Messages waiting to be delivered, and the sequence number of the last message delivered from every peer.
+	// A peer is only in delivered once we got a message from it, the one before that is where we start
+	pending   []*pendingMessage
+	delivered map[string]uint64
+	// Number of messages delivered to our client, which numbers them like the server numbers its history
+	count uint64
+}
+
+// A message waiting to be delivered, with the peer that published it and the run of the peer it was published in
+type pendingMessage struct {
+	origin string
+	epoch  uint64
+	msg    *proto.Message
+}
+
+// A peer we send to, with the messages waiting to be sent to it
+type p2pPeer struct {
+	address string
+	client  proto.ChatClient
+	outbox  chan *pendingMessage
+}
+
+// Starts a peer listening on the address, and connects to the peers given
+func startPeer(address string, peers []string) (*p2pNode, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	n := &p2pNode{
+		address:   peerAddress(listener.Addr().String()),
+		port:      port,
+		epoch:     uint64(time.Now().UnixNano()),
+		joined:    make(chan struct{}),
+		peers:     make(map[string]*p2pPeer),
+		clocks:    make(map[string]uint64),
+		lastSeen:  make(map[string]time.Time),
+		epochs:    make(map[string]uint64),
+		delivered: make(map[string]uint64),
+	}
+	for _, peer := range peers {
+		n.addPeer(peer)
+	}
+
+	grpcServer := grpc.NewServer()
+	proto.RegisterChatServer(grpcServer, n)
+	go grpcServer.Serve(listener)
+	go n.heartbeat()
+	return n, nil
+}
+
+// Starts sending to the peer at the address, unless we already do
+func (n *p2pNode) addPeer(address string) {
+	address = peerAddress(address)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, found := n.peers[address]; found || address == n.address {
+		return
+	}
+	conn, err := grpc.Dial(address, grpc.WithInsecure())
+	if err != nil {
+		log.Printf("[Peer] Could not connect to %s: %v", address, err)
+		return
+	}
+	peer := &p2pPeer{address: address, client: proto.NewChatClient(conn), outbox: make(chan *pendingMessage, outboxSize)}
+	n.peers[address] = peer
+	// The peer gets what we published recently before we knew it first, so everything we sent comes in order.
+	// It starts with the first of them, so it does not matter what we sent before
+	for _, out := range n.sent {
+		peer.outbox <- out
+	}
+	go n.send(peer)
+}
+
+// Sends the messages waiting for the peer, in order. A message is sent again until the peer got it,
+// heartbeats are just dropped if the peer can not be reached
+func (n *p2pNode) send(peer *p2pPeer) {
+	for out := range peer.outbox {
+		for {
+			n.mu.Lock()
+			id := n.id
+			n.mu.Unlock()
+			ctx, cancel := context.WithTimeout(context.Background(), resendInterval)
+			ctx = metadata.AppendToOutgoingContext(ctx, hopKey, id, portKey, n.port, originKey, out.origin, epochKey, strconv.FormatUint(out.epoch, 10))
+			_, err := peer.client.Publish(ctx, out.msg)
+			cancel()
+			if err == nil || isHeartbeat(out.msg) {
+				break
+			}
+			time.Sleep(resendInterval)
+		}
+	}
+}
+
+// Queues a message for every peer but the ones given
+func (n *p2pNode) broadcast(out *pendingMessage, except ...string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	skip := make(map[string]bool)
+	for _, address := range except {
+		skip[address] = true
+	}
+	for _, peer := range n.peers {
+		if skip[peer.address] {
+			continue
+		}
+		select {
+		case peer.outbox <- out:
+		default:
+			if !isHeartbeat(out.msg) {
+				log.Printf("[Peer] Too many messages waiting for %s, dropping a message from %s", peer.address, out.origin)
+			}
+		}
+	}
+}
+
+// Heartbeats have no text and no sequence number, they only carry the lamport time of the peer
+func isHeartbeat(msg *proto.Message) bool {
+	return msg.Text == "" && msg.Seq == 0
+}
+
+// Sends our lamport time to the peers, and lets the peers we have not heard from in a while go
+func (n *p2pNode) heartbeat() {
+	for range time.Tick(heartbeatInterval) {
+		n.mu.Lock()
+		id, current := n.id, n.lamport
+		var gone []string
+		for peer, seen := range n.lastSeen {
+			if time.Since(seen) > peerTimeout {
+				gone = append(gone, peer)
+				delete(n.lastSeen, peer)
+			}
+		}
+		n.mu.Unlock()
+
+		for _, peer := range gone {
+			n.show(&proto.Message{Text: peer + " can not be reached anymore", Lamport: current})
+		}
+		if id != "" {
+			n.broadcast(&pendingMessage{origin: id, epoch: n.epoch, msg: &proto.Message{Id: id, Lamport: current}})
+		}
+		n.deliver()
+	}
+}
+
+// Implementation of the Join rpc for our own client - the stream gets every message delivered in its room
+func (n *p2pNode) Join(user *proto.User, stream proto.Chat_JoinServer) error {
+	n.mu.Lock()
+	if n.stream == nil {
+		close(n.joined)
+	}
+	n.id, n.user, n.stream = user.Id, user, stream
+	n.mu.Unlock()
+	// The client waits for the header before it goes on. There are no sessions without a server
+	stream.SendHeader(metadata.MD{})
+	// Tell the peers, like the server does when a user joins
+	if _, err := n.publishOwn(&proto.Message{Text: user.Name + " joined Chitty-Chat at Lamport time "}); err != nil {
+		return err
+	}
+	<-stream.Context().Done()
+	return stream.Context().Err()
+}
+
+// Implementation of the Publish rpc. Our own client publishes the messages of the user, which are broadcast to the peers,
+// and the peers publish the messages they got
+func (n *p2pNode) Publish(ctx context.Context, msg *proto.Message) (*proto.Empty, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if len(md.Get(hopKey)) == 0 {
+		return n.publishOwn(msg)
+	}
+	hop, origin := md.Get(hopKey)[0], first(md.Get(originKey))
+	epoch, _ := strconv.ParseUint(first(md.Get(epochKey)), 10, 64)
+	// Peers only have to know some of the others, they learn about the rest from who sends to them
+	var address string
+	if from, found := peer.FromContext(ctx); found && first(md.Get(portKey)) != "" {
+		host, _, _ := net.SplitHostPort(from.Addr.String())
+		address = peerAddress(net.JoinHostPort(host, first(md.Get(portKey))))
+		n.addPeer(address)
+	}
+
+	n.mu.Lock()
+	if hop == n.id || origin == n.id {
+		n.mu.Unlock()
+		return &proto.Empty{}, nil
+	}
+	// A peer that has not joined yet can pass messages on, but it is not one of the peers we wait for
+	if hop != "" {
+		if _, known := n.lastSeen[hop]; !known {
+			defer n.show(&proto.Message{Text: hop + " is reachable", Lamport: msg.Lamport})
+		}
+		n.lastSeen[hop] = time.Now()
+	}
+	// Messages from an earlier run of the peer may still be passed around after it restarted
+	if epoch < n.epochs[origin] {
+		n.mu.Unlock()
+		return &proto.Empty{}, nil
+	}
+	if epoch > n.epochs[origin] {
+		n.restarted(origin, epoch)
+	}
+	n.lamport = max(n.lamport, msg.Lamport) + 1
+	// What a peer sends itself comes in order, so nothing earlier from it can arrive later
+	if hop == origin {
+		n.clocks[origin] = max(n.clocks[origin], msg.Lamport)
+	}
+	if _, known := n.delivered[origin]; !known && !isHeartbeat(msg) {
+		n.delivered[origin] = msg.Seq - 1
+	}
+	fresh := !isHeartbeat(msg) && msg.Seq > n.delivered[origin] && !n.isPending(origin, msg.Seq)
+	if fresh {
+		n.pending = append(n.pending, &pendingMessage{origin: origin, epoch: epoch, msg: msg})
+	}
+	n.mu.Unlock()
+
+	// Pass new messages on, in case the sender did not get to send them to everybody
+	if fresh {
+		n.broadcast(&pendingMessage{origin: origin, epoch: epoch, msg: msg}, address)
+	}
+	n.deliver()
+	return &proto.Empty{}, nil
+}
+
+// Forgets what we knew about the earlier run of a peer. Its waiting messages are dropped, they can not be delivered anymore,
+// and we start again with the first message we get from the new run. The caller must hold n.mu
+func (n *p2pNode) restarted(origin string, epoch uint64) {
+	n.epochs[origin] = epoch
+	delete(n.delivered, origin)
+	delete(n.clocks, origin)
+	pending := n.pending[:0]
+	for _, p := range n.pending {
+		if p.origin != origin {
+			pending = append(pending, p)
+		}
+	}
+	n.pending = pending
+}
+
+// Stamps a message of our own user and broadcasts it. Join messages get the lamport time appended, like the server does
+func (n *p2pNode) publishOwn(msg *proto.Message) (*proto.Empty, error) {
+	if msg.Text == "" {
+		return nil, status.Error(codes.InvalidArgument, "text must not be empty")
+	}
+	// The client may publish right after it opened the Join stream, which may not have reached us yet
+	select {
+	case <-n.joined:
+	case <-time.After(flushTimeout):
+		return nil, status.Error(codes.FailedPrecondition, "join before publishing")
+	}
+	n.mu.Lock()
+	n.lamport = max(n.lamport, msg.Lamport) + 1
+	n.seq++
+	msg.Lamport, msg.Seq = n.lamport, n.seq
+	if msg.Id == "" {
+		msg.Text += fmt.Sprintf("%d", n.lamport)
+	}
+	out := &pendingMessage{origin: n.id, epoch: n.epoch, msg: msg}
+	n.pending = append(n.pending, out)
+	n.sent = append(n.sent, out)
+	if len(n.sent) > outboxSize/2 {
+		n.sent = n.sent[1:]
+	}
+	n.mu.Unlock()
+
+	n.broadcast(out)
+	n.deliver()
+	return &proto.Empty{}, nil
+}
+
+// Implementation of the Leave rpc for our own client - tells the peers, and waits a little for the messages to go out
+func (n *p2pNode) Leave(ctx context.Context, id *proto.Id) (*proto.Empty, error) {
+	if _, err := n.publishOwn(&proto.Message{Text: id.Id + " left Chitty-Chat at Lamport time ", Lamport: id.Lamport}); err != nil {
+		return nil, err
+	}
+	for deadline := time.Now().Add(flushTimeout); time.Now().Before(deadline) && n.sending(); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return &proto.Empty{}, nil
+}
+
+// Implementation of the GetServerInfo rpc for our own client. There is no server, so none of the optional features are there
+func (n *p2pNode) GetServerInfo(ctx context.Context, _ *proto.Empty) (*proto.ServerInfo, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return &proto.ServerInfo{
+		MaxMessageLength: uint32(maxMessageLength),
+		MaxNameLength:    uint32(maxNameLength),
+		ServerVersion:    "peer-to-peer",
+		ProtocolVersion:  protocolVersion,
+		Lamport:          n.lamport,
+	}, nil
+}
+
+// Checks if there are messages waiting to be sent to a peer
+func (n *p2pNode) sending() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, peer := range n.peers {
+		if len(peer.outbox) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks if the message is waiting to be delivered already. The caller must hold n.mu
+func (n *p2pNode) isPending(origin string, seq uint64) bool {
+	for _, p := range n.pending {
+		if p.origin == origin && p.msg.Seq == seq {
+			return true
+		}
+	}
+	return false
+}
+
+// Delivers the waiting messages that can be delivered, in order of lamport time
+func (n *p2pNode) deliver() {
+	n.delivering.Lock()
+	defer n.delivering.Unlock()
+	n.mu.Lock()
+	// Messages are kept until our client joined, so it gets all of them
+	if n.stream == nil {
+		n.mu.Unlock()
+		return
+	}
+	sort.Slice(n.pending, func(i, j int) bool {
+		a, b := n.pending[i], n.pending[j]
+		if a.msg.Lamport != b.msg.Lamport {
+			return a.msg.Lamport < b.msg.Lamport
+		}
+		return a.origin < b.origin
+	})
+	var ready []*proto.Message
+	for len(n.pending) > 0 && n.deliverable(n.pending[0]) {
+		next := n.pending[0]
+		n.pending = n.pending[1:]
+		n.delivered[next.origin] = next.msg.Seq
+		n.count++
+		msg := protobuf.Clone(next.msg).(*proto.Message)
+		msg.Seq = n.count
+		ready = append(ready, msg)
+	}
+	n.mu.Unlock()
+
+	for _, msg := range ready {
+		n.show(msg)
+	}
+}
+
+// A message can be delivered when it is the next one from its peer, and every other peer that is around
+// has sent us a later lamport time, so no message with an earlier time can still come. The caller must hold n.mu
+func (n *p2pNode) deliverable(p *pendingMessage) bool {
+	if p.msg.Seq != n.delivered[p.origin]+1 {
+		return false
+	}
+	for peer := range n.lastSeen {
+		if peer != p.origin && n.clocks[peer] <= p.msg.Lamport {
+			return false
+		}
+	}
+	return true
+}
+
+// Sends a delivered message to our own client, if it is in the room of the user. Only one message is sent at a time,
+// and a slow client does not hold up the messages coming from the peers
+func (n *p2pNode) show(msg *proto.Message) {
+	n.showing.Lock()
+	defer n.showing.Unlock()
+	n.mu.Lock()
+	stream, user := n.stream, n.user
+	n.mu.Unlock()
+	if stream == nil || (msg.Room != "" && msg.Room != user.Room) {
+		return
+	}
+	stream.Send(msg)
+}
+
+// The address of a peer in the same form, however it was given. Peers on this machine are all at 127.0.0.1
+func peerAddress(address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	if ip := net.ParseIP(host); host == "" || host == "localhost" || (ip != nil && (ip.IsUnspecified() || ip.IsLoopback())) {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/00kristian/MiniProject_2/proto"
+	"golang.org/x/net/context"
+)
+
+// How long answering a heartbeat may take. A late answer counts as a missed one anyway
+const heartbeatTimeout = 5 * time.Second
+
+// Answers a heartbeat from the server, so it knows we are still here. The first answer is sent right after we joined,
+// which tells the server that we answer heartbeats
+func answerHeartbeat() {
+	if !hasFeature("presence") {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), heartbeatTimeout)
+		defer cancel()
+		client.Heartbeat(ctx, &proto.Id{Id: me})
+	}()
+}
+
+// Describes the new status of a user, like "alice seems to be gone"
+func presenceNotice(msg *proto.Message) string {
+	switch msg.Text {
+	case "suspect":
+		return fmt.Sprintf("%s seems to be gone", msg.Id)
+	case "dead":
+		return fmt.Sprintf("%s lost the connection", msg.Id)
+	case "alive":
+		return fmt.Sprintf("%s is back", msg.Id)
+	}
+	return fmt.Sprintf("%s is %s", msg.Id, msg.Text)
+}
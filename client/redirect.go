@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/00kristian/MiniProject_2/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+)
+
+// The connection to the server
+var conn *grpc.ClientConn
+
+// How often we ping the server when the connection is quiet, so a dead connection is found while we wait for messages.
+// Must not be more often than the server allows, or the server disconnects us
+var keepaliveParams = keepalive.ClientParameters{PermitWithoutStream: true}
+
+// Ends the current Join stream
+var endStream context.CancelFunc = func() {}
+
+// Our name, used to join again when we move to another server
+var myName string
+
+// Our session on the server we joined, sent in the header of the Join stream. Every call carries it, so the server
+// knows the calls made as us are made by us. Protected by mu
+var session string
+
+// Metadata key of the session
+const sessionKey = "chitty-session"
+
+// Adds our session to the calls made with the context
+func withSession(ctx context.Context) context.Context {
+	mu.Lock()
+	current := session
+	mu.Unlock()
+	if current == "" {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, sessionKey, current)
+}
+
+// Waits for the header of the Join stream, with our session. A server that does not let us join
+// ends the stream without one, then the error it ended the stream with is returned
+func joinHeader(stream proto.Chat_JoinClient) (metadata.MD, error) {
+	header, err := stream.Header()
+	if err == nil && len(header) == 0 {
+		_, err = stream.Recv()
+	}
+	return header, err
+}
+
+// Unary interceptor adding our session to every call
+func sessionInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return invoker(withSession(ctx), method, req, reply, cc, opts...)
+}
+
+// Connects to the first healthy server of the endpoints - no https, so connect with grpc.WithInsecure().
+// Our resolver checks the health of the servers and moves the connection to another server if ours goes down
+func connect() error {
+	c, err := grpc.Dial(endpointScheme+":///"+strings.Join(endpoints, ","), grpc.WithInsecure(), grpc.WithResolvers(endpointBuilder{}), grpc.WithKeepaliveParams(keepaliveParams), grpc.WithUnaryInterceptor(sessionInterceptor))
+	if err != nil {
+		return err
+	}
+	conn = c
+	client = proto.NewChatClient(conn)
+	return nil
+}
+
+// Moves to the leader if the trailer of a failed call says where it is. A server that is not the leader
+// of a replicated cluster sends the address of the leader in the "leader" trailer. Returns false if there
+// is nowhere to move to
+func redirect(trailer metadata.MD) bool {
+	leaders := trailer.Get("leader")
+	if len(leaders) == 0 {
+		return false
+	}
+	// Right after the leader goes down the other servers still point to it, until they elect a new one
+	if !leaderServing(leaders[0]) {
+		return false
+	}
+	ui.Info("This server is not the leader, moving to the leader at %s", leaders[0])
+
+	endStream()
+	old := conn
+	prefer(leaders[0])
+	if err := connect(); err != nil {
+		fatalf("Could not connect to the leader: %v", err)
+	}
+	old.Close()
+	join(me, myName)
+	return true
+}
+
+// Checks the health of the leader before we move to it
+func leaderServing(address string) bool {
+	c, err := grpc.Dial(address, grpc.WithInsecure())
+	if err != nil {
+		return false
+	}
+	defer c.Close()
+	return isServing(c)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/00kristian/MiniProject_2/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Commands for managing the room and the roles in it
+var roomCommands = map[string]bool{
+	"\\roles":  true,
+	"\\role":   true,
+	"\\topic":  true,
+	"\\invite": true,
+	"\\kick":   true,
+}
+
+// Checks if the text is one of the room commands
+func isRoomCommand(text string) bool {
+	return roomCommands[strings.Fields(text + " ")[0]]
+}
+
+// Runs a room command. The message carries who we are, the room and the lamport time of the command
+func roomCommand(msg *proto.Message) {
+	if !hasFeature("roles") {
+		ui.Info("The server does not support rooms and roles.")
+		return
+	}
+
+	fields := strings.Fields(msg.Text)
+	command, args := fields[0], fields[1:]
+	req := &proto.RoomRequest{Room: msg.Room, Actor: msg.Id, Lamport: msg.Lamport}
+
+	var err error
+	switch {
+	case command == "\\roles":
+		err = printRoles(req)
+	case command == "\\role" && len(args) == 2:
+		var role proto.Role
+		role, err = parseRole(args[1])
+		if err == nil {
+			_, err = client.SetRole(context.Background(), &proto.RoleRequest{Room: msg.Room, Actor: msg.Id, Target: args[0], Role: role, Lamport: msg.Lamport})
+		}
+	case command == "\\topic" && len(args) > 0:
+		req.Topic = strings.TrimSpace(strings.TrimPrefix(msg.Text, command))
+		_, err = client.SetTopic(context.Background(), req)
+	case command == "\\invite" && len(args) == 1:
+		req.Target = args[0]
+		_, err = client.Invite(context.Background(), req)
+	case command == "\\kick" && len(args) == 1:
+		req.Target = args[0]
+		_, err = client.Kick(context.Background(), req)
+	default:
+		ui.Info("Wrong use of the command. Type \\help to see how to use it.")
+		return
+	}
+
+	// Being denied is not fatal, the user is just told why
+	switch status.Code(err) {
+	case codes.OK:
+	case codes.PermissionDenied, codes.NotFound, codes.InvalidArgument:
+		ui.Info("%s", status.Convert(err).Message())
+	default:
+		fatalf("Error occured when running %s: %v", command, err)
+	}
+}
+
+// Prints the topic of the room and the roles of its users
+func printRoles(req *proto.RoomRequest) error {
+	list, err := client.GetRoles(context.Background(), req)
+	if err != nil {
+		return err
+	}
+	ui.Info("------------------------------------")
+	ui.Info("#%s - %s", list.Room, list.Topic)
+	for _, assignment := range list.Roles {
+		ui.Info("%s: %s", assignment.Id, roleName(assignment.Role))
+	}
+	ui.Info("------------------------------------")
+	return nil
+}
+
+// Parses a role name like "moderator" into a role
+func parseRole(name string) (proto.Role, error) {
+	role, found := proto.Role_value["ROLE_"+strings.ToUpper(name)]
+	if !found || role == int32(proto.Role_ROLE_UNSPECIFIED) {
+		return proto.Role_ROLE_UNSPECIFIED, status.Errorf(codes.InvalidArgument, "unknown role %q", name)
+	}
+	return proto.Role(role), nil
+}
+
+// The short lower case name of a role, like "moderator"
+func roleName(role proto.Role) string {
+	return strings.ToLower(strings.TrimPrefix(role.String(), "ROLE_"))
+}
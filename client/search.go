@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/00kristian/MiniProject_2/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Number of hits shown at once
+const searchPage = 10
+
+// Runs "\search <words> [from:<id>] [in:<room>] [lamport:<from>-<to>] [page:<n>]"
+func search(msg *proto.Message) {
+	if !hasFeature("search") {
+		ui.Info("The server does not support searching.")
+		return
+	}
+
+	req := &proto.SearchRequest{Limit: searchPage}
+	var words []string
+	for _, field := range strings.Fields(msg.Text)[1:] {
+		key, value := "", field
+		if i := strings.Index(field, ":"); i > 0 {
+			key, value = field[:i], field[i+1:]
+		}
+		var err error
+		switch key {
+		case "from":
+			req.Sender = value
+		case "in":
+			req.Room = strings.TrimPrefix(value, "#")
+		case "lamport":
+			from, to := value, ""
+			if i := strings.Index(value, "-"); i >= 0 {
+				from, to = value[:i], value[i+1:]
+			}
+			if from != "" {
+				req.FromLamport, err = strconv.ParseUint(from, 10, 64)
+			}
+			if to != "" && err == nil {
+				req.ToLamport, err = strconv.ParseUint(to, 10, 64)
+			}
+		case "page":
+			var page uint64
+			page, err = strconv.ParseUint(value, 10, 32)
+			if err == nil && page > 0 {
+				req.Offset = uint32(page-1) * searchPage
+			}
+		default:
+			words = append(words, field)
+		}
+		if err != nil {
+			ui.Info("%q is not a number.", value)
+			return
+		}
+	}
+	req.Query = strings.Join(words, " ")
+
+	result, err := client.Search(context.Background(), req)
+	if status.Code(err) == codes.InvalidArgument {
+		ui.Info("%s", status.Convert(err).Message())
+		return
+	}
+	if err != nil {
+		fatalf("Error occured when searching: %v", err)
+	}
+
+	ui.Info("------------------------------------")
+	if result.Total == 0 {
+		ui.Info("Nothing found.")
+	}
+	for _, hit := range result.Hits {
+		ui.Info("[%d] #%s (%d) %s: %s", hit.Message.Lamport, hit.Message.Room, hit.Message.Seq, hit.Message.Id, hit.Highlighted)
+	}
+	if shown := req.Offset + uint32(len(result.Hits)); shown < result.Total {
+		ui.Info("Showing %d-%d of %d. Add page:%d to see more.", req.Offset+1, shown, result.Total, req.Offset/searchPage+2)
+	}
+	ui.Info("------------------------------------")
+}
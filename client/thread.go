@@ -0,0 +1,133 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/00kristian/MiniProject_2/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Number of received messages remembered, so replies can quote the message they reply to
+const remembered = 1000
+
+// The messages received most recently, by sequence number
+var recent = struct {
+	sync.Mutex
+	messages map[uint64]*proto.Message
+	order    []uint64
+}{messages: make(map[uint64]*proto.Message)}
+
+// Remembers a received message. Edits and deletes change the remembered message they refer to
+func remember(msg *proto.Message) {
+	recent.Lock()
+	defer recent.Unlock()
+	switch msg.Event {
+	case proto.EventType_EVENT_EDIT:
+		if target, found := recent.messages[msg.Ref]; found {
+			target.Text = msg.Text
+		}
+		return
+	case proto.EventType_EVENT_DELETE:
+		if target, found := recent.messages[msg.Ref]; found {
+			target.Text, target.Deleted = "", true
+		}
+		return
+	case proto.EventType_EVENT_REACT, proto.EventType_EVENT_UNREACT:
+		return
+	}
+	if msg.Seq == 0 || msg.Id == "" {
+		return
+	}
+	recent.messages[msg.Seq] = msg
+	recent.order = append(recent.order, msg.Seq)
+	if len(recent.order) > remembered {
+		delete(recent.messages, recent.order[0])
+		recent.order = recent.order[1:]
+	}
+}
+
+// A short quote of the message with the given sequence number, like `alice: "hello every…"`
+func quote(seq uint64) string {
+	recent.Lock()
+	defer recent.Unlock()
+	parent, found := recent.messages[seq]
+	switch {
+	case !found:
+		return "message " + strconv.FormatUint(seq, 10)
+	case parent.Deleted:
+		return parent.Id + ": (deleted)"
+	}
+	text := []rune(parent.Text)
+	if len(text) > 30 {
+		text = append(text[:29], '…')
+	}
+	return parent.Id + ": \"" + string(text) + "\""
+}
+
+// Turns "\reply <number> <text>" into a reply to the message with that number.
+// Returns false if the command is used wrong
+func parseReply(msg *proto.Message) bool {
+	fields := strings.Fields(msg.Text)
+	if !hasFeature("threads") {
+		ui.Info("The server does not support replies.")
+		return false
+	}
+	if len(fields) < 3 {
+		ui.Info("Wrong use of the command. Type \\help to see how to use it.")
+		return false
+	}
+	parent, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		ui.Info("%q is not a message number.", fields[1])
+		return false
+	}
+	msg.Parent = parent
+	msg.Text = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(strings.TrimPrefix(msg.Text, fields[0])), fields[1]))
+	return true
+}
+
+// Prints the thread the message in "\thread <number>" is part of
+func printThread(msg *proto.Message) {
+	if !hasFeature("threads") {
+		ui.Info("The server does not support threads.")
+		return
+	}
+	fields := strings.Fields(msg.Text)
+	if len(fields) != 2 {
+		ui.Info("Wrong use of the command. Type \\help to see how to use it.")
+		return
+	}
+	seq, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		ui.Info("%q is not a message number.", fields[1])
+		return
+	}
+
+	list, err := client.Thread(context.Background(), &proto.Message{Id: msg.Id, Lamport: msg.Lamport, Ref: seq})
+	if status.Code(err) == codes.NotFound {
+		ui.Info("%s", status.Convert(err).Message())
+		return
+	}
+	if err != nil {
+		fatalf("Error occured when fetching the thread: %v", err)
+	}
+
+	// Replies are indented below the message they reply to
+	depth := make(map[uint64]int)
+	ui.Info("------------------------------------")
+	for _, reply := range list.Messages {
+		if reply.Parent != 0 {
+			depth[reply.Seq] = depth[reply.Parent] + 1
+		}
+		text := reply.Text
+		if reply.Deleted {
+			text = "(deleted)"
+		}
+		ui.Info("%s(%d) %s: %s", strings.Repeat("  ", depth[reply.Seq]), reply.Seq, reply.Id, text)
+	}
+	ui.Info("------------------------------------")
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/00kristian/MiniProject_2/proto"
+	"github.com/gdamore/tcell/v2"
+	"github.com/mattn/go-runewidth"
+	"golang.org/x/net/context"
+)
+
+// Max number of lines kept in the scrollback of a room
+const scrollback = 1000
+
+// Width of the user list to the right of the messages
+const sidebarWidth = 20
+
+// Colours given to senders, so it is easy to see who says what
+var senderColours = []tcell.Color{
+	tcell.ColorRed,
+	tcell.ColorGreen,
+	tcell.ColorYellow,
+	tcell.ColorBlue,
+	tcell.ColorFuchsia,
+	tcell.ColorAqua,
+	tcell.ColorOrange,
+	tcell.ColorLime,
+}
+
+// Messages mentioning us stand out
+var mentionStyle = tcell.StyleDefault.Background(tcell.ColorOlive).Foreground(tcell.ColorWhite).Bold(true)
+
+// A line in the scrollback. Lines without a sender are system messages or information to the user
+type chatLine struct {
+	sender  string
+	text    string
+	lamport uint64
+	info    bool
+	// Number of the message on the server, used to refer to it. Zero for lines that are not messages
+	seq     uint64
+	edited  bool
+	deleted bool
+	// Quote of the message this line replies to, empty if it is not a reply
+	quote string
+	// Tally of the reactions on the message
+	reactions string
+	// The message mentions us
+	mentioned bool
+	// Description of the attached file, empty if there is none
+	attachment string
+}
+
+// A tab for each room we have seen messages from
+type tab struct {
+	room  string
+	lines []chatLine
+	// Number of lines scrolled up from the bottom
+	scroll int
+	unread bool
+}
+
+// The full-screen terminal UI: tabs for the rooms on top, the messages of the room with the users
+// next to them, and an input line at the bottom that does not get broken by incoming messages
+type tui struct {
+	screen tcell.Screen
+
+	lock   sync.Mutex
+	tabs   []*tab
+	active int
+	users  []*proto.User
+
+	// The line being typed, and the position of the cursor in it
+	input  []rune
+	cursor int
+	// Lines typed before, and where we are in them when going through them with up and down
+	history    []string
+	historyPos int
+
+	lines     chan string
+	refresh   chan struct{}
+	quit      chan struct{}
+	closeOnce sync.Once
+}
+
+func newTUI() (*tui, error) {
+	screen, err := tcell.NewScreen()
+	if err != nil {
+		return nil, err
+	}
+	if err := screen.Init(); err != nil {
+		return nil, err
+	}
+	t := &tui{
+		screen:  screen,
+		tabs:    []*tab{{room: currentRoom()}},
+		lines:   make(chan string),
+		refresh: make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+	}
+	go t.events()
+	go t.refreshUsers()
+	t.draw()
+	return t, nil
+}
+
+func (t *tui) Show(msg *proto.Message, lamport uint64) {
+	t.lock.Lock()
+	// Mentions ring the bell. They are shown in the room we are looking at, unless the message is in that room
+	if msg.Event == proto.EventType_EVENT_MENTION {
+		if msg.Room != t.tabs[t.active].room {
+			t.tabs[t.active].add(chatLine{text: mentionNotice(msg), info: true, mentioned: true})
+		}
+		t.lock.Unlock()
+		t.screen.Beep()
+		t.draw()
+		return
+	}
+	// Users coming and going are shown in the room we are looking at, and change the list of users
+	if msg.Event == proto.EventType_EVENT_PRESENCE {
+		t.tabs[t.active].add(chatLine{text: presenceNotice(msg), info: true})
+		t.lock.Unlock()
+		t.refreshUsersSoon()
+		t.draw()
+		return
+	}
+	// Messages without a room are for everybody, those are shown in the room we are looking at
+	target := t.tabs[t.active]
+	if msg.Room != "" {
+		target = t.tab(msg.Room)
+	}
+	// Edits and deletes change the line of the message they refer to
+	if msg.Event != proto.EventType_EVENT_MESSAGE {
+		target.change(msg)
+	} else {
+		line := chatLine{sender: msg.Id, text: msg.Text, lamport: msg.Lamport, seq: msg.Seq, mentioned: mentionsMe(msg)}
+		if msg.Parent != 0 {
+			line.quote = quote(msg.Parent)
+		}
+		if msg.Attachment != nil {
+			line.attachment = describeAttachment(msg)
+		}
+		target.add(line)
+	}
+	if target != t.tabs[t.active] {
+		target.unread = true
+	}
+	t.lock.Unlock()
+
+	// System messages are often about users joining and leaving
+	if msg.Id == "" {
+		t.refreshUsersSoon()
+	}
+	t.draw()
+}
+
+func (t *tui) Info(format string, args ...interface{}) {
+	t.lock.Lock()
+	t.tabs[t.active].add(chatLine{text: fmt.Sprintf(format, args...), info: true})
+	t.lock.Unlock()
+	t.draw()
+}
+
+func (t *tui) ReadLine() (string, bool) {
+	select {
+	case line := <-t.lines:
+		return line, true
+	case <-t.quit:
+		return "", false
+	}
+}
+
+func (t *tui) Close() {
+	t.closeOnce.Do(func() {
+		close(t.quit)
+		t.screen.Fini()
+	})
+}
+
+// Returns the tab of the room, creating it if we have not seen the room before. The caller must hold t.lock
+func (t *tui) tab(room string) *tab {
+	for _, tab := range t.tabs {
+		if tab.room == room {
+			return tab
+		}
+	}
+	tab := &tab{room: room}
+	t.tabs = append(t.tabs, tab)
+	return tab
+}
+
+// Adds a line to the scrollback, dropping the oldest line if there are too many
+func (tab *tab) add(line chatLine) {
+	tab.lines = append(tab.lines, line)
+	if len(tab.lines) > scrollback {
+		tab.lines = tab.lines[len(tab.lines)-scrollback:]
+	}
+	// Keep the view still if the user has scrolled up
+	if tab.scroll > 0 {
+		tab.scroll++
+	}
+}
+
+// Handles keys and resizes until the screen is closed
+func (t *tui) events() {
+	for {
+		ev := t.screen.PollEvent()
+		switch ev := ev.(type) {
+		case nil:
+			// The screen was closed
+			return
+		case *tcell.EventResize:
+			t.screen.Sync()
+			t.draw()
+		case *tcell.EventKey:
+			if line, entered := t.key(ev); entered {
+				select {
+				case t.lines <- line:
+				case <-t.quit:
+					return
+				}
+			}
+			t.draw()
+		}
+	}
+}
+
+// Handles a key. Returns the line and true when the user pressed enter
+func (t *tui) key(ev *tcell.EventKey) (string, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	switch ev.Key() {
+	case tcell.KeyEnter:
+		line := string(t.input)
+		if line != "" {
+			t.history = append(t.history, line)
+		}
+		t.historyPos = len(t.history)
+		t.input, t.cursor = nil, 0
+		return line, true
+	case tcell.KeyCtrlC:
+		return "\\leave", true
+	case tcell.KeyBackspace, tcell.KeyBackspace2:
+		if t.cursor > 0 {
+			t.input = append(t.input[:t.cursor-1], t.input[t.cursor:]...)
+			t.cursor--
+		}
+	case tcell.KeyDelete:
+		if t.cursor < len(t.input) {
+			t.input = append(t.input[:t.cursor], t.input[t.cursor+1:]...)
+		}
+	case tcell.KeyLeft:
+		if t.cursor > 0 {
+			t.cursor--
+		}
+	case tcell.KeyRight:
+		if t.cursor < len(t.input) {
+			t.cursor++
+		}
+	case tcell.KeyHome, tcell.KeyCtrlA:
+		t.cursor = 0
+	case tcell.KeyEnd, tcell.KeyCtrlE:
+		t.cursor = len(t.input)
+	case tcell.KeyCtrlU:
+		t.input, t.cursor = t.input[t.cursor:], 0
+	case tcell.KeyCtrlW:
+		// Delete the word before the cursor, and the spaces after it
+		start := t.cursor
+		for start > 0 && t.input[start-1] == ' ' {
+			start--
+		}
+		for start > 0 && t.input[start-1] != ' ' {
+			start--
+		}
+		t.input = append(t.input[:start], t.input[t.cursor:]...)
+		t.cursor = start
+	case tcell.KeyUp:
+		if t.historyPos > 0 {
+			t.historyPos--
+			t.input = []rune(t.history[t.historyPos])
+			t.cursor = len(t.input)
+		}
+	case tcell.KeyDown:
+		if t.historyPos < len(t.history) {
+			t.historyPos++
+			t.input = nil
+			if t.historyPos < len(t.history) {
+				t.input = []rune(t.history[t.historyPos])
+			}
+			t.cursor = len(t.input)
+		}
+	case tcell.KeyTab:
+		t.switchTab(1)
+	case tcell.KeyBacktab:
+		t.switchTab(-1)
+	case tcell.KeyPgUp:
+		_, height := t.screen.Size()
+		t.tabs[t.active].scroll += height / 2
+	case tcell.KeyPgDn:
+		_, height := t.screen.Size()
+		t.tabs[t.active].scroll -= height / 2
+		if t.tabs[t.active].scroll < 0 {
+			t.tabs[t.active].scroll = 0
+		}
+	case tcell.KeyRune:
+		t.input = append(t.input[:t.cursor], append([]rune{ev.Rune()}, t.input[t.cursor:]...)...)
+		t.cursor++
+	}
+	return "", false
+}
+
+// Switches to the next or previous tab, and chats in its room from now on. The caller must hold t.lock
+func (t *tui) switchTab(step int) {
+	t.active = (t.active + step + len(t.tabs)) % len(t.tabs)
+	t.tabs[t.active].unread = false
+	t.users = nil
+	setRoom(t.tabs[t.active].room)
+	t.refreshUsersSoon()
+}
+
+// Asks for the user list to be refreshed without waiting for it
+func (t *tui) refreshUsersSoon() {
+	select {
+	case t.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// Keeps the user list of the current room up to date, if the server can tell us who is there
+func (t *tui) refreshUsers() {
+	if !hasFeature("users") {
+		return
+	}
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		list, err := client.ListUsers(context.Background(), &proto.RoomRequest{Room: currentRoom()})
+		if err == nil {
+			t.lock.Lock()
+			t.users = t.users[:0]
+			for _, user := range list.Users {
+				t.users = append(t.users, user)
+			}
+			t.lock.Unlock()
+			t.draw()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-t.refresh:
+		case <-t.quit:
+			return
+		}
+	}
+}
+
+// A piece of a row on the screen with its own style
+type segment struct {
+	text  string
+	style tcell.Style
+}
+
+// The colour of a sender - the same sender always gets the same colour
+func senderStyle(sender string) tcell.Style {
+	hash := fnv.New32a()
+	hash.Write([]byte(sender))
+	return tcell.StyleDefault.Foreground(senderColours[hash.Sum32()%uint32(len(senderColours))]).Bold(true)
+}
+
+// Applies an edit, delete or reaction to the line of the message it refers to. If the message is no longer
+// in the scrollback, the change is added as a line of its own
+func (tab *tab) change(msg *proto.Message) {
+	for i := len(tab.lines) - 1; i >= 0; i-- {
+		line := &tab.lines[i]
+		if line.seq != msg.Ref || line.info {
+			continue
+		}
+		switch msg.Event {
+		case proto.EventType_EVENT_DELETE:
+			line.text, line.deleted = "", true
+		case proto.EventType_EVENT_EDIT:
+			line.text, line.edited = msg.Text, true
+		default:
+			// Reactions come with the new tally of the message
+			line.reactions = tally(msg.Reactions)
+		}
+		return
+	}
+	switch msg.Event {
+	case proto.EventType_EVENT_DELETE:
+		tab.add(chatLine{text: fmt.Sprintf("%s deleted message %d", msg.Id, msg.Ref), lamport: msg.Lamport})
+	case proto.EventType_EVENT_EDIT:
+		tab.add(chatLine{text: fmt.Sprintf("%s edited message %d: %s", msg.Id, msg.Ref, msg.Text), lamport: msg.Lamport})
+	default:
+		tab.add(chatLine{text: fmt.Sprintf("%s reacted to message %d - %s", msg.Id, msg.Ref, tally(msg.Reactions)), lamport: msg.Lamport})
+	}
+}
+
+// Splits a line from the scrollback into rows no wider than width
+func wrap(line chatLine, width int) [][]segment {
+	dim := tcell.StyleDefault.Foreground(tcell.ColorGray)
+	var segments []segment
+	switch {
+	case line.info && line.mentioned:
+		segments = []segment{{line.text, mentionStyle}}
+	case line.info:
+		segments = []segment{{line.text, tcell.StyleDefault.Foreground(tcell.ColorSilver)}}
+	case line.sender == "":
+		// If id == "", it is a system message
+		segments = []segment{{fmt.Sprintf("[%d] ", line.lamport), dim}, {line.text, dim.Italic(true)}}
+	case line.deleted:
+		segments = []segment{
+			{fmt.Sprintf("[%d] (%d) ", line.lamport, line.seq), dim},
+			{line.sender, senderStyle(line.sender)},
+			{": (deleted)", dim.Italic(true)},
+		}
+	default:
+		segments = []segment{{fmt.Sprintf("[%d] (%d) ", line.lamport, line.seq), dim}}
+		// Replies are indented, with a quote of the message they reply to
+		if line.quote != "" {
+			segments = append(segments, segment{"  ↳ " + line.quote + " ", dim.Italic(true)})
+		}
+		textStyle := tcell.StyleDefault
+		if line.mentioned {
+			textStyle = mentionStyle
+		}
+		segments = append(segments,
+			segment{line.sender, senderStyle(line.sender)},
+			segment{": " + line.text, textStyle},
+		)
+		if line.attachment != "" {
+			segments = append(segments, segment{" " + line.attachment, tcell.StyleDefault.Foreground(tcell.ColorAqua)})
+		}
+		if line.edited {
+			segments = append(segments, segment{" (edited)", dim})
+		}
+		if line.reactions != "" {
+			segments = append(segments, segment{"  " + line.reactions, tcell.StyleDefault.Foreground(tcell.ColorYellow)})
+		}
+	}
+
+	var rows [][]segment
+	var row []segment
+	used := 0
+	for _, seg := range segments {
+		start := 0
+		runes := []rune(seg.text)
+		for i, r := range runes {
+			w := runewidth.RuneWidth(r)
+			if used+w > width && used > 0 {
+				row = append(row, segment{string(runes[start:i]), seg.style})
+				rows = append(rows, row)
+				row, used, start = nil, 0, i
+			}
+			used += w
+		}
+		row = append(row, segment{string(runes[start:]), seg.style})
+	}
+	return append(rows, row)
+}
+
+// Puts the text on the screen at the given position, cutting it at maxX. Returns where the text ended
+func (t *tui) put(x, y, maxX int, text string, style tcell.Style) int {
+	for _, r := range text {
+		w := runewidth.RuneWidth(r)
+		if x+w > maxX {
+			break
+		}
+		t.screen.SetContent(x, y, r, nil, style)
+		x += w
+	}
+	return x
+}
+
+// Draws the whole screen
+func (t *tui) draw() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	select {
+	case <-t.quit:
+		return
+	default:
+	}
+
+	t.screen.Clear()
+	width, height := t.screen.Size()
+	paneWidth := width
+	if width >= 3*sidebarWidth {
+		paneWidth = width - sidebarWidth - 1
+	}
+
+	// Tabs for the rooms on the top row
+	x := 0
+	for i, tab := range t.tabs {
+		style := tcell.StyleDefault
+		if i == t.active {
+			style = style.Reverse(true)
+		} else if tab.unread {
+			style = style.Bold(true)
+		}
+		x = t.put(x, 0, width, " #"+tab.room+" ", style)
+		x = t.put(x, 0, width, " ", tcell.StyleDefault)
+	}
+
+	// Messages of the current room, the newest at the bottom
+	tab := t.tabs[t.active]
+	var rows [][]segment
+	for _, line := range tab.lines {
+		rows = append(rows, wrap(line, paneWidth)...)
+	}
+	paneHeight := height - 2
+	if max := len(rows) - paneHeight; tab.scroll > max {
+		tab.scroll = max
+	}
+	if tab.scroll < 0 {
+		tab.scroll = 0
+	}
+	end := len(rows) - tab.scroll
+	start := end - paneHeight
+	if start < 0 {
+		start = 0
+	}
+	for y, row := range rows[start:end] {
+		x := 0
+		for _, seg := range row {
+			x = t.put(x, y+1, paneWidth, seg.text, seg.style)
+		}
+	}
+
+	// Users in the room to the right
+	if paneWidth < width {
+		for y := 1; y < height-1; y++ {
+			t.screen.SetContent(paneWidth, y, tcell.RuneVLine, nil, tcell.StyleDefault)
+		}
+		t.put(paneWidth+2, 1, width, "Users", tcell.StyleDefault.Bold(true))
+		for i, user := range t.users {
+			if i+2 >= height-1 {
+				break
+			}
+			name := user.Id
+			// Users that have done nothing for a while are dimmed
+			style := senderStyle(user.Id)
+			if user.Bot {
+				name += " (bot)"
+			}
+			if user.Away {
+				name += " (away)"
+				style = style.Dim(true)
+			}
+			t.put(paneWidth+2, i+2, width, name, style)
+		}
+	}
+
+	// The input line at the bottom, scrolled sideways so the cursor is always visible
+	prompt := "> "
+	if tab.scroll > 0 {
+		prompt = "^ "
+	}
+	x = t.put(0, height-1, width, prompt, tcell.StyleDefault.Bold(true))
+	offset := 0
+	for runewidth.StringWidth(string(t.input[offset:t.cursor])) >= width-x && offset < t.cursor {
+		offset++
+	}
+	cursorX := x + runewidth.StringWidth(string(t.input[offset:t.cursor]))
+	t.put(x, height-1, width, string(t.input[offset:]), tcell.StyleDefault)
+	t.screen.ShowCursor(cursorX, height-1)
+
+	t.screen.Show()
+}
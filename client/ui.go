@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/00kristian/MiniProject_2/proto"
+)
+
+// What the user sees and types. The line mode prints everything as lines on the terminal,
+// the terminal UI has a pane for messages and a separate input line
+type UI interface {
+	// Shows a message received from the server. lamport is our lamport time after receiving it
+	Show(msg *proto.Message, lamport uint64)
+	// Shows a line of information to the user
+	Info(format string, args ...interface{})
+	// Reads the next line typed by the user. Returns false when there is no more input
+	ReadLine() (string, bool)
+	// Gives the terminal back to the user
+	Close()
+}
+
+// The UI in use - line mode until the user has entered a name
+var ui UI = newLineUI()
+
+// The classic line mode. Incoming messages are logged, input is read line by line from stdin
+type lineUI struct {
+	scanner *bufio.Scanner
+}
+
+func newLineUI() *lineUI {
+	return &lineUI{scanner: bufio.NewScanner(os.Stdin)}
+}
+
+func (l *lineUI) Show(msg *proto.Message, lamport uint64) {
+	// Messages from other rooms than our own are prefixed with the room
+	prefix := ""
+	if msg.Room != "" && msg.Room != currentRoom() {
+		prefix = "#" + msg.Room + " "
+	}
+	// If id == "", it is a join message
+	switch {
+	case msg.Id == "":
+		log.Printf("[%s: %d] %s%s", me, lamport, prefix, msg.Text)
+	case msg.Event == proto.EventType_EVENT_MENTION:
+		// We see the message itself if we are in the room, so only ring the bell
+		fmt.Print(bell)
+		if msg.Room != currentRoom() {
+			log.Printf("[%s: %d] %s", me, lamport, highlight(mentionNotice(msg)))
+		}
+	case msg.Event == proto.EventType_EVENT_PRESENCE:
+		log.Printf("[%s: %d] %s", me, lamport, presenceNotice(msg))
+	case msg.Event == proto.EventType_EVENT_EDIT:
+		log.Printf("[%s: %d] %s%s edited (%d): %s", me, lamport, prefix, msg.Id, msg.Ref, msg.Text)
+	case msg.Event == proto.EventType_EVENT_DELETE:
+		log.Printf("[%s: %d] %s%s deleted (%d)", me, lamport, prefix, msg.Id, msg.Ref)
+	case msg.Event == proto.EventType_EVENT_REACT:
+		log.Printf("[%s: %d] %s%s reacted %s to (%d) - %s", me, lamport, prefix, msg.Id, msg.Text, msg.Ref, tally(msg.Reactions))
+	case msg.Event == proto.EventType_EVENT_UNREACT:
+		log.Printf("[%s: %d] %s%s took back %s on (%d) - %s", me, lamport, prefix, msg.Id, msg.Text, msg.Ref, tally(msg.Reactions))
+	case msg.Parent != 0:
+		log.Printf("[%s: %d] %s(%d) %s replied to %s: %s", me, lamport, prefix, msg.Seq, msg.Id, quote(msg.Parent), messageText(msg))
+	default:
+		// The number in front of the message is used to refer to it, like with \edit
+		log.Printf("[%s: %d] %s(%d) %s: %s", me, lamport, prefix, msg.Seq, msg.Id, messageText(msg))
+	}
+}
+
+// The text of a message, highlighted if it mentions us, and with the attachment if it has one
+func messageText(msg *proto.Message) string {
+	text := msg.Text
+	if mentionsMe(msg) {
+		text = highlight(text)
+	}
+	if msg.Attachment != nil {
+		text += " " + describeAttachment(msg)
+	}
+	return text
+}
+
+func (l *lineUI) Info(format string, args ...interface{}) {
+	fmt.Printf(format+"\n", args...)
+}
+
+func (l *lineUI) ReadLine() (string, bool) {
+	if !l.scanner.Scan() {
+		return "", false
+	}
+	return l.scanner.Text(), true
+}
+
+func (l *lineUI) Close() {}
+
+// Gives the terminal back to the user and exits with an error, like log.Fatalf
+func fatalf(format string, args ...interface{}) {
+	ui.Close()
+	log.Fatalf(format, args...)
+}
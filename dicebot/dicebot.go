@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/00kristian/MiniProject_2/bot"
+)
+
+// Most dice and sides a single roll may have. The single dice are only listed if they fit in a message
+const maxDice, maxSides = 20, 1000
+
+func main() {
+	address := flag.String("server", ":8080", "Address of the Chitty-Chat server")
+	id := flag.String("id", "dicebot", "Id of the bot user")
+	token := flag.String("token", os.Getenv("CHITTY_BOT_TOKEN"), "Token the server knows the bot by")
+	room := flag.String("room", "lobby", "The room the bot joins, it can be invited to others")
+	flag.Parse()
+
+	b, err := bot.New(bot.Config{Server: *address, ID: *id, Token: *token, Room: *room})
+	if err != nil {
+		log.Fatalf("Could not start the bot: %v", err)
+	}
+	defer b.Close()
+	rand.Seed(time.Now().UnixNano())
+
+	b.Command("roll", "Rolls dice, like /roll 2d6 (one six-sided die if nothing is given)", roll)
+	b.Command("flip", "Flips a coin", func(r *bot.Request) {
+		side := "heads"
+		if rand.Intn(2) == 1 {
+			side = "tails"
+		}
+		reply(r, "%s flipped %s", r.Message.Id, side)
+	})
+	b.Command("remind", "Reminds the room later, like /remind 15m standup", remind)
+
+	// Leave when we are stopped
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	log.Printf("[Bot] %s joins %s on %s", *id, *room, *address)
+	if err := b.Run(ctx); err != nil {
+		log.Fatalf("The bot stopped: %v", err)
+	}
+}
+
+// Rolls NdM: N dice with M sides each
+func roll(r *bot.Request) {
+	dice, sides := 1, 6
+	if len(r.Args) > 0 {
+		var err error
+		if dice, sides, err = parseDice(r.Args[0]); err != nil {
+			reply(r, "%s: %v", r.Message.Id, err)
+			return
+		}
+	}
+	rolls := make([]string, dice)
+	total := 0
+	for i := range rolls {
+		n := rand.Intn(sides) + 1
+		total += n
+		rolls[i] = strconv.Itoa(n)
+	}
+	text := fmt.Sprintf("%s rolled %dd%d: %s = %d", r.Message.Id, dice, sides, strings.Join(rolls, " + "), total)
+	if limit := r.Bot().MaxMessageLength(); limit > 0 && utf8.RuneCountInString(text) > limit {
+		text = fmt.Sprintf("%s rolled %dd%d: %d", r.Message.Id, dice, sides, total)
+	}
+	reply(r, "%s", text)
+}
+
+// Replies to the request, the user just gets no answer if that fails
+func reply(r *bot.Request, format string, args ...interface{}) {
+	if err := r.Reply(format, args...); err != nil {
+		log.Printf("[Bot] Could not reply to %s: %v", r.Message.Id, err)
+	}
+}
+
+// Parses dice like "2d6", or "d20" for one die
+func parseDice(text string) (int, int, error) {
+	parts := strings.SplitN(strings.ToLower(text), "d", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("dice are written like 2d6")
+	}
+	dice := 1
+	if parts[0] != "" {
+		n, err := strconv.Atoi(parts[0])
+		if err != nil || n < 1 || n > maxDice {
+			return 0, 0, fmt.Errorf("the number of dice must be 1 to %d", maxDice)
+		}
+		dice = n
+	}
+	sides, err := strconv.Atoi(parts[1])
+	if err != nil || sides < 2 || sides > maxSides {
+		return 0, 0, fmt.Errorf("dice must have 2 to %d sides", maxSides)
+	}
+	return dice, sides, nil
+}
+
+// Says the text in the room after the given time
+func remind(r *bot.Request) {
+	if len(r.Args) < 2 {
+		reply(r, "Use it like /remind 15m standup")
+		return
+	}
+	after, err := time.ParseDuration(r.Args[0])
+	if err != nil || after <= 0 {
+		reply(r, "%s: %q is not a duration like 15m or 1h30m", r.Message.Id, r.Args[0])
+		return
+	}
+	text := strings.Join(r.Args[1:], " ")
+	room, asker := r.Message.Room, r.Message.Id
+	reply(r, "%s: I will remind %s in %v", asker, room, after)
+	time.AfterFunc(after, func() {
+		if err := r.Bot().Say(room, fmt.Sprintf("Reminder from %s: %s", asker, text)); err != nil {
+			log.Printf("[Bot] Could not send the reminder: %v", err)
+		}
+	})
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"embed"
+	"flag"
+	"io/fs"
+	"log"
+	"net/http"
+
+	"github.com/00kristian/MiniProject_2/proto"
+	"golang.org/x/net/websocket"
+	"google.golang.org/grpc"
+)
+
+// The static test page served by the gateway
+//
+//go:embed static
+var static embed.FS
+
+// Client for the chat server every socket is bridged to
+var client proto.ChatClient
+
+func main() {
+	listen := flag.String("listen", ":8081", "Address the gateway listens on")
+	address := flag.String("server", ":8080", "Address of the Chitty-Chat server")
+	flag.Parse()
+
+	// Connect to our server - no https, so connect with grpc.WithInsecure()
+	conn, err := grpc.Dial(*address, grpc.WithInsecure())
+	if err != nil {
+		log.Fatalf("Could not connect: %s", err)
+	}
+	defer conn.Close()
+	client = proto.NewChatClient(conn)
+
+	page, err := fs.Sub(static, "static")
+	if err != nil {
+		log.Fatalf("Could not load static files: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/ws", websocket.Handler(serveWebSocket))
+	registerREST(mux)
+	mux.Handle("/", http.FileServer(http.FS(page)))
+
+	log.Printf("[Gateway] Started gateway on %s for server %s", *listen, *address)
+	log.Fatal(http.ListenAndServe(*listen, mux))
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/00kristian/MiniProject_2/proto"
+	// Registers the error details sent by the server, so they can be written as JSON
+	_ "google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+// The JSON is made directly from the proto messages, so the shapes always follow chat.proto.
+// Field names are the ones from chat.proto, and fields are always present
+var marshaler = protojson.MarshalOptions{UseProtoNames: true, EmitUnpopulated: true}
+var unmarshaler = protojson.UnmarshalOptions{DiscardUnknown: true}
+
+// HTTP status for each gRPC error code the chat server uses
+var httpStatus = map[codes.Code]int{
+	codes.InvalidArgument:    http.StatusBadRequest,
+	codes.Unauthenticated:    http.StatusUnauthorized,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.NotFound:           http.StatusNotFound,
+	codes.FailedPrecondition: http.StatusConflict,
+	codes.ResourceExhausted:  http.StatusTooManyRequests,
+	codes.Unimplemented:      http.StatusNotImplemented,
+	codes.Unavailable:        http.StatusServiceUnavailable,
+}
+
+// Registers the REST endpoints and the event stream
+func registerREST(mux *http.ServeMux) {
+	// POST /api/messages with a Message as body - publishes the message
+	mux.HandleFunc("/api/messages", method(http.MethodPost, asUser(proto.ChatClient.Publish)))
+	// POST /api/edit with a Message as body - changes the text of the message with the seq in ref
+	mux.HandleFunc("/api/edit", method(http.MethodPost, asUser(proto.ChatClient.Edit)))
+	// POST /api/delete with a Message as body - deletes the message with the seq in ref
+	mux.HandleFunc("/api/delete", method(http.MethodPost, asUser(proto.ChatClient.Delete)))
+	// POST /api/react with a Message as body - adds (event EVENT_REACT) or removes (event EVENT_UNREACT)
+	// the emoji in text as a reaction on the message with the seq in ref
+	mux.HandleFunc("/api/react", method(http.MethodPost, asUser(proto.ChatClient.React)))
+	mux.HandleFunc("/api/leave", method(http.MethodPost, leave))
+	mux.HandleFunc("/api/users", method(http.MethodGet, users))
+	mux.HandleFunc("/api/history", method(http.MethodGet, history))
+	mux.HandleFunc("/api/thread", method(http.MethodGet, thread))
+	mux.HandleFunc("/api/search", method(http.MethodGet, search))
+	mux.HandleFunc("/api/attachments", attachments)
+	mux.HandleFunc("/api/events", method(http.MethodGet, events))
+}
+
+// The session of the user, as sent in the "session" event of /api/events. Calls made as the user need it
+const sessionHeader = "X-Chitty-Session"
+
+// Metadata key of the session, the server sends it in the header of the Join stream
+const sessionKey = "chitty-session"
+
+// The context of the request, with the session of the user the request carries
+func auth(r *http.Request) context.Context {
+	if session := r.Header.Get(sessionHeader); session != "" {
+		return metadata.AppendToOutgoingContext(r.Context(), sessionKey, session)
+	}
+	return r.Context()
+}
+
+// Only lets requests with the given method through
+func method(allowed string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != allowed {
+			w.Header().Set("Allow", allowed)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// An rpc that is called with a message as the user who sends it, like Publish and Edit
+type messageCall func(proto.ChatClient, context.Context, *proto.Message, ...grpc.CallOption) (*proto.Empty, error)
+
+// Makes the handler for a POST with a Message as body, which calls the rpc with the session of the user the request carries
+func asUser(call messageCall) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		msg := &proto.Message{}
+		if !readBody(w, r, msg) {
+			return
+		}
+		var trailer metadata.MD
+		reply, err := call(client, auth(r), msg, grpc.Trailer(&trailer))
+		// Tell the caller how long to wait, just like the server tells gRPC clients
+		if values := trailer.Get("retry-after"); len(values) > 0 {
+			w.Header().Set("Retry-After", values[0])
+		}
+		writeReply(w, reply, err)
+	}
+}
+
+// POST /api/leave with an Id as body - leaves Chitty-Chat
+func leave(w http.ResponseWriter, r *http.Request) {
+	id := &proto.Id{}
+	if !readBody(w, r, id) {
+		return
+	}
+	reply, err := client.Leave(auth(r), id)
+	writeReply(w, reply, err)
+}
+
+// GET /api/users?room=lobby - lists the active users, in the room if one is given
+func users(w http.ResponseWriter, r *http.Request) {
+	reply, err := client.ListUsers(r.Context(), &proto.RoomRequest{Room: r.URL.Query().Get("room")})
+	writeReply(w, reply, err)
+}
+
+// GET /api/history?room=lobby&before=42&limit=50 - fetches a page of the history of a room
+func history(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	req := &proto.HistoryRequest{Room: query.Get("room")}
+	var err error
+	if before := query.Get("before"); before != "" {
+		if req.Before, err = strconv.ParseUint(before, 10, 64); err != nil {
+			writeError(w, status.Errorf(codes.InvalidArgument, "before must be a sequence number: %v", err))
+			return
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.ParseUint(limit, 10, 32)
+		if err != nil {
+			writeError(w, status.Errorf(codes.InvalidArgument, "limit must be a number: %v", err))
+			return
+		}
+		req.Limit = uint32(n)
+	}
+	reply, err := client.History(r.Context(), req)
+	writeReply(w, reply, err)
+}
+
+// GET /api/thread?seq=42 - fetches the thread the message is part of
+func thread(w http.ResponseWriter, r *http.Request) {
+	seq, err := strconv.ParseUint(r.URL.Query().Get("seq"), 10, 64)
+	if err != nil {
+		writeError(w, status.Errorf(codes.InvalidArgument, "seq must be a sequence number: %v", err))
+		return
+	}
+	reply, err := client.Thread(r.Context(), &proto.Message{Ref: seq})
+	writeReply(w, reply, err)
+}
+
+// GET /api/search?q=hello&sender=alice&room=lobby&from_lamport=1&to_lamport=99&from_time=0&to_time=0&offset=0&limit=20 -
+// searches the history. Every parameter is optional, but one of q, sender and room must be given
+func search(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	req := &proto.SearchRequest{Query: query.Get("q"), Sender: query.Get("sender"), Room: query.Get("room")}
+	numbers := []struct {
+		name string
+		set  func(string) error
+	}{
+		{"from_lamport", func(v string) (err error) { req.FromLamport, err = strconv.ParseUint(v, 10, 64); return }},
+		{"to_lamport", func(v string) (err error) { req.ToLamport, err = strconv.ParseUint(v, 10, 64); return }},
+		{"from_time", func(v string) (err error) { req.FromTime, err = strconv.ParseInt(v, 10, 64); return }},
+		{"to_time", func(v string) (err error) { req.ToTime, err = strconv.ParseInt(v, 10, 64); return }},
+		{"offset", func(v string) error { n, err := strconv.ParseUint(v, 10, 32); req.Offset = uint32(n); return err }},
+		{"limit", func(v string) error { n, err := strconv.ParseUint(v, 10, 32); req.Limit = uint32(n); return err }},
+	}
+	for _, number := range numbers {
+		if value := query.Get(number.name); value != "" {
+			if err := number.set(value); err != nil {
+				writeError(w, status.Errorf(codes.InvalidArgument, "%s must be a number: %v", number.name, err))
+				return
+			}
+		}
+	}
+	reply, err := client.Search(r.Context(), req)
+	writeReply(w, reply, err)
+}
+
+// POST /api/attachments?id=alice&name=notes.txt with the file as body - uploads an attachment and returns it, so it can
+// be sent with a message.
+// GET /api/attachments?hash=<hash> - downloads an attachment
+func attachments(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		uploadAttachment(w, r)
+	case http.MethodGet:
+		downloadAttachment(w, r)
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func uploadAttachment(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	// Uploads are made as the user, so they need the session too
+	var trailer metadata.MD
+	stream, err := client.Upload(auth(r), grpc.Trailer(&trailer))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	chunk := &proto.Chunk{Id: query.Get("id"), Attachment: &proto.Attachment{Name: query.Get("name")}}
+	buffer := make([]byte, 32*1024)
+	for {
+		n, err := r.Body.Read(buffer)
+		if n > 0 || chunk.Attachment != nil {
+			chunk.Data = buffer[:n]
+			// The server ended the upload, the reason comes with CloseAndRecv
+			if stream.Send(chunk) != nil {
+				break
+			}
+			chunk = &proto.Chunk{}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			stream.CloseSend()
+			writeError(w, status.Errorf(codes.InvalidArgument, "could not read the body: %v", err))
+			return
+		}
+	}
+	reply, err := stream.CloseAndRecv()
+	if values := trailer.Get("retry-after"); len(values) > 0 {
+		w.Header().Set("Retry-After", values[0])
+	}
+	writeReply(w, reply, err)
+}
+
+func downloadAttachment(w http.ResponseWriter, r *http.Request) {
+	stream, err := client.Download(r.Context(), &proto.Attachment{Hash: r.URL.Query().Get("hash")})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	// Errors like a missing attachment come with the first chunk, before anything is written
+	chunk, err := stream.Recv()
+	if err != nil && err != io.EOF {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", http.DetectContentType(chunk.GetData()))
+	for err == nil {
+		w.Write(chunk.Data)
+		chunk, err = stream.Recv()
+	}
+	if err != io.EOF {
+		log.Printf("[Gateway] Error occured when downloading an attachment: %v", err)
+	}
+}
+
+// GET /api/events?id=alice&name=Alice&room=lobby - joins Chitty-Chat and mirrors the Join stream as Server-Sent Events.
+// The first event is "session", with the session the other requests made as the user send as the X-Chitty-Session header.
+// Every event after it is a Message, sent as "message" for messages from users, "system" for system messages
+// "edit", "delete", "react" or "unreact" when a message is changed, and "mention" when the user is mentioned
+func events(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	user := &proto.User{Id: query.Get("id"), Name: query.Get("name"), Active: true, Room: query.Get("room")}
+	if user.Name == "" {
+		user.Name = user.Id
+	}
+
+	// The stream ends when the HTTP client goes away
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	stream, err := client.Join(ctx, user)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	// A server that does not let the user join ends the stream without a header
+	header, err := stream.Header()
+	if err == nil && len(header) == 0 {
+		_, err = stream.Recv()
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	session := ""
+	if sessions := header.Get(sessionKey); len(sessions) > 0 {
+		session = sessions[0]
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set(sessionHeader, session)
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "event: session\ndata: %s\n\n", session)
+	flusher.Flush()
+	log.Printf("[Gateway] %s joined through server-sent events", user.Id)
+
+	for {
+		msg, err := stream.Recv()
+		// Errors after joining, like being kicked, are only reported here, so they are sent as an event
+		if err != nil {
+			if ctx.Err() == nil {
+				fmt.Fprintf(w, "event: error\ndata: %s\n\n", status.Convert(err).Message())
+				flusher.Flush()
+			}
+			return
+		}
+		data, err := marshaler.Marshal(msg)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", msg.Seq, eventName(msg), data)
+		flusher.Flush()
+	}
+}
+
+// Reads the JSON body into the message. Writes an error and returns false if the body is not valid
+func readBody(w http.ResponseWriter, r *http.Request, msg protobuf.Message) bool {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err == nil {
+		err = unmarshaler.Unmarshal(body, msg)
+	}
+	if err != nil {
+		writeError(w, status.Errorf(codes.InvalidArgument, "invalid body: %v", err))
+		return false
+	}
+	return true
+}
+
+// Writes the reply of an rpc as JSON, or the error if the rpc failed
+func writeReply(w http.ResponseWriter, reply protobuf.Message, err error) {
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	data, err := marshaler.Marshal(reply)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// Writes a gRPC error as a JSON body with the matching HTTP status
+func writeError(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	code, found := httpStatus[st.Code()]
+	if !found {
+		code = http.StatusInternalServerError
+	}
+	data, _ := marshaler.Marshal(st.Proto())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/00kristian/MiniProject_2/proto"
+	"golang.org/x/net/websocket"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// A JSON frame sent over the websocket.
+// Browsers send "join", "message", "edit", "delete", "react", "unreact" and "leave" frames.
+// The gateway sends "joined", "message", "system", "edit", "delete", "react", "unreact", "mention", "presence", "error" and "left" frames.
+// A "mention" frame tells that the user was mentioned in the message with the seq in ref, even in another room.
+// A "presence" frame tells that the user with the id is now "alive", "suspect" or "dead".
+// Edits, deletes and reactions refer to the seq of the message they change with ref, replies to the message they reply to with parent.
+// Reactions have the emoji as text, and the gateway sends them with the new reaction counts of the message
+type frame struct {
+	Type    string `json:"type"`
+	Id      string `json:"id,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Room    string `json:"room,omitempty"`
+	Text    string `json:"text,omitempty"`
+	Lamport uint64 `json:"lamport,omitempty"`
+	Seq     uint64 `json:"seq,omitempty"`
+	Ref     uint64 `json:"ref,omitempty"`
+	Parent  uint64 `json:"parent,omitempty"`
+	// Emoji and the number of users that reacted with it
+	Reactions map[string]uint32 `json:"reactions,omitempty"`
+	// Ids of the users mentioned in the message
+	Mentions []string `json:"mentions,omitempty"`
+	// File attached to the message, uploaded through /api/attachments
+	Attachment *proto.Attachment `json:"attachment,omitempty"`
+}
+
+// A browser bridged to the chat server. The gateway keeps the lamport time on behalf of the browser
+type session struct {
+	ws   *websocket.Conn
+	user *proto.User
+
+	mu      sync.Mutex
+	lamport uint64
+	// The session of the Join stream, every call made as the user carries it
+	token string
+}
+
+// Ticks the lamport time of the session, merging it with the given time
+func (s *session) tick(other uint64) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lamport = max(s.lamport, other) + 1
+	return s.lamport
+}
+
+// Adds the session of the user to the calls made with the context
+func (s *session) auth(ctx context.Context) context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token == "" {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, sessionKey, s.token)
+}
+
+// Sends a frame to the browser. Errors are ignored, the read loop notices when the socket is gone
+func (s *session) send(f frame) {
+	websocket.JSON.Send(s.ws, f)
+}
+
+// Bridges a websocket to a Join stream and Publish calls
+func serveWebSocket(ws *websocket.Conn) {
+	defer ws.Close()
+
+	// The first frame has to be a join
+	var join frame
+	if err := websocket.JSON.Receive(ws, &join); err != nil || join.Type != "join" {
+		websocket.JSON.Send(ws, frame{Type: "error", Text: "the first frame must be a join"})
+		return
+	}
+	if join.Name == "" {
+		join.Name = join.Id
+	}
+	s := &session{
+		ws:   ws,
+		user: &proto.User{Id: join.Id, Name: join.Name, Active: true, Room: join.Room},
+	}
+
+	// The stream is cancelled when the socket closes
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.Join(ctx, s.user)
+	if err != nil {
+		s.send(frame{Type: "error", Text: err.Error()})
+		return
+	}
+	// A server that does not let the user join ends the stream without a header. The server publishes the join message
+	header, err := stream.Header()
+	if err == nil && len(header) == 0 {
+		_, err = stream.Recv()
+	}
+	if err != nil {
+		s.send(frame{Type: "error", Text: status.Convert(err).Message()})
+		return
+	}
+	if tokens := header.Get(sessionKey); len(tokens) > 0 {
+		s.mu.Lock()
+		s.token = tokens[0]
+		s.mu.Unlock()
+	}
+	s.send(frame{Type: "joined", Id: s.user.Id, Name: s.user.Name, Room: s.user.Room, Lamport: s.tick(join.Lamport)})
+	log.Printf("[Gateway] %s joined through a websocket", s.user.Id)
+
+	go s.forward(stream)
+	s.read(ctx)
+}
+
+// Forwards everything from the Join stream to the browser, keeping the lamport stamp of the server
+func (s *session) forward(stream proto.Chat_JoinClient) {
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			s.send(frame{Type: "error", Text: status.Convert(err).Message()})
+			s.ws.Close()
+			return
+		}
+		s.tick(msg.Lamport)
+		f := frame{Type: eventName(msg), Id: msg.Id, Room: msg.Room, Text: msg.Text, Lamport: msg.Lamport, Seq: msg.Seq, Ref: msg.Ref, Parent: msg.Parent, Mentions: msg.Mentions, Attachment: msg.Attachment}
+		if len(msg.Reactions) > 0 {
+			f.Reactions = make(map[string]uint32)
+			for _, reaction := range msg.Reactions {
+				f.Reactions[reaction.Emoji] = reaction.Count
+			}
+		}
+		s.send(f)
+	}
+}
+
+// Reads frames from the browser until it leaves or the socket closes
+func (s *session) read(ctx context.Context) {
+	for {
+		var f frame
+		if err := websocket.JSON.Receive(s.ws, &f); err != nil {
+			// The browser went away without saying goodbye
+			s.leave(ctx, 0)
+			return
+		}
+
+		switch f.Type {
+		case "message":
+			room := f.Room
+			if room == "" {
+				room = s.user.Room
+			}
+			_, err := client.Publish(s.auth(ctx), &proto.Message{Id: s.user.Id, Text: f.Text, Lamport: s.tick(f.Lamport), Room: room, Parent: f.Parent, Attachment: f.Attachment})
+			if err != nil {
+				// Rate limits and validation errors are shown to the user, the socket stays open
+				s.send(frame{Type: "error", Text: status.Convert(err).Message()})
+			}
+		case "edit", "delete", "react", "unreact":
+			req := &proto.Message{Id: s.user.Id, Text: f.Text, Lamport: s.tick(f.Lamport), Ref: f.Ref}
+			var err error
+			switch f.Type {
+			case "edit":
+				_, err = client.Edit(s.auth(ctx), req)
+			case "delete":
+				_, err = client.Delete(s.auth(ctx), req)
+			case "react":
+				req.Event = proto.EventType_EVENT_REACT
+				_, err = client.React(s.auth(ctx), req)
+			case "unreact":
+				req.Event = proto.EventType_EVENT_UNREACT
+				_, err = client.React(s.auth(ctx), req)
+			}
+			if err != nil {
+				s.send(frame{Type: "error", Text: status.Convert(err).Message()})
+			}
+		case "leave":
+			s.leave(ctx, f.Lamport)
+			s.send(frame{Type: "left", Id: s.user.Id})
+			return
+		default:
+			s.send(frame{Type: "error", Text: "unknown frame type " + f.Type})
+		}
+	}
+}
+
+// Leaves Chitty-Chat on behalf of the browser
+func (s *session) leave(ctx context.Context, browserLamport uint64) {
+	_, err := client.Leave(s.auth(ctx), &proto.Id{Id: s.user.Id, Lamport: s.tick(browserLamport)})
+	if err != nil {
+		log.Printf("[Gateway] Error occured when %s tried to leave: %v", s.user.Id, err)
+		return
+	}
+	log.Printf("[Gateway] %s left through a websocket", s.user.Id)
+}
+
+// The name of the frame or server-sent event for a message from the server
+func eventName(msg *proto.Message) string {
+	switch {
+	case msg.Id == "":
+		// If id == "", it is a system message
+		return "system"
+	case msg.Event == proto.EventType_EVENT_EDIT:
+		return "edit"
+	case msg.Event == proto.EventType_EVENT_DELETE:
+		return "delete"
+	case msg.Event == proto.EventType_EVENT_REACT:
+		return "react"
+	case msg.Event == proto.EventType_EVENT_UNREACT:
+		return "unreact"
+	case msg.Event == proto.EventType_EVENT_MENTION:
+		return "mention"
+	case msg.Event == proto.EventType_EVENT_PRESENCE:
+		return "presence"
+	}
+	return "message"
+}
+
+func max(x, y uint64) uint64 {
+	if x >= y {
+		return x
+	}
+	return y
+}
@@ -3,14 +3,20 @@ module github.com/00kristian/MiniProject_2
 go 1.17
 
 require (
+	github.com/gdamore/tcell/v2 v2.4.0
+	github.com/mattn/go-runewidth v0.0.10
 	golang.org/x/net v0.0.0-20200822124328-c89045814202
+	golang.org/x/term v0.0.0-20201210144234-2321bbc49cbf
+	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013
 	google.golang.org/grpc v1.41.0
 	google.golang.org/protobuf v1.27.1
 )
 
 require (
+	github.com/gdamore/encoding v1.0.0 // indirect
 	github.com/golang/protobuf v1.5.0 // indirect
-	golang.org/x/sys v0.0.0-20200323222414-85ca7c5b95cd // indirect
+	github.com/lucasb-eyer/go-colorful v1.0.3 // indirect
+	github.com/rivo/uniseg v0.1.0 // indirect
+	golang.org/x/sys v0.0.0-20201119102817-f84b799fce68 // indirect
 	golang.org/x/text v0.3.0 // indirect
-	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013 // indirect
 )
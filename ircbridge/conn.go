@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/00kristian/MiniProject_2/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Metadata key of the session the server sends in the header of the Join stream
+const sessionKey = "chitty-session"
+
+// A parsed IRC line: [:prefix] COMMAND params... [:trailing]
+type line struct {
+	command string
+	params  []string
+}
+
+// Parses a line from an IRC client. The trailing parameter is added as the last parameter
+func parseLine(text string) line {
+	text = strings.TrimRight(text, "\r\n")
+	// Clients may send a prefix, but it is ignored - we know who they are
+	if strings.HasPrefix(text, ":") {
+		if i := strings.Index(text, " "); i >= 0 {
+			text = text[i+1:]
+		} else {
+			text = ""
+		}
+	}
+	var trailing *string
+	if i := strings.Index(text, " :"); i >= 0 {
+		rest := text[i+2:]
+		trailing = &rest
+		text = text[:i]
+	}
+	fields := strings.Fields(text)
+	l := line{}
+	if len(fields) > 0 {
+		l.command = strings.ToUpper(fields[0])
+		l.params = fields[1:]
+	}
+	if trailing != nil {
+		l.params = append(l.params, *trailing)
+	}
+	return l
+}
+
+// An IRC client bridged to the chat server. An IRC client can be in one channel at a time,
+// since a user on the chat server has one Join stream
+type ircConn struct {
+	tcp    net.Conn
+	writeM sync.Mutex
+
+	nick       string
+	registered bool
+
+	// The channel the client is in, and the function to end its Join stream
+	channel string
+	cancel  context.CancelFunc
+
+	mu      sync.Mutex
+	lamport uint64
+	// The session of the Join stream, every call made as the user carries it
+	session string
+}
+
+func newIRCConn(tcp net.Conn) *ircConn {
+	return &ircConn{tcp: tcp}
+}
+
+// Ticks the lamport time of the connection, merging it with the given time
+func (c *ircConn) tick(other uint64) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lamport = max(c.lamport, other) + 1
+	return c.lamport
+}
+
+// Adds the session of the user to the calls made with the context
+func (c *ircConn) auth(ctx context.Context) context.Context {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.session == "" {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, sessionKey, c.session)
+}
+
+// Sends a raw line to the IRC client
+func (c *ircConn) send(format string, args ...interface{}) {
+	c.writeM.Lock()
+	defer c.writeM.Unlock()
+	fmt.Fprintf(c.tcp, format+"\r\n", args...)
+}
+
+// Sends a numeric reply from the server to the IRC client
+func (c *ircConn) reply(numeric string, params string) {
+	nick := c.nick
+	if nick == "" {
+		nick = "*"
+	}
+	c.send(":%s %s %s %s", serverName, numeric, nick, params)
+}
+
+// Reads commands from the IRC client until it quits or goes away
+func (c *ircConn) serve() {
+	defer c.tcp.Close()
+	scanner := bufio.NewScanner(c.tcp)
+	for scanner.Scan() {
+		l := parseLine(scanner.Text())
+		if l.command == "" {
+			continue
+		}
+		if !c.handle(l) {
+			return
+		}
+	}
+	// The client went away without QUIT
+	c.part()
+}
+
+// Handles a single command. Returns false when the connection should be closed
+func (c *ircConn) handle(l line) bool {
+	switch l.command {
+	case "PING":
+		c.send(":%s PONG %s :%s", serverName, serverName, strings.Join(l.params, " "))
+	case "PONG":
+	case "NICK":
+		if len(l.params) == 0 {
+			c.reply("431", ":No nickname given")
+			return true
+		}
+		if c.channel != "" {
+			c.reply("484", ":Cannot change nickname while in a channel")
+			return true
+		}
+		c.nick = l.params[0]
+	case "USER":
+		if c.nick == "" {
+			c.reply("451", ":Send NICK before USER")
+			return true
+		}
+		if !c.registered {
+			c.registered = true
+			c.reply("001", ":Welcome to Chitty-Chat =^.^= "+c.nick)
+			c.reply("002", ":Your host is "+serverName)
+			c.reply("004", serverName+" chitty-chat o o")
+			c.reply("422", ":MOTD File is missing")
+		}
+	case "QUIT":
+		c.part()
+		c.send("ERROR :Closing link")
+		return false
+	default:
+		if !c.registered {
+			c.reply("451", ":You have not registered")
+			return true
+		}
+		c.handleRegistered(l)
+	}
+	return true
+}
+
+// Handles the commands that require the client to be registered
+func (c *ircConn) handleRegistered(l line) {
+	switch l.command {
+	case "JOIN":
+		if len(l.params) == 0 {
+			c.reply("461", "JOIN :Not enough parameters")
+			return
+		}
+		// Only the first channel is used, since a user has one Join stream
+		channel := strings.Split(l.params[0], ",")[0]
+		if channel == "0" {
+			c.part()
+			return
+		}
+		c.join(channel)
+	case "PART":
+		if len(l.params) == 0 {
+			c.reply("461", "PART :Not enough parameters")
+			return
+		}
+		if c.channel == "" || !strings.EqualFold(l.params[0], c.channel) {
+			c.reply("442", l.params[0]+" :You're not on that channel")
+			return
+		}
+		c.part()
+	case "PRIVMSG":
+		if len(l.params) < 2 {
+			c.reply("412", ":No text to send")
+			return
+		}
+		c.privmsg(l.params[0], l.params[1])
+	case "NAMES":
+		channel := c.channel
+		if len(l.params) > 0 {
+			channel = l.params[0]
+		}
+		c.names(channel)
+	default:
+		c.reply("421", l.command+" :Unknown command")
+	}
+}
+
+// The name of the room on the chat server for an IRC channel
+func roomOf(channel string) string {
+	return strings.TrimPrefix(channel, "#")
+}
+
+// Joins the channel by joining the chat server in the room of the channel
+func (c *ircConn) join(channel string) {
+	if !strings.HasPrefix(channel, "#") {
+		c.reply("403", channel+" :No such channel")
+		return
+	}
+	if strings.EqualFold(channel, c.channel) {
+		return
+	}
+	// Leave the current channel first
+	c.part()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	user := &proto.User{Id: c.nick, Name: c.nick, Active: true, Room: roomOf(channel)}
+	stream, err := client.Join(ctx, user)
+	var header metadata.MD
+	if err == nil {
+		header, err = stream.Header()
+	}
+	// A server that does not let the user join ends the stream without a header. The server publishes the join message
+	if err == nil && len(header) == 0 {
+		_, err = stream.Recv()
+	}
+	if err != nil {
+		cancel()
+		c.reply("403", channel+" :"+status.Convert(err).Message())
+		return
+	}
+	c.mu.Lock()
+	c.session = first(header.Get(sessionKey))
+	c.mu.Unlock()
+	c.channel = channel
+	c.cancel = cancel
+
+	c.send(":%s!%s@%s JOIN %s", c.nick, c.nick, serverName, channel)
+	c.names(channel)
+	log.Printf("[IRC] %s joined %s", c.nick, channel)
+
+	go c.forward(channel, stream)
+}
+
+// Forwards everything from the Join stream to the IRC client
+func (c *ircConn) forward(channel string, stream proto.Chat_JoinClient) {
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			// The stream was cancelled because we left, or the server ended it
+			if status.Code(err) != codes.Canceled {
+				c.send(":%s NOTICE %s :%s", serverName, channel, status.Convert(err).Message())
+			}
+			return
+		}
+		c.tick(msg.Lamport)
+
+		target := channel
+		if msg.Room != "" && msg.Room != roomOf(channel) {
+			target = "#" + msg.Room
+		}
+		switch {
+		case msg.Id == "":
+			// If id == "", it is a system message
+			c.send(":%s NOTICE %s :%s", serverName, target, msg.Text)
+		case msg.Event == proto.EventType_EVENT_MENTION:
+			// IRC clients notice their nick in messages of the channel themselves, mentions from other rooms are sent to the nick
+			if target != channel {
+				c.send(":%s!%s@%s NOTICE %s :mentioned you in %s: %s", msg.Id, msg.Id, serverName, c.nick, target, msg.Text)
+			}
+		case msg.Event == proto.EventType_EVENT_EDIT:
+			// IRC has no way to change a message that was sent, so edits and deletes are told as notices
+			c.send(":%s!%s@%s NOTICE %s :edited message %d: %s", msg.Id, msg.Id, serverName, target, msg.Ref, msg.Text)
+		case msg.Event == proto.EventType_EVENT_DELETE:
+			c.send(":%s!%s@%s NOTICE %s :deleted message %d", msg.Id, msg.Id, serverName, target, msg.Ref)
+		case msg.Event == proto.EventType_EVENT_REACT:
+			c.send(":%s!%s@%s NOTICE %s :reacted %s to message %d", msg.Id, msg.Id, serverName, target, msg.Text, msg.Ref)
+		case msg.Event == proto.EventType_EVENT_UNREACT:
+			// Taking back a reaction is not worth a notice
+		case msg.Event == proto.EventType_EVENT_PRESENCE:
+			c.send(":%s NOTICE %s :%s is %s", serverName, target, msg.Id, msg.Text)
+		case msg.Id != c.nick:
+			// IRC clients show their own messages themselves. IRC has no replies, so they just say what they reply to
+			text := msg.Text
+			if msg.Parent != 0 {
+				text = fmt.Sprintf("(re %d) %s", msg.Parent, text)
+			}
+			if msg.Attachment != nil {
+				text = fmt.Sprintf("%s [attachment %s, %d bytes, %s]", text, msg.Attachment.Name, msg.Attachment.Size, msg.Attachment.Hash)
+			}
+			c.send(":%s!%s@%s PRIVMSG %s :%s", msg.Id, msg.Id, serverName, target, text)
+		}
+	}
+}
+
+// Leaves the current channel, if any
+func (c *ircConn) part() {
+	if c.channel == "" {
+		return
+	}
+	_, err := client.Leave(c.auth(context.Background()), &proto.Id{Id: c.nick, Lamport: c.tick(0)})
+	if err != nil {
+		log.Printf("[IRC] Error occured when %s tried to leave: %v", c.nick, err)
+	}
+	c.cancel()
+	c.send(":%s!%s@%s PART %s", c.nick, c.nick, serverName, c.channel)
+	log.Printf("[IRC] %s left %s", c.nick, c.channel)
+	c.channel = ""
+	c.cancel = nil
+}
+
+// Publishes a message to the channel
+func (c *ircConn) privmsg(target string, text string) {
+	if !strings.HasPrefix(target, "#") {
+		c.reply("401", target+" :Private messages are not supported by Chitty-Chat")
+		return
+	}
+	if !strings.EqualFold(target, c.channel) {
+		c.reply("404", target+" :Cannot send to channel")
+		return
+	}
+	_, err := client.Publish(c.auth(context.Background()), &proto.Message{Id: c.nick, Text: text, Lamport: c.tick(0), Room: roomOf(target)})
+	if err != nil {
+		// Rate limits and validation errors are shown to the user
+		c.reply("404", target+" :"+status.Convert(err).Message())
+	}
+}
+
+// Lists the users in the channel
+func (c *ircConn) names(channel string) {
+	if channel != "" {
+		list, err := client.ListUsers(context.Background(), &proto.RoomRequest{Room: roomOf(channel)})
+		if err == nil {
+			var nicks []string
+			for _, user := range list.Users {
+				nicks = append(nicks, user.Id)
+			}
+			c.reply("353", "= "+channel+" :"+strings.Join(nicks, " "))
+		}
+	}
+	c.reply("366", channel+" :End of /NAMES list")
+}
+
+// The first of the values, empty if there are none
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func max(x, y uint64) uint64 {
+	if x >= y {
+		return x
+	}
+	return y
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/00kristian/MiniProject_2/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// A chat server in memory. Only the rpcs the bridge uses are there, the others panic
+type fakeChat struct {
+	proto.ChatClient
+	// The error Join fails with, if any
+	rejectJoin error
+
+	mu        sync.Mutex
+	joined    []*proto.User
+	published []*proto.Message
+	left      []*proto.Id
+	// The session every Publish and Leave was called with
+	sessions []string
+	stream   *fakeStream
+}
+
+// The Join stream of the fake server. The test sends messages to the user through it
+type fakeStream struct {
+	grpc.ClientStream
+	ctx      context.Context
+	header   metadata.MD
+	err      error
+	messages chan *proto.Message
+}
+
+func (f *fakeChat) Join(ctx context.Context, user *proto.User, _ ...grpc.CallOption) (proto.Chat_JoinClient, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.joined = append(f.joined, user)
+	// A rejected join ends the stream without a header, like the server does
+	stream := &fakeStream{ctx: ctx, header: metadata.Pairs(sessionKey, "session-of-"+user.Id), messages: make(chan *proto.Message, 10)}
+	if f.rejectJoin != nil {
+		stream.header, stream.err = metadata.MD{}, f.rejectJoin
+	}
+	f.stream = stream
+	return stream, nil
+}
+
+func (f *fakeChat) Publish(ctx context.Context, msg *proto.Message, _ ...grpc.CallOption) (*proto.Empty, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.published = append(f.published, msg)
+	f.sessions = append(f.sessions, sessionOf(ctx))
+	return &proto.Empty{}, nil
+}
+
+func (f *fakeChat) Leave(ctx context.Context, id *proto.Id, _ ...grpc.CallOption) (*proto.Empty, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.left = append(f.left, id)
+	f.sessions = append(f.sessions, sessionOf(ctx))
+	return &proto.Empty{}, nil
+}
+
+func (f *fakeChat) ListUsers(ctx context.Context, req *proto.RoomRequest, _ ...grpc.CallOption) (*proto.UserList, error) {
+	return &proto.UserList{Users: []*proto.User{{Id: "alice"}, {Id: "bob"}}}, nil
+}
+
+func (s *fakeStream) Header() (metadata.MD, error) {
+	return s.header, nil
+}
+
+func (s *fakeStream) Recv() (*proto.Message, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	select {
+	case msg := <-s.messages:
+		return msg, nil
+	case <-s.ctx.Done():
+		return nil, status.FromContextError(s.ctx.Err()).Err()
+	}
+}
+
+// The session the call carries
+func sessionOf(ctx context.Context) string {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	return first(md.Get(sessionKey))
+}
+
+// An IRC client talking to the bridge over a pipe
+type ircClient struct {
+	conn  net.Conn
+	lines chan string
+}
+
+// Bridges a new IRC connection to the fake server
+func connect(t *testing.T, chat *fakeChat) *ircClient {
+	client = chat
+	ours, theirs := net.Pipe()
+	go newIRCConn(theirs).serve()
+	c := &ircClient{conn: ours, lines: make(chan string, 100)}
+	go func() {
+		scanner := bufio.NewScanner(ours)
+		for scanner.Scan() {
+			c.lines <- scanner.Text()
+		}
+		close(c.lines)
+	}()
+	t.Cleanup(func() { ours.Close() })
+	return c
+}
+
+func (c *ircClient) send(t *testing.T, line string) {
+	t.Helper()
+	c.conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.conn.Write([]byte(line + "\r\n")); err != nil {
+		t.Fatalf("could not send %q: %v", line, err)
+	}
+}
+
+// Reads lines from the bridge until one contains the text
+func (c *ircClient) expect(t *testing.T, text string) string {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case line, ok := <-c.lines:
+			if !ok {
+				t.Fatalf("the bridge closed the connection while we waited for %q", text)
+			}
+			if strings.Contains(line, text) {
+				return line
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %q", text)
+		}
+	}
+}
+
+func TestRegisterJoinPrivmsgPart(t *testing.T) {
+	chat := &fakeChat{}
+	c := connect(t, chat)
+
+	c.send(t, "NICK alice")
+	c.send(t, "USER alice 0 * :Alice")
+	c.expect(t, "001 alice :Welcome to Chitty-Chat")
+	c.expect(t, "422 alice")
+
+	c.send(t, "JOIN #lobby")
+	c.expect(t, ":alice!alice@chitty-chat JOIN #lobby")
+	if got := c.expect(t, " 353 "); !strings.HasSuffix(got, "= #lobby :alice bob") {
+		t.Errorf("names are %q", got)
+	}
+	c.expect(t, " 366 ")
+	chat.mu.Lock()
+	if len(chat.joined) != 1 || chat.joined[0].Id != "alice" || chat.joined[0].Room != "lobby" {
+		t.Errorf("joined %v, want alice in lobby", chat.joined)
+	}
+	stream := chat.stream
+	chat.mu.Unlock()
+
+	// Messages of others come through as PRIVMSG, our own are not echoed
+	stream.messages <- &proto.Message{Id: "alice", Text: "echo", Room: "lobby"}
+	stream.messages <- &proto.Message{Id: "bob", Text: "hi alice", Room: "lobby"}
+	if got := c.expect(t, "PRIVMSG"); got != ":bob!bob@chitty-chat PRIVMSG #lobby :hi alice" {
+		t.Errorf("got %q", got)
+	}
+
+	c.send(t, "PRIVMSG #lobby :hello bob")
+	c.send(t, "PART #lobby")
+	c.expect(t, ":alice!alice@chitty-chat PART #lobby")
+
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+	if len(chat.published) != 1 || chat.published[0].Id != "alice" || chat.published[0].Text != "hello bob" || chat.published[0].Room != "lobby" {
+		t.Errorf("published %v, want hello bob from alice in lobby", chat.published)
+	}
+	if len(chat.left) != 1 || chat.left[0].Id != "alice" {
+		t.Errorf("left %v, want alice", chat.left)
+	}
+	// Calls made as the user carry the session of its Join stream
+	for _, session := range chat.sessions {
+		if session != "session-of-alice" {
+			t.Errorf("a call was made with session %q", session)
+		}
+	}
+}
+
+func TestRejectedJoin(t *testing.T) {
+	chat := &fakeChat{rejectJoin: status.Error(codes.PermissionDenied, "alice is banned: spam")}
+	c := connect(t, chat)
+
+	c.send(t, "NICK alice")
+	c.send(t, "USER alice 0 * :Alice")
+	c.expect(t, "422 alice")
+	c.send(t, "JOIN #lobby")
+	if got := c.expect(t, " 403 "); !strings.HasSuffix(got, "#lobby :alice is banned: spam") {
+		t.Errorf("got %q", got)
+	}
+
+	// Not in the channel, so nothing can be sent to it
+	c.send(t, "PRIVMSG #lobby :hello")
+	c.expect(t, " 404 ")
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+	if len(chat.published) != 0 {
+		t.Errorf("published %v without joining", chat.published)
+	}
+}
+
+func TestCommandsBeforeRegistering(t *testing.T) {
+	c := connect(t, &fakeChat{})
+	c.send(t, "JOIN #lobby")
+	c.expect(t, "451 * :You have not registered")
+	c.send(t, "USER alice 0 * :Alice")
+	c.expect(t, "451 * :Send NICK before USER")
+	c.send(t, "PING :check")
+	c.expect(t, "PONG chitty-chat :check")
+	c.send(t, "QUIT")
+	c.expect(t, "ERROR :Closing link")
+}
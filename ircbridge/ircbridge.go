@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+
+	"github.com/00kristian/MiniProject_2/proto"
+	"google.golang.org/grpc"
+)
+
+// Name the bridge uses as server name towards IRC clients
+const serverName = "chitty-chat"
+
+// Client for the chat server every IRC connection is bridged to
+var client proto.ChatClient
+
+func main() {
+	listen := flag.String("listen", ":6667", "Address the IRC bridge listens on")
+	address := flag.String("server", ":8080", "Address of the Chitty-Chat server")
+	flag.Parse()
+
+	// Connect to our server - no https, so connect with grpc.WithInsecure()
+	conn, err := grpc.Dial(*address, grpc.WithInsecure())
+	if err != nil {
+		log.Fatalf("Could not connect: %s", err)
+	}
+	defer conn.Close()
+	client = proto.NewChatClient(conn)
+
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatalf("Error creating IRC bridge: %v", err)
+	}
+	log.Printf("[IRC] Started IRC bridge on %s for server %s", *listen, *address)
+
+	for {
+		tcp, err := listener.Accept()
+		if err != nil {
+			log.Printf("[IRC] Error accepting connection: %v", err)
+			continue
+		}
+		go newIRCConn(tcp).serve()
+	}
+}
@@ -0,0 +1,240 @@
+// Package membership keeps track of which members are still around, with the phi accrual failure detector.
+// Members send heartbeats, and instead of a fixed timeout the detector learns how regularly each member sends them.
+// Phi tells how unlikely it is that a member is still alive given how long it has been quiet: a phi of 1 means
+// about a 10% chance of being wrong when calling it dead, 2 about 1%, 3 about 0.1% and so on. Members above
+// one threshold are suspected, and above a higher one they are dead and forgotten.
+// Time comes from a Clock, so the detector can be driven by a fake clock in simulations.
+package membership
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// What the detector thinks of a member
+type Status int
+
+const (
+	Alive Status = iota
+	Suspect
+	Dead
+)
+
+func (s Status) String() string {
+	return [...]string{"alive", "suspect", "dead"}[s]
+}
+
+// Where the detector gets the time from
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// The clock of the system
+var SystemClock Clock = systemClock{}
+
+// A clock that only moves when it is told to
+type FakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Moves the clock forward
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+type Config struct {
+	// Defaults to the system clock
+	Clock Clock
+	// How often members are expected to send heartbeats. Used until a member has sent a few
+	HeartbeatInterval time.Duration
+	// Phi above which a member is suspected, and above which it is dead. Default 5 and 12
+	SuspectPhi float64
+	DeadPhi    float64
+	// Number of intervals between heartbeats remembered per member. Default 100
+	WindowSize int
+	// Lower bound of the deviation of the intervals, so members with very regular heartbeats are not
+	// suspected the moment one heartbeat is a little late. Defaults to half the heartbeat interval
+	MinStdDeviation time.Duration
+}
+
+// A status change of a member, with the phi that caused it
+type Change struct {
+	ID   string
+	From Status
+	To   Status
+	Phi  float64
+}
+
+// The phi accrual failure detector. Safe for concurrent use
+type Detector struct {
+	config Config
+
+	mu      sync.Mutex
+	members map[string]*member
+}
+
+// What the detector knows about a member
+type member struct {
+	status Status
+	last   time.Time
+	// The most recent intervals between heartbeats in milliseconds, oldest first
+	intervals []float64
+}
+
+func New(config Config) *Detector {
+	if config.Clock == nil {
+		config.Clock = SystemClock
+	}
+	if config.HeartbeatInterval == 0 {
+		config.HeartbeatInterval = time.Second
+	}
+	if config.SuspectPhi == 0 {
+		config.SuspectPhi = 5
+	}
+	if config.DeadPhi == 0 {
+		config.DeadPhi = 12
+	}
+	if config.WindowSize == 0 {
+		config.WindowSize = 100
+	}
+	if config.MinStdDeviation == 0 {
+		config.MinStdDeviation = config.HeartbeatInterval / 2
+	}
+	return &Detector{config: config, members: make(map[string]*member)}
+}
+
+// Records a heartbeat from the member. The first heartbeat makes it a member
+func (d *Detector) Heartbeat(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.config.Clock.Now()
+	m, found := d.members[id]
+	if !found {
+		// Until real intervals arrive, the member is expected to keep to the heartbeat interval
+		expected := milliseconds(d.config.HeartbeatInterval)
+		d.members[id] = &member{last: now, intervals: []float64{expected, expected}}
+		return
+	}
+	m.intervals = append(m.intervals, milliseconds(now.Sub(m.last)))
+	if len(m.intervals) > d.config.WindowSize {
+		m.intervals = m.intervals[1:]
+	}
+	m.last = now
+}
+
+// Forgets the member, like when it left on its own
+func (d *Detector) Remove(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.members, id)
+}
+
+// What the detector thinks of the member. False if it is not a member
+func (d *Detector) Status(id string) (Status, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m, found := d.members[id]
+	if !found {
+		return Dead, false
+	}
+	return m.status, true
+}
+
+// The phi of the member right now, 0 if it is not a member
+func (d *Detector) Phi(id string) float64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m, found := d.members[id]
+	if !found {
+		return 0
+	}
+	return d.phi(m, d.config.Clock.Now())
+}
+
+// The ids of the members, sorted
+func (d *Detector) Members() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ids := make([]string, 0, len(d.members))
+	for id := range d.members {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Updates the status of every member and returns the changes, sorted by id. Dead members are forgotten.
+// A suspected member that sends a heartbeat again is alive again
+func (d *Detector) Check() []Change {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.config.Clock.Now()
+	var changes []Change
+	for id, m := range d.members {
+		phi := d.phi(m, now)
+		status := Alive
+		switch {
+		case phi >= d.config.DeadPhi:
+			status = Dead
+		case phi >= d.config.SuspectPhi:
+			status = Suspect
+		}
+		if status == m.status {
+			continue
+		}
+		changes = append(changes, Change{ID: id, From: m.status, To: status, Phi: phi})
+		m.status = status
+		if status == Dead {
+			delete(d.members, id)
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].ID < changes[j].ID })
+	return changes
+}
+
+// Phi of the member at the given time: -log10 of the probability that a heartbeat comes this late or later,
+// with the intervals assumed to be normally distributed. The caller must hold d.mu
+func (d *Detector) phi(m *member, now time.Time) float64 {
+	mean, deviation := 0.0, 0.0
+	for _, interval := range m.intervals {
+		mean += interval
+	}
+	mean /= float64(len(m.intervals))
+	for _, interval := range m.intervals {
+		deviation += (interval - mean) * (interval - mean)
+	}
+	deviation = math.Max(math.Sqrt(deviation/float64(len(m.intervals))), milliseconds(d.config.MinStdDeviation))
+
+	// A logistic approximation of the cumulative normal distribution, which does not run out of precision as fast
+	y := (milliseconds(now.Sub(m.last)) - mean) / deviation
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if y > 0 {
+		return -math.Log10(e / (1 + e))
+	}
+	return -math.Log10(1 - 1/(1+e))
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
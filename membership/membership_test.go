@@ -0,0 +1,125 @@
+package membership
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// A detector on a fake clock with a member that sent heartbeats every second for a while
+func newDetector(t *testing.T, id string) (*Detector, *FakeClock) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	d := New(Config{Clock: clock, HeartbeatInterval: time.Second})
+	for i := 0; i < 10; i++ {
+		d.Heartbeat(id)
+		clock.Advance(time.Second)
+	}
+	d.Heartbeat(id)
+	if changes := d.Check(); len(changes) != 0 {
+		t.Fatalf("changes %v for a member that keeps to its interval", changes)
+	}
+	return d, clock
+}
+
+// Moves the clock in small steps until the member changes, and returns the change
+func waitForChange(t *testing.T, d *Detector, clock *FakeClock) Change {
+	t.Helper()
+	for i := 0; i < 1000; i++ {
+		clock.Advance(100 * time.Millisecond)
+		if changes := d.Check(); len(changes) > 0 {
+			if len(changes) != 1 {
+				t.Fatalf("got %d changes at once: %v", len(changes), changes)
+			}
+			return changes[0]
+		}
+	}
+	t.Fatalf("the member did not change in 100 seconds")
+	return Change{}
+}
+
+func TestRegularHeartbeatsStayAlive(t *testing.T) {
+	d, clock := newDetector(t, "alice")
+	for i := 0; i < 100; i++ {
+		// A little late or early, well within what the detector learned
+		clock.Advance(time.Second + time.Duration(i%3-1)*100*time.Millisecond)
+		d.Heartbeat("alice")
+		if changes := d.Check(); len(changes) != 0 {
+			t.Fatalf("heartbeat %d: changes %v", i, changes)
+		}
+	}
+	if status, _ := d.Status("alice"); status != Alive {
+		t.Errorf("alice is %v, want alive", status)
+	}
+}
+
+func TestSuspectedMemberComesBack(t *testing.T) {
+	d, clock := newDetector(t, "alice")
+
+	change := waitForChange(t, d, clock)
+	if change.ID != "alice" || change.From != Alive || change.To != Suspect {
+		t.Fatalf("got %+v, want alice going from alive to suspect", change)
+	}
+	if change.Phi < 5 || change.Phi >= 12 {
+		t.Errorf("suspected with phi %v, want between the thresholds", change.Phi)
+	}
+	if status, _ := d.Status("alice"); status != Suspect {
+		t.Errorf("alice is %v, want suspect", status)
+	}
+
+	d.Heartbeat("alice")
+	want := []Change{{ID: "alice", From: Suspect, To: Alive}}
+	changes := d.Check()
+	for i := range changes {
+		changes[i].Phi = 0
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("after a heartbeat got %v, want %v", changes, want)
+	}
+}
+
+func TestDeadMemberIsForgottenAndCanComeBack(t *testing.T) {
+	d, clock := newDetector(t, "alice")
+
+	if change := waitForChange(t, d, clock); change.To != Suspect {
+		t.Fatalf("got %+v, want alice suspected first", change)
+	}
+	change := waitForChange(t, d, clock)
+	if change.ID != "alice" || change.From != Suspect || change.To != Dead {
+		t.Fatalf("got %+v, want alice going from suspect to dead", change)
+	}
+	if change.Phi < 12 {
+		t.Errorf("dead with phi %v, want at least 12", change.Phi)
+	}
+	if _, found := d.Status("alice"); found {
+		t.Errorf("alice is still a member after being declared dead")
+	}
+	if phi := d.Phi("alice"); phi != 0 {
+		t.Errorf("phi of a forgotten member is %v, want 0", phi)
+	}
+
+	// A heartbeat makes alice a member again, starting over with the heartbeat interval
+	d.Heartbeat("alice")
+	if status, found := d.Status("alice"); !found || status != Alive {
+		t.Fatalf("alice is %v after a heartbeat, want alive", status)
+	}
+	clock.Advance(time.Second)
+	d.Heartbeat("alice")
+	if changes := d.Check(); len(changes) != 0 {
+		t.Errorf("changes %v right after alice came back", changes)
+	}
+	if members := d.Members(); !reflect.DeepEqual(members, []string{"alice"}) {
+		t.Errorf("members are %v, want alice", members)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	d, clock := newDetector(t, "alice")
+	d.Remove("alice")
+	clock.Advance(time.Hour)
+	if changes := d.Check(); len(changes) != 0 {
+		t.Errorf("changes %v for a member that left", changes)
+	}
+	if members := d.Members(); len(members) != 0 {
+		t.Errorf("members are %v after alice left", members)
+	}
+}
@@ -0,0 +1,75 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/00kristian/MiniProject_2/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Transport between server processes over gRPC. Calls carry the token as "authorization: Bearer <token>" metadata
+type GRPCTransport struct {
+	// Address of every node by id
+	addresses map[string]string
+	token     string
+
+	mu      sync.Mutex
+	clients map[string]proto.RaftClient
+}
+
+func NewGRPCTransport(addresses map[string]string, token string) *GRPCTransport {
+	return &GRPCTransport{addresses: addresses, token: token, clients: make(map[string]proto.RaftClient)}
+}
+
+// Connects to the node, reusing the connection if there is one. Connections are made lazily by grpc
+func (t *GRPCTransport) client(id string) (proto.RaftClient, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if client, found := t.clients[id]; found {
+		return client, nil
+	}
+	address, found := t.addresses[id]
+	if !found {
+		return nil, fmt.Errorf("unknown raft node %s", id)
+	}
+	conn, err := grpc.Dial(address, grpc.WithInsecure())
+	if err != nil {
+		return nil, err
+	}
+	t.clients[id] = proto.NewRaftClient(conn)
+	return t.clients[id], nil
+}
+
+func (t *GRPCTransport) RequestVote(ctx context.Context, to string, req *proto.VoteRequest) (*proto.VoteReply, error) {
+	client, err := t.client(to)
+	if err != nil {
+		return nil, err
+	}
+	return client.RequestVote(metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+t.token), req)
+}
+
+func (t *GRPCTransport) AppendEntries(ctx context.Context, to string, req *proto.AppendRequest) (*proto.AppendReply, error) {
+	client, err := t.client(to)
+	if err != nil {
+		return nil, err
+	}
+	return client.AppendEntries(metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+t.token), req)
+}
+
+// Implementation of the Raft service, handing the calls from other nodes to the node
+type Server struct {
+	// Has to be implemented, otherwise the grpc cannot register
+	proto.UnimplementedRaftServer
+	Node *Node
+}
+
+func (s *Server) RequestVote(ctx context.Context, req *proto.VoteRequest) (*proto.VoteReply, error) {
+	return s.Node.HandleRequestVote(req), nil
+}
+
+func (s *Server) AppendEntries(ctx context.Context, req *proto.AppendRequest) (*proto.AppendReply, error) {
+	return s.Node.HandleAppendEntries(req), nil
+}
@@ -0,0 +1,114 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/00kristian/MiniProject_2/proto"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+// ErrUnreachable is returned by the in-memory network when the nodes cannot reach each other
+var ErrUnreachable = errors.New("node is unreachable")
+
+// An in-memory network for running a whole cluster inside one process. The network can be partitioned,
+// so it is possible to see what happens when the leader is cut off from the rest
+type Network struct {
+	mu    sync.Mutex
+	nodes map[string]*Node
+	// Which group each node is in while the network is partitioned. Nodes in different groups cannot talk
+	groups map[string]int
+}
+
+func NewNetwork() *Network {
+	return &Network{nodes: make(map[string]*Node), groups: make(map[string]int)}
+}
+
+// Connects the node to the network
+func (net *Network) Add(node *Node) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	net.nodes[node.ID()] = node
+}
+
+// Removes the node from the network, as if it crashed
+func (net *Network) Remove(id string) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	delete(net.nodes, id)
+}
+
+// Splits the network into the given groups of node ids. Nodes not in any group are cut off from everybody
+func (net *Network) Partition(groups ...[]string) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	net.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, id := range group {
+			net.groups[id] = i + 1
+		}
+	}
+	for id := range net.nodes {
+		if net.groups[id] == 0 {
+			net.groups[id] = -len(net.groups) - 1
+		}
+	}
+}
+
+// Ends the partition, everybody can talk to everybody again
+func (net *Network) Heal() {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	net.groups = make(map[string]int)
+}
+
+// The transport the node with the given id uses to reach the others
+func (net *Network) Transport(from string) Transport {
+	return &memoryTransport{net: net, from: from}
+}
+
+// Finds the node if it can be reached from the other node
+func (net *Network) reach(from string, to string) (*Node, error) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	node, found := net.nodes[to]
+	if !found || net.groups[from] != net.groups[to] {
+		return nil, ErrUnreachable
+	}
+	if _, found := net.nodes[from]; !found {
+		return nil, ErrUnreachable
+	}
+	return node, nil
+}
+
+type memoryTransport struct {
+	net  *Network
+	from string
+}
+
+// Requests and replies are copied, just like they would be over the wire
+func (t *memoryTransport) RequestVote(ctx context.Context, to string, req *proto.VoteRequest) (*proto.VoteReply, error) {
+	node, err := t.net.reach(t.from, to)
+	if err != nil {
+		return nil, err
+	}
+	reply := node.HandleRequestVote(protobuf.Clone(req).(*proto.VoteRequest))
+	// The reply can be lost on the way back as well
+	if _, err := t.net.reach(to, t.from); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (t *memoryTransport) AppendEntries(ctx context.Context, to string, req *proto.AppendRequest) (*proto.AppendReply, error) {
+	node, err := t.net.reach(t.from, to)
+	if err != nil {
+		return nil, err
+	}
+	reply := node.HandleAppendEntries(protobuf.Clone(req).(*proto.AppendRequest))
+	if _, err := t.net.reach(to, t.from); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
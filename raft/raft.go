@@ -0,0 +1,561 @@
+// Package raft replicates a log of chat messages across a few server nodes with the Raft consensus algorithm.
+// A message is only handed to the server once a majority of the nodes has it in their log, so it survives
+// the loss of any minority of the nodes. The nodes talk through a Transport, which is gRPC between
+// processes or an in-memory network with simulated partitions inside a single process. Each node keeps its
+// term, vote and log in a Storage, on disk for real servers, so it survives a restart.
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/00kristian/MiniProject_2/proto"
+)
+
+// The role of a node. Every node starts as a follower
+type State int
+
+const (
+	Follower State = iota
+	Candidate
+	Leader
+)
+
+func (s State) String() string {
+	return [...]string{"follower", "candidate", "leader"}[s]
+}
+
+// Max number of entries sent in a single AppendEntries call
+const maxBatch = 100
+
+// ErrStopped is returned by Propose when the node is stopped
+var ErrStopped = errors.New("raft node is stopped")
+
+// Returned by Propose on a node that is not the leader. Leader is the id of the leader, if the node knows it
+type NotLeaderError struct {
+	Leader string
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.Leader == "" {
+		return "not the leader, and no leader is known"
+	}
+	return fmt.Sprintf("not the leader, the leader is %s", e.Leader)
+}
+
+// How nodes reach each other
+type Transport interface {
+	RequestVote(ctx context.Context, to string, req *proto.VoteRequest) (*proto.VoteReply, error)
+	AppendEntries(ctx context.Context, to string, req *proto.AppendRequest) (*proto.AppendReply, error)
+}
+
+type Config struct {
+	// Id of this node, and the ids of the other nodes
+	ID    string
+	Peers []string
+	// Called with every committed entry, in log order, on every node
+	Apply     func(entry *proto.LogEntry)
+	Transport Transport
+	// A follower that has not heard from a leader for between ElectionTimeout and twice that starts an election
+	ElectionTimeout time.Duration
+	// How often the leader tells the followers that it is alive. Must be well below ElectionTimeout
+	HeartbeatInterval time.Duration
+	// Where the term, the vote and the log are kept. In memory if nil, which is only safe for nodes that never restart
+	Storage Storage
+}
+
+// A node of the cluster. The term, the vote and the log are stored before the node acts on them,
+// so a node that restarts keeps the promises it made before. Committed entries are applied again after a restart
+type Node struct {
+	config Config
+
+	mu       sync.Mutex
+	state    State
+	term     uint64
+	votedFor string
+	leader   string
+	// log[0] is a placeholder, so the index of an entry is its position in the log
+	log         []*proto.LogEntry
+	commitIndex uint64
+	lastApplied uint64
+	// Per follower on the leader: the next entry to send, and the last entry known to be in its log
+	nextIndex  map[string]uint64
+	matchIndex map[string]uint64
+	// When the leader last heard from each follower
+	lastContact map[string]time.Time
+	// When a follower gives up on the leader and starts an election
+	electionDeadline time.Time
+	// Proposals waiting for their entry to be committed, by index
+	waiters map[uint64]chan error
+
+	applySignal chan struct{}
+	stop        chan struct{}
+	stopOnce    sync.Once
+	random      *rand.Rand
+}
+
+// Creates the node with the state found in the storage
+func New(config Config) (*Node, error) {
+	if config.ElectionTimeout == 0 {
+		config.ElectionTimeout = 300 * time.Millisecond
+	}
+	if config.HeartbeatInterval == 0 {
+		config.HeartbeatInterval = config.ElectionTimeout / 6
+	}
+	if config.Storage == nil {
+		config.Storage = NewMemoryStorage()
+	}
+	term, votedFor, entries, err := config.Storage.Load()
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{
+		config:      config,
+		log:         []*proto.LogEntry{{}},
+		nextIndex:   make(map[string]uint64),
+		matchIndex:  make(map[string]uint64),
+		lastContact: make(map[string]time.Time),
+		waiters:     make(map[uint64]chan error),
+		applySignal: make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+		random:      rand.New(rand.NewSource(time.Now().UnixNano() + int64(len(config.ID)))),
+	}
+	n.term, n.votedFor = term, votedFor
+	n.log = append(n.log, entries...)
+	n.resetElectionDeadline()
+	return n, nil
+}
+
+// Starts the timers and the goroutine applying committed entries
+func (n *Node) Start() {
+	go n.run()
+	go n.applier()
+}
+
+// Stops the node. Proposals waiting for a commit fail with ErrStopped
+func (n *Node) Stop() {
+	n.stopOnce.Do(func() {
+		close(n.stop)
+		n.mu.Lock()
+		n.failWaiters(0, ErrStopped)
+		n.mu.Unlock()
+	})
+}
+
+// The id of the node
+func (n *Node) ID() string {
+	return n.config.ID
+}
+
+// The role of the node, its term and the leader it knows of
+func (n *Node) Status() (State, uint64, string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.state, n.term, n.leader
+}
+
+// Number of entries known to be committed
+func (n *Node) CommitIndex() uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.commitIndex
+}
+
+// Adds the message to the log and waits until a majority of the nodes has it. Only the leader accepts proposals,
+// other nodes return a *NotLeaderError. If the leader loses its leadership while waiting, the message might
+// or might not end up committed
+func (n *Node) Propose(ctx context.Context, msg *proto.Message) (uint64, error) {
+	n.mu.Lock()
+	if n.state != Leader {
+		defer n.mu.Unlock()
+		return 0, &NotLeaderError{Leader: n.leader}
+	}
+	entry := &proto.LogEntry{Term: n.term, Index: n.lastIndex() + 1, Message: msg}
+	n.log = append(n.log, entry)
+	n.saveEntries(n.log[entry.Index:])
+	done := make(chan error, 1)
+	n.waiters[entry.Index] = done
+	// A cluster of one commits right away
+	n.advanceCommit()
+	n.mu.Unlock()
+
+	n.replicate()
+	select {
+	case err := <-done:
+		return entry.Index, err
+	case <-ctx.Done():
+		n.mu.Lock()
+		delete(n.waiters, entry.Index)
+		n.mu.Unlock()
+		return 0, ctx.Err()
+	case <-n.stop:
+		return 0, ErrStopped
+	}
+}
+
+// Ticks the timers: the leader sends heartbeats, everybody else waits for the leader and starts an election when it is gone
+func (n *Node) run() {
+	ticker := time.NewTicker(n.config.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+		}
+		n.mu.Lock()
+		// A leader cut off from the majority steps down, so its clients go looking for the real leader
+		if n.state == Leader && !n.hasQuorum() {
+			log.Printf("[Raft %s] Lost contact with the majority", n.config.ID)
+			n.becomeFollower(n.term)
+		}
+		state, timedOut := n.state, time.Now().After(n.electionDeadline)
+		n.mu.Unlock()
+		if state == Leader {
+			n.replicate()
+		} else if timedOut {
+			n.startElection()
+		}
+	}
+}
+
+// Becomes a candidate and asks every other node for its vote
+func (n *Node) startElection() {
+	n.mu.Lock()
+	n.state = Candidate
+	n.term++
+	n.votedFor = n.config.ID
+	n.leader = ""
+	n.saveState()
+	n.resetElectionDeadline()
+	req := &proto.VoteRequest{
+		Term:         n.term,
+		Candidate:    n.config.ID,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.lastTerm(),
+	}
+	votes := 1
+	if n.isMajority(votes) {
+		n.becomeLeader()
+	}
+	n.mu.Unlock()
+	log.Printf("[Raft %s] Starting election for term %d", n.config.ID, req.Term)
+
+	for _, peer := range n.config.Peers {
+		go func(peer string) {
+			ctx, cancel := context.WithTimeout(context.Background(), n.config.ElectionTimeout)
+			defer cancel()
+			reply, err := n.config.Transport.RequestVote(ctx, peer, req)
+			if err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if reply.Term > n.term {
+				n.becomeFollower(reply.Term)
+				return
+			}
+			// Votes for an older election do not count
+			if n.state != Candidate || n.term != req.Term || !reply.Granted {
+				return
+			}
+			votes++
+			if n.isMajority(votes) {
+				n.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// Starts leading. The caller must hold n.mu
+func (n *Node) becomeLeader() {
+	n.state = Leader
+	n.leader = n.config.ID
+	for _, peer := range n.config.Peers {
+		n.nextIndex[peer] = n.lastIndex() + 1
+		n.matchIndex[peer] = 0
+		// Followers get an election timeout to answer before the leader gives up
+		n.lastContact[peer] = time.Now()
+	}
+	// An empty entry of the new term, so entries of older terms get committed with it
+	n.log = append(n.log, &proto.LogEntry{Term: n.term, Index: n.lastIndex() + 1})
+	n.saveEntries(n.log[n.lastIndex():])
+	n.advanceCommit()
+	log.Printf("[Raft %s] Became leader for term %d", n.config.ID, n.term)
+	go n.replicate()
+}
+
+// Steps down to follower, in the given term if it is newer. Proposals waiting on this node can no longer
+// be promised a commit, so they fail. The caller must hold n.mu
+func (n *Node) becomeFollower(term uint64) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		n.saveState()
+	}
+	if n.state == Leader {
+		log.Printf("[Raft %s] Stepping down in term %d", n.config.ID, n.term)
+		n.failWaiters(0, &NotLeaderError{})
+	}
+	n.state = Follower
+	n.resetElectionDeadline()
+}
+
+// Sends the entries each follower is missing, or an empty heartbeat if it has them all
+func (n *Node) replicate() {
+	for _, peer := range n.config.Peers {
+		go n.replicateTo(peer)
+	}
+}
+
+func (n *Node) replicateTo(peer string) {
+	n.mu.Lock()
+	if n.state != Leader {
+		n.mu.Unlock()
+		return
+	}
+	prev := n.nextIndex[peer] - 1
+	if prev > n.lastIndex() {
+		prev = n.lastIndex()
+	}
+	end := n.lastIndex() + 1
+	if end-(prev+1) > maxBatch {
+		end = prev + 1 + maxBatch
+	}
+	req := &proto.AppendRequest{
+		Term:         n.term,
+		Leader:       n.config.ID,
+		PrevLogIndex: prev,
+		PrevLogTerm:  n.log[prev].Term,
+		Entries:      append([]*proto.LogEntry(nil), n.log[prev+1:end]...),
+		LeaderCommit: n.commitIndex,
+	}
+	n.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), n.config.ElectionTimeout)
+	defer cancel()
+	reply, err := n.config.Transport.AppendEntries(ctx, peer, req)
+	if err != nil {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if reply.Term > n.term {
+		n.becomeFollower(reply.Term)
+		return
+	}
+	if n.state != Leader || n.term != req.Term {
+		return
+	}
+	n.lastContact[peer] = time.Now()
+	if reply.Success {
+		// Replies can arrive out of order, so only ever move forward
+		if match := req.PrevLogIndex + uint64(len(req.Entries)); match > n.matchIndex[peer] {
+			n.matchIndex[peer] = match
+			n.nextIndex[peer] = match + 1
+		}
+		n.advanceCommit()
+		return
+	}
+	// The follower is missing entries or has conflicting ones. Back up to where it might agree with us
+	next := req.PrevLogIndex
+	if reply.LastIndex+1 < next {
+		next = reply.LastIndex + 1
+	}
+	if next < 1 {
+		next = 1
+	}
+	n.nextIndex[peer] = next
+}
+
+// Commits the newest entry of the current term that a majority has. The caller must hold n.mu
+func (n *Node) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex; index-- {
+		// Only entries of the current term are committed by counting, older ones are committed with them
+		if n.log[index].Term != n.term {
+			break
+		}
+		count := 1
+		for _, peer := range n.config.Peers {
+			if n.matchIndex[peer] >= index {
+				count++
+			}
+		}
+		if n.isMajority(count) {
+			n.commitIndex = index
+			n.signalApply()
+			return
+		}
+	}
+}
+
+// Handles a vote request from a candidate
+func (n *Node) HandleRequestVote(req *proto.VoteRequest) *proto.VoteReply {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.Term > n.term {
+		n.becomeFollower(req.Term)
+	}
+	// Only vote once per term, and only for candidates with a log at least as new as ours
+	upToDate := req.LastLogTerm > n.lastTerm() || (req.LastLogTerm == n.lastTerm() && req.LastLogIndex >= n.lastIndex())
+	granted := req.Term == n.term && (n.votedFor == "" || n.votedFor == req.Candidate) && upToDate
+	if granted && n.votedFor != req.Candidate {
+		n.votedFor = req.Candidate
+		n.saveState()
+	}
+	if granted {
+		n.resetElectionDeadline()
+	}
+	return &proto.VoteReply{Term: n.term, Granted: granted}
+}
+
+// Handles entries or a heartbeat from the leader
+func (n *Node) HandleAppendEntries(req *proto.AppendRequest) *proto.AppendReply {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.Term < n.term {
+		return &proto.AppendReply{Term: n.term, Success: false, LastIndex: n.lastIndex()}
+	}
+	if req.Term > n.term || n.state != Follower {
+		n.becomeFollower(req.Term)
+	}
+	n.leader = req.Leader
+	n.resetElectionDeadline()
+
+	// Our log has to agree with the leader's up to the entry before the new ones
+	if req.PrevLogIndex > n.lastIndex() {
+		return &proto.AppendReply{Term: n.term, Success: false, LastIndex: n.lastIndex()}
+	}
+	if n.log[req.PrevLogIndex].Term != req.PrevLogTerm {
+		return &proto.AppendReply{Term: n.term, Success: false, LastIndex: req.PrevLogIndex - 1}
+	}
+
+	// The index of the first entry that changes our log, 0 if none does
+	var changed uint64
+	for _, entry := range req.Entries {
+		if entry.Index <= n.lastIndex() {
+			if n.log[entry.Index].Term == entry.Term {
+				continue
+			}
+			// A conflicting entry was never committed, so it and everything after it goes
+			n.failWaiters(entry.Index, &NotLeaderError{Leader: req.Leader})
+			n.log = n.log[:entry.Index]
+		}
+		if changed == 0 {
+			changed = entry.Index
+		}
+		n.log = append(n.log, entry)
+	}
+	// The leader counts us as having the entries once we answer
+	if changed != 0 {
+		n.saveEntries(n.log[changed:])
+	}
+
+	if req.LeaderCommit > n.commitIndex {
+		n.commitIndex = req.LeaderCommit
+		if last := req.PrevLogIndex + uint64(len(req.Entries)); last < n.commitIndex {
+			n.commitIndex = last
+		}
+		n.signalApply()
+	}
+	return &proto.AppendReply{Term: n.term, Success: true, LastIndex: n.lastIndex()}
+}
+
+// Hands committed entries to Apply in log order, and tells the proposers their entry is committed
+func (n *Node) applier() {
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-n.applySignal:
+		}
+		for {
+			n.mu.Lock()
+			if n.lastApplied >= n.commitIndex {
+				n.mu.Unlock()
+				break
+			}
+			n.lastApplied++
+			entry := n.log[n.lastApplied]
+			done, waiting := n.waiters[entry.Index]
+			delete(n.waiters, entry.Index)
+			n.mu.Unlock()
+
+			// Empty entries only exist to commit entries of older terms
+			if entry.Message != nil && n.config.Apply != nil {
+				n.config.Apply(entry)
+			}
+			if waiting {
+				done <- nil
+			}
+		}
+	}
+}
+
+// Stores the term and the vote. A node that cannot store them could break its promises after a restart,
+// so it stops the process instead - to the others that is just a crashed node. The caller must hold n.mu
+func (n *Node) saveState() {
+	if err := n.config.Storage.SaveState(n.term, n.votedFor); err != nil {
+		log.Fatalf("[Raft %s] Could not store the term and the vote: %v", n.config.ID, err)
+	}
+}
+
+// Stores the entries at the end of the log, replacing stored entries from the first of them on. The caller must hold n.mu
+func (n *Node) saveEntries(entries []*proto.LogEntry) {
+	if err := n.config.Storage.Append(entries); err != nil {
+		log.Fatalf("[Raft %s] Could not store the log: %v", n.config.ID, err)
+	}
+}
+
+// Fails the proposals waiting for entries from the given index on. The caller must hold n.mu
+func (n *Node) failWaiters(from uint64, err error) {
+	for index, done := range n.waiters {
+		if index >= from {
+			done <- err
+			delete(n.waiters, index)
+		}
+	}
+}
+
+func (n *Node) signalApply() {
+	select {
+	case n.applySignal <- struct{}{}:
+	default:
+	}
+}
+
+// Picks a new random election deadline, so nodes rarely start elections at the same time. The caller must hold n.mu
+func (n *Node) resetElectionDeadline() {
+	timeout := n.config.ElectionTimeout + time.Duration(n.random.Int63n(int64(n.config.ElectionTimeout)))
+	n.electionDeadline = time.Now().Add(timeout)
+}
+
+// Checks if the leader has heard from a majority within the election timeout. The caller must hold n.mu
+func (n *Node) hasQuorum() bool {
+	count := 1
+	for _, peer := range n.config.Peers {
+		if time.Since(n.lastContact[peer]) < n.config.ElectionTimeout {
+			count++
+		}
+	}
+	return n.isMajority(count)
+}
+
+// Checks if the number of nodes is a majority of the cluster
+func (n *Node) isMajority(count int) bool {
+	return count*2 > len(n.config.Peers)+1
+}
+
+func (n *Node) lastIndex() uint64 {
+	return uint64(len(n.log) - 1)
+}
+
+func (n *Node) lastTerm() uint64 {
+	return n.log[len(n.log)-1].Term
+}
@@ -0,0 +1,271 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/00kristian/MiniProject_2/proto"
+)
+
+// A cluster on the in-memory network, remembering what every node applied
+type cluster struct {
+	network *Network
+	nodes   []*Node
+
+	mu      sync.Mutex
+	applied map[string][]string
+}
+
+func newCluster(t *testing.T, size int) *cluster {
+	c := &cluster{network: NewNetwork(), applied: make(map[string][]string)}
+	var ids []string
+	for i := 1; i <= size; i++ {
+		ids = append(ids, fmt.Sprintf("node%d", i))
+	}
+	for _, id := range ids {
+		id := id
+		var peers []string
+		for _, other := range ids {
+			if other != id {
+				peers = append(peers, other)
+			}
+		}
+		node, err := New(Config{
+			ID:              id,
+			Peers:           peers,
+			Transport:       c.network.Transport(id),
+			ElectionTimeout: 100 * time.Millisecond,
+			Apply: func(entry *proto.LogEntry) {
+				c.mu.Lock()
+				c.applied[id] = append(c.applied[id], entry.Message.Text)
+				c.mu.Unlock()
+			},
+		})
+		if err != nil {
+			t.Fatalf("could not create %s: %v", id, err)
+		}
+		c.network.Add(node)
+		c.nodes = append(c.nodes, node)
+		node.Start()
+	}
+	t.Cleanup(func() {
+		for _, node := range c.nodes {
+			node.Stop()
+		}
+	})
+	return c
+}
+
+// Waits until exactly one of the given nodes, or of all nodes if none are given, is leader and they all agree on it
+func (c *cluster) waitForLeader(t *testing.T, ids ...string) *Node {
+	t.Helper()
+	var leader *Node
+	waitFor(t, "a leader", func() bool {
+		leader = nil
+		known := make(map[string]bool)
+		for _, node := range c.nodes {
+			if len(ids) > 0 && !contains(ids, node.ID()) {
+				continue
+			}
+			state, _, current := node.Status()
+			if state == Leader {
+				if leader != nil {
+					return false
+				}
+				leader = node
+			}
+			known[current] = true
+		}
+		return leader != nil && len(known) == 1
+	})
+	return leader
+}
+
+func (c *cluster) propose(t *testing.T, node *Node, text string) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := node.Propose(ctx, &proto.Message{Id: "test", Text: text}); err != nil {
+		t.Fatalf("%s could not commit %q: %v", node.ID(), text, err)
+	}
+}
+
+func (c *cluster) appliedBy(id string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.applied[id]...)
+}
+
+func TestLeaderChangeAfterPartition(t *testing.T) {
+	c := newCluster(t, 5)
+	leader := c.waitForLeader(t)
+	c.propose(t, leader, "before the partition")
+
+	// Cut the old leader off with one other node, the other three are the majority
+	minority, majority := []string{leader.ID()}, []string(nil)
+	for _, node := range c.nodes {
+		switch {
+		case node == leader:
+		case len(minority) < 2:
+			minority = append(minority, node.ID())
+		default:
+			majority = append(majority, node.ID())
+		}
+	}
+	c.network.Partition(minority, majority)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	_, err := leader.Propose(ctx, &proto.Message{Id: "test", Text: "lost in the minority"})
+	cancel()
+	if err == nil {
+		t.Fatalf("the old leader committed without the majority")
+	}
+
+	newLeader := c.waitForLeader(t, majority...)
+	if newLeader == leader {
+		t.Fatalf("the old leader is still the leader of the majority")
+	}
+	c.propose(t, newLeader, "during the partition")
+
+	c.network.Heal()
+	final := c.waitForLeader(t)
+	c.propose(t, final, "after the partition")
+
+	want := []string{"before the partition", "during the partition", "after the partition"}
+	for _, node := range c.nodes {
+		id := node.ID()
+		waitFor(t, id+" to apply every committed entry", func() bool {
+			return len(c.appliedBy(id)) >= len(want)
+		})
+		if got := c.appliedBy(id); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s applied %q, want %q", id, got, want)
+		}
+	}
+}
+
+func TestLeaderChangeAfterCrash(t *testing.T) {
+	c := newCluster(t, 3)
+	leader := c.waitForLeader(t)
+	c.propose(t, leader, "first")
+
+	c.network.Remove(leader.ID())
+	var rest []string
+	for _, node := range c.nodes {
+		if node != leader {
+			rest = append(rest, node.ID())
+		}
+	}
+	newLeader := c.waitForLeader(t, rest...)
+	c.propose(t, newLeader, "second")
+
+	for _, id := range rest {
+		id := id
+		waitFor(t, id+" to apply both entries", func() bool {
+			return len(c.appliedBy(id)) >= 2
+		})
+		if got, want := c.appliedBy(id), []string{"first", "second"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s applied %q, want %q", id, got, want)
+		}
+	}
+}
+
+func TestRestartKeepsTermVoteAndLog(t *testing.T) {
+	dir := t.TempDir()
+	open := func() (*Node, *FileStorage) {
+		t.Helper()
+		storage, err := OpenFileStorage(dir)
+		if err != nil {
+			t.Fatalf("could not open the storage: %v", err)
+		}
+		node, err := New(Config{ID: "a", Peers: []string{"b", "c"}, Storage: storage})
+		if err != nil {
+			t.Fatalf("could not create the node: %v", err)
+		}
+		return node, storage
+	}
+	entry := func(term, index uint64, text string) *proto.LogEntry {
+		return &proto.LogEntry{Term: term, Index: index, Message: &proto.Message{Id: "test", Text: text}}
+	}
+
+	node, storage := open()
+	if reply := node.HandleRequestVote(&proto.VoteRequest{Term: 3, Candidate: "b"}); !reply.Granted {
+		t.Fatalf("the vote for b was not granted")
+	}
+	reply := node.HandleAppendEntries(&proto.AppendRequest{Term: 3, Leader: "b", Entries: []*proto.LogEntry{entry(3, 1, "one"), entry(3, 2, "two")}})
+	if !reply.Success {
+		t.Fatalf("the entries of b were not appended")
+	}
+	storage.Close()
+
+	// The restarted node must not vote for another candidate in the same term
+	node, storage = open()
+	if _, term, _ := node.Status(); term != 3 {
+		t.Fatalf("term after restart is %d, want 3", term)
+	}
+	if reply := node.HandleRequestVote(&proto.VoteRequest{Term: 3, Candidate: "c", LastLogIndex: 2, LastLogTerm: 3}); reply.Granted {
+		t.Fatalf("voted for c after voting for b in the same term")
+	}
+	if got := texts(node); !reflect.DeepEqual(got, []string{"one", "two"}) {
+		t.Fatalf("log after restart is %q, want one and two", got)
+	}
+
+	// A new leader replaces the entry that was never committed
+	reply = node.HandleAppendEntries(&proto.AppendRequest{Term: 4, Leader: "c", PrevLogIndex: 1, PrevLogTerm: 3, Entries: []*proto.LogEntry{entry(4, 2, "replaced")}})
+	if !reply.Success {
+		t.Fatalf("the entries of c were not appended")
+	}
+	storage.Close()
+
+	// Half a record at the end, as a crash in the middle of a write leaves it, is dropped
+	file, err := os.OpenFile(filepath.Join(dir, "log"), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte{0, 0, 1})
+	file.Close()
+
+	node, storage = open()
+	defer storage.Close()
+	if _, term, _ := node.Status(); term != 4 {
+		t.Fatalf("term after the second restart is %d, want 4", term)
+	}
+	if got := texts(node); !reflect.DeepEqual(got, []string{"one", "replaced"}) {
+		t.Fatalf("log after the second restart is %q, want one and replaced", got)
+	}
+}
+
+// The texts of the messages in the log of the node
+func texts(n *Node) []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var texts []string
+	for _, entry := range n.log[1:] {
+		texts = append(texts, entry.Message.GetText())
+	}
+	return texts
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if condition() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func contains(ids []string, id string) bool {
+	for _, other := range ids {
+		if other == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,240 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/00kristian/MiniProject_2/proto"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+// Where a node keeps what it must never forget: its term, who it voted for and its log. A node that forgets
+// could vote twice in a term or lose an entry it told the leader it has, and then two leaders or a lost commit
+// are possible. Every change is stored before the node acts on it or answers
+type Storage interface {
+	// The term, vote and log entries stored last. Empty if nothing was stored yet
+	Load() (term uint64, votedFor string, entries []*proto.LogEntry, err error)
+	// Stores the term and the vote
+	SaveState(term uint64, votedFor string) error
+	// Stores the entries at the end of the log. Stored entries from the index of the first one on are replaced
+	Append(entries []*proto.LogEntry) error
+}
+
+// Keeps the state in memory only, so it is lost with the process. For tests and simulations
+type MemoryStorage struct {
+	mu       sync.Mutex
+	term     uint64
+	votedFor string
+	entries  []*proto.LogEntry
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{}
+}
+
+func (m *MemoryStorage) Load() (uint64, string, []*proto.LogEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.term, m.votedFor, append([]*proto.LogEntry(nil), m.entries...), nil
+}
+
+func (m *MemoryStorage) SaveState(term uint64, votedFor string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.term, m.votedFor = term, votedFor
+	return nil
+}
+
+func (m *MemoryStorage) Append(entries []*proto.LogEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Entries start at index 1
+	first := entries[0].Index
+	if first < 1 || first > uint64(len(m.entries))+1 {
+		return fmt.Errorf("entry %d does not follow the stored log of %d entries", first, len(m.entries))
+	}
+	m.entries = append(m.entries[:first-1], entries...)
+	return nil
+}
+
+// The term and vote as stored in the state file
+type fileState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for"`
+}
+
+// Keeps the state in a directory: the term and vote in "state", replaced as a whole, and the log in "log",
+// as entries that are each prefixed with their length. Every write is synced to disk before it returns
+type FileStorage struct {
+	dir string
+
+	mu  sync.Mutex
+	log *os.File
+	// Where each stored entry starts in the log file, so the log can be cut off at an entry
+	offsets []int64
+	size    int64
+}
+
+// Opens the storage in the directory, creating it if needed
+func OpenFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, "log"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStorage{dir: dir, log: file}, nil
+}
+
+// Closes the log file
+func (f *FileStorage) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.log.Close()
+}
+
+func (f *FileStorage) Load() (uint64, string, []*proto.LogEntry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	state := fileState{}
+	data, err := ioutil.ReadFile(filepath.Join(f.dir, "state"))
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &state); err != nil {
+			return 0, "", nil, fmt.Errorf("corrupt raft state in %s: %v", f.dir, err)
+		}
+	case !os.IsNotExist(err):
+		return 0, "", nil, err
+	}
+
+	if _, err := f.log.Seek(0, io.SeekStart); err != nil {
+		return 0, "", nil, err
+	}
+	reader := bufio.NewReader(f.log)
+	var entries []*proto.LogEntry
+	f.offsets, f.size = nil, 0
+	for {
+		var length uint32
+		if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+			if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			return 0, "", nil, err
+		}
+		record := make([]byte, length)
+		if _, err := io.ReadFull(reader, record); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) || err == io.EOF {
+				break
+			}
+			return 0, "", nil, err
+		}
+		entry := &proto.LogEntry{}
+		if err := protobuf.Unmarshal(record, entry); err != nil {
+			return 0, "", nil, fmt.Errorf("corrupt raft log entry %d in %s: %v", len(entries)+1, f.dir, err)
+		}
+		entries = append(entries, entry)
+		f.offsets = append(f.offsets, f.size)
+		f.size += int64(4 + length)
+	}
+	// A write that was cut off by a crash was never synced, so nobody was told about it
+	if err := f.log.Truncate(f.size); err != nil {
+		return 0, "", nil, err
+	}
+	return state.Term, state.VotedFor, entries, nil
+}
+
+func (f *FileStorage) SaveState(term uint64, votedFor string) error {
+	data, err := json.Marshal(fileState{Term: term, VotedFor: votedFor})
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := filepath.Join(f.dir, "state")
+	temp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	// Written to a temporary file first, so a crash leaves either the old or the new state
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	return syncDir(f.dir)
+}
+
+func (f *FileStorage) Append(entries []*proto.LogEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	first := entries[0].Index
+	if first < 1 || first > uint64(len(f.offsets))+1 {
+		return fmt.Errorf("entry %d does not follow the stored log of %d entries", first, len(f.offsets))
+	}
+	if first <= uint64(len(f.offsets)) {
+		f.size = f.offsets[first-1]
+		f.offsets = f.offsets[:first-1]
+		if err := f.log.Truncate(f.size); err != nil {
+			return err
+		}
+	}
+
+	var buffer []byte
+	offsets := f.offsets
+	size := f.size
+	for _, entry := range entries {
+		record, err := protobuf.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		offsets = append(offsets, size)
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(record)))
+		buffer = append(append(buffer, length...), record...)
+		size += int64(4 + len(record))
+	}
+	if _, err := f.log.WriteAt(buffer, f.size); err != nil {
+		return err
+	}
+	if err := f.log.Sync(); err != nil {
+		return err
+	}
+	f.offsets, f.size = offsets, size
+	return nil
+}
+
+// Syncs the directory, so a renamed file is there after a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
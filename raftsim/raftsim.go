@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/00kristian/MiniProject_2/proto"
+	"github.com/00kristian/MiniProject_2/raft"
+)
+
+// Runs a Raft cluster inside this process on the in-memory network, and checks that it behaves when the leader
+// is cut off by a partition: the rest elect a new leader and keep committing, the old leader cannot commit
+// anything on its own, and every node ends up with the same messages in the same order once the network heals
+func main() {
+	size := flag.Int("nodes", 5, "Number of nodes in the cluster (3 to 5)")
+	verbose := flag.Bool("v", false, "Log what the nodes are doing")
+	flag.Parse()
+	if !*verbose {
+		log.SetOutput(ioDiscard{})
+	}
+
+	sim := newSimulation(*size)
+	defer sim.stop()
+
+	leader := sim.waitForLeader(nil)
+	step("%s was elected leader", leader.ID())
+	sim.propose(leader, "before the partition")
+
+	// Cut the leader off with as many nodes as possible while keeping it in the minority
+	minority, majority := []string{leader.ID()}, []string(nil)
+	for _, node := range sim.nodes {
+		switch {
+		case node == leader:
+		case len(minority) < (*size-1)/2:
+			minority = append(minority, node.ID())
+		default:
+			majority = append(majority, node.ID())
+		}
+	}
+	sim.network.Partition(minority, majority)
+	step("Partitioned the network into %v and %v", minority, majority)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	_, err := leader.Propose(ctx, &proto.Message{Id: "sim", Text: "lost in the minority"})
+	cancel()
+	check(err != nil, "the old leader could not commit without the majority (%v)", err)
+
+	newLeader := sim.waitForLeader(func(node *raft.Node) bool { return node.ID() != leader.ID() && contains(majority, node.ID()) })
+	step("%s was elected leader of the majority", newLeader.ID())
+	sim.propose(newLeader, "during the partition")
+
+	sim.network.Heal()
+	step("Healed the network")
+	final := sim.waitForLeader(nil)
+	sim.propose(final, "after the partition")
+
+	sim.waitForApplied()
+	want := sim.applied[sim.nodes[0].ID()]
+	for _, node := range sim.nodes {
+		got := sim.applied[node.ID()]
+		check(fmt.Sprint(got) == fmt.Sprint(want), "%s applied %v", node.ID(), got)
+	}
+	fmt.Println("All checks passed")
+}
+
+// The nodes of the cluster and what each of them applied
+type simulation struct {
+	network *raft.Network
+	nodes   []*raft.Node
+
+	mu      sync.Mutex
+	applied map[string][]string
+}
+
+func newSimulation(size int) *simulation {
+	sim := &simulation{network: raft.NewNetwork(), applied: make(map[string][]string)}
+	var ids []string
+	for i := 1; i <= size; i++ {
+		ids = append(ids, "node"+strconv.Itoa(i))
+	}
+	for _, id := range ids {
+		id := id
+		var peers []string
+		for _, other := range ids {
+			if other != id {
+				peers = append(peers, other)
+			}
+		}
+		// The nodes never restart, so their state is kept in memory
+		node, err := raft.New(raft.Config{
+			ID:              id,
+			Peers:           peers,
+			Transport:       sim.network.Transport(id),
+			ElectionTimeout: 150 * time.Millisecond,
+			Apply: func(entry *proto.LogEntry) {
+				sim.mu.Lock()
+				sim.applied[id] = append(sim.applied[id], entry.Message.Text)
+				sim.mu.Unlock()
+			},
+		})
+		if err != nil {
+			log.Fatalf("Could not create %s: %v", id, err)
+		}
+		sim.network.Add(node)
+		sim.nodes = append(sim.nodes, node)
+		node.Start()
+	}
+	return sim
+}
+
+func (sim *simulation) stop() {
+	for _, node := range sim.nodes {
+		node.Stop()
+	}
+}
+
+// Waits until exactly one of the nodes accepted by the filter thinks it is leader
+func (sim *simulation) waitForLeader(accept func(*raft.Node) bool) *raft.Node {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var leaders []*raft.Node
+		for _, node := range sim.nodes {
+			if state, _, _ := node.Status(); state == raft.Leader && (accept == nil || accept(node)) {
+				leaders = append(leaders, node)
+			}
+		}
+		if len(leaders) == 1 {
+			return leaders[0]
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	check(false, "a leader was elected")
+	return nil
+}
+
+// Commits a message through the leader
+func (sim *simulation) propose(leader *raft.Node, text string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	index, err := leader.Propose(ctx, &proto.Message{Id: "sim", Text: text})
+	check(err == nil, "%s committed %q as entry %d (%v)", leader.ID(), text, index, err)
+}
+
+// Waits until every node has applied as many messages as the first one
+func (sim *simulation) waitForApplied() {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		sim.mu.Lock()
+		done := true
+		for _, node := range sim.nodes {
+			if len(sim.applied[node.ID()]) != 3 {
+				done = false
+			}
+		}
+		sim.mu.Unlock()
+		if done {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func step(format string, args ...interface{}) {
+	fmt.Printf("- "+format+"\n", args...)
+}
+
+// Prints the outcome of a check, and stops the simulation if it failed
+func check(ok bool, format string, args ...interface{}) {
+	if ok {
+		fmt.Printf("  ok: "+format+"\n", args...)
+		return
+	}
+	fmt.Printf("  FAILED: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+func contains(ids []string, id string) bool {
+	for _, other := range ids {
+		if other == id {
+			return true
+		}
+	}
+	return false
+}
+
+type ioDiscard struct{}
+
+func (ioDiscard) Write(p []byte) (int, error) { return len(p), nil }
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/00kristian/MiniProject_2/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Prefix of the full method names of the admin service
+const adminServicePrefix = "/proto.ChatAdmin/"
+
+// Implementation of the ChatAdmin service - lets moderators manage the running chat server
+type AdminServer struct {
+	// Has to be implemented, otherwise the grpc cannot register
+	proto.UnimplementedChatAdminServer
+	chat *Server
+}
+
+// Unary interceptor that only lets calls to the admin service through if they carry the admin token
+// as "authorization: Bearer <token>" metadata. The admin service is disabled if no token is configured
+func adminAuthInterceptor(token string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if !strings.HasPrefix(info.FullMethod, adminServicePrefix) {
+			return handler(ctx, req)
+		}
+		if token == "" {
+			return nil, status.Error(codes.PermissionDenied, "the admin service is disabled on this server")
+		}
+
+		if !hasBearerToken(ctx, token) {
+			return nil, status.Error(codes.Unauthenticated, "missing or invalid admin token")
+		}
+		return handler(ctx, req)
+	}
+}
+
+// Checks if the call carries the token as "authorization: Bearer <token>" metadata
+func hasBearerToken(ctx context.Context, token string) bool {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		given := strings.TrimPrefix(value, "Bearer ")
+		// Constant time comparison, so the token cannot be guessed by timing the calls
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// Implementation of the Kick rpc - disconnects the user and tells everybody. The user is allowed to join again
+func (a *AdminServer) Kick(ctx context.Context, req *proto.ModerationRequest) (*proto.Empty, error) {
+	if err := a.disconnect(req.Id, status.Errorf(codes.Aborted, "you were kicked by a moderator: %s", reason(req))); err != nil {
+		return nil, err
+	}
+	log.Printf("[Server: %d] %s was kicked: %s", lamport, req.Id, reason(req))
+	a.chat.announce(ctx, fmt.Sprintf("%s was kicked by a moderator: %s", req.Id, reason(req)))
+	return &proto.Empty{}, nil
+}
+
+// Implementation of the Ban rpc - disconnects the user if connected, and keeps the user from joining or publishing again
+func (a *AdminServer) Ban(ctx context.Context, req *proto.ModerationRequest) (*proto.Empty, error) {
+	if req.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "id must not be empty")
+	}
+	a.chat.lock.Lock()
+	a.chat.banned[req.Id] = reason(req)
+	a.chat.lock.Unlock()
+
+	// The user does not have to be connected to be banned
+	a.disconnect(req.Id, status.Errorf(codes.PermissionDenied, "you were banned by a moderator: %s", reason(req)))
+
+	log.Printf("[Server: %d] %s was banned: %s", lamport, req.Id, reason(req))
+	a.chat.announce(ctx, fmt.Sprintf("%s was banned by a moderator: %s", req.Id, reason(req)))
+	return &proto.Empty{}, nil
+}
+
+// Implementation of the Unban rpc - allows a banned user to join again
+func (a *AdminServer) Unban(ctx context.Context, req *proto.ModerationRequest) (*proto.Empty, error) {
+	a.chat.lock.Lock()
+	_, banned := a.chat.banned[req.Id]
+	delete(a.chat.banned, req.Id)
+	a.chat.lock.Unlock()
+
+	if !banned {
+		return nil, status.Errorf(codes.NotFound, "%s is not banned", req.Id)
+	}
+	log.Printf("[Server: %d] %s was unbanned", lamport, req.Id)
+	return &proto.Empty{}, nil
+}
+
+// Implementation of the Mute rpc - keeps the user from publishing for the given duration
+func (a *AdminServer) Mute(ctx context.Context, req *proto.ModerationRequest) (*proto.Empty, error) {
+	if req.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "id must not be empty")
+	}
+	if req.DurationSeconds <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "duration must be positive")
+	}
+	duration := time.Duration(req.DurationSeconds) * time.Second
+	a.chat.limiter.mute(req.Id, time.Now().Add(duration))
+
+	log.Printf("[Server: %d] %s was muted for %v: %s", lamport, req.Id, duration, reason(req))
+	a.chat.announce(ctx, fmt.Sprintf("%s has been muted for %v by a moderator: %s", req.Id, duration, reason(req)))
+	return &proto.Empty{}, nil
+}
+
+// Implementation of the Announce rpc - broadcasts a system message to everybody
+func (a *AdminServer) Announce(ctx context.Context, msg *proto.Message) (*proto.Empty, error) {
+	if err := invalidArgument("invalid announcement", checkText("text", msg.Text, a.chat.limits.MaxMessageLength)); err != nil {
+		return nil, err
+	}
+	a.chat.announce(ctx, "[Announcement] "+msg.Text)
+	return &proto.Empty{}, nil
+}
+
+// Implementation of the ListSessions rpc - lists every connection the server knows, sorted by id
+func (a *AdminServer) ListSessions(ctx context.Context, _ *proto.Empty) (*proto.SessionList, error) {
+	a.chat.lock.RLock()
+	defer a.chat.lock.RUnlock()
+
+	list := &proto.SessionList{}
+	for _, conn := range a.chat.connections {
+		list.Sessions = append(list.Sessions, &proto.Session{
+			Id:          conn.user.Id,
+			Name:        conn.user.Name,
+			Active:      conn.user.Active,
+			Address:     conn.address,
+			UserAgent:   conn.userAgent,
+			ConnectedAt: conn.connectedAt.Unix(),
+		})
+	}
+	sort.Slice(list.Sessions, func(i, j int) bool {
+		return list.Sessions[i].Id < list.Sessions[j].Id
+	})
+	return list, nil
+}
+
+// Implementation of the Disconnect rpc - silently ends the stream of the user
+func (a *AdminServer) Disconnect(ctx context.Context, req *proto.ModerationRequest) (*proto.Empty, error) {
+	if err := a.disconnect(req.Id, status.Error(codes.Aborted, "you were disconnected by a moderator")); err != nil {
+		return nil, err
+	}
+	log.Printf("[Server: %d] %s was disconnected", lamport, req.Id)
+	return &proto.Empty{}, nil
+}
+
+// Makes the user inactive and ends its Join stream with the given error
+func (a *AdminServer) disconnect(id string, reason error) error {
+	a.chat.lock.Lock()
+	conn, found := a.chat.connections[id]
+	active := found && conn.user.Active
+	if active {
+		conn.user.Active = false
+	}
+	a.chat.lock.Unlock()
+
+	if !active {
+		return status.Errorf(codes.NotFound, "%s is not connected", id)
+	}
+	conn.close(reason)
+	return nil
+}
+
+// The reason of a moderation request, or a default if the moderator did not give one
+func reason(req *proto.ModerationRequest) string {
+	if req.Reason == "" {
+		return "no reason given"
+	}
+	return req.Reason
+}
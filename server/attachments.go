@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io"
+	"log"
+	"path/filepath"
+	"strconv"
+
+	"github.com/00kristian/MiniProject_2/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// The longest file name of an attachment
+const maxAttachmentName = 255
+
+// Implementation of the Upload rpc - receives a file in chunks and stores it. The first chunk says who uploads
+// and the name of the file. The returned attachment can then be sent with a message
+func (s *Server) Upload(stream proto.Chat_UploadServer) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if first.Attachment == nil || first.Attachment.Name == "" {
+		return status.Error(codes.InvalidArgument, "the first chunk must have the name of the attachment")
+	}
+	if err := s.checkUploader(stream, first.Id); err != nil {
+		return err
+	}
+
+	blob, err := s.blobs.create()
+	if err != nil {
+		return status.Errorf(codes.Internal, "could not store the attachment: %v", err)
+	}
+	for chunk := first; ; {
+		if _, err := blob.Write(chunk.Data); err != nil {
+			blob.abort()
+			return err
+		}
+		chunk, err = stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			blob.abort()
+			return err
+		}
+	}
+
+	attachment, err := blob.done(first.Attachment.Name)
+	if err != nil {
+		return status.Errorf(codes.Internal, "could not store the attachment: %v", err)
+	}
+	log.Printf("[Server: %d] %s uploaded %s (%d bytes) as %s", lamport, first.Id, attachment.Name, attachment.Size, attachment.Hash)
+	return stream.SendAndClose(attachment)
+}
+
+// Implementation of the Download rpc - sends the attachment with the given hash in chunks
+func (s *Server) Download(req *proto.Attachment, stream proto.Chat_DownloadServer) error {
+	file, err := s.blobs.open(req.Hash)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	buffer := make([]byte, chunkSize)
+	for {
+		n, err := file.Read(buffer)
+		if n > 0 {
+			if err := stream.Send(&proto.Chunk{Data: buffer[:n]}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return status.Errorf(codes.Internal, "could not read the attachment: %v", err)
+		}
+	}
+}
+
+// Only users that have joined and are not banned can upload, and only as themselves. Upload is a stream,
+// so the interceptors never see it: it checks the token of bots and the session itself, and every upload
+// takes a token from the rate limit of the user, so nobody can fill the store without limit
+func (s *Server) checkUploader(stream proto.Chat_UploadServer, id string) error {
+	ctx := stream.Context()
+	if err := s.authenticate(ctx, id); err != nil {
+		return err
+	}
+	if err := s.checkSession(ctx, id); err != nil {
+		return err
+	}
+	if reason, banned := s.isBanned(id); banned {
+		return status.Errorf(codes.PermissionDenied, "%s is banned: %s", id, reason)
+	}
+	if seconds, err := s.takeToken(ctx, s.limiter, id); err != nil {
+		stream.SetTrailer(metadata.Pairs(retryAfterKey, strconv.FormatInt(seconds, 10)))
+		return err
+	}
+	return nil
+}
+
+// Checks that the attachment of a message has been uploaded. Size and MIME type come from the stored blob,
+// so a message cannot claim anything about the attachment that is not true. The name is the only thing the sender
+// chooses, and it cannot be a path
+func (s *Server) checkAttachment(msg *proto.Message) error {
+	if msg.Attachment == nil {
+		return nil
+	}
+	msg.Attachment.Name = filepath.Base(msg.Attachment.Name)
+	violations := checkText("attachment.name", msg.Attachment.Name, maxAttachmentName)
+	if msg.Attachment.Name == "." || msg.Attachment.Name == ".." || msg.Attachment.Name == string(filepath.Separator) {
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{
+			Field:       "attachment.name",
+			Description: "must be the name of a file",
+		})
+	}
+	size, mimeType, found := s.blobs.stat(msg.Attachment.Hash)
+	if !found {
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{
+			Field:       "attachment.hash",
+			Description: "must be the hash of an uploaded attachment",
+		})
+	}
+	msg.Attachment.Size = size
+	msg.Attachment.MimeType = mimeType
+	return invalidArgument("invalid attachment", violations)
+}
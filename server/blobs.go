@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/00kristian/MiniProject_2/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Size of the chunks attachments are sent in
+const chunkSize = 32 * 1024
+
+// A blob is named by the hex SHA-256 of its content
+var blobName = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// Attachments stored on disk by the hash of their content, so the same file is only stored once
+type BlobStore struct {
+	dir string
+	// Max size of a single attachment in bytes
+	maxSize int64
+}
+
+func openBlobStore(dir string, maxSize int64) (*BlobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &BlobStore{dir: dir, maxSize: maxSize}, nil
+}
+
+// Where the blob with the given hash is stored
+func (b *BlobStore) path(hash string) string {
+	return filepath.Join(b.dir, hash)
+}
+
+// Where the MIME type of the blob with the given hash is stored
+func (b *BlobStore) typePath(hash string) string {
+	return b.path(hash) + ".type"
+}
+
+// Looks up a stored blob. The size and MIME type come from the stored file, not from the caller
+func (b *BlobStore) stat(hash string) (uint64, string, bool) {
+	if !blobName.MatchString(hash) {
+		return 0, "", false
+	}
+	info, err := os.Stat(b.path(hash))
+	if err != nil {
+		return 0, "", false
+	}
+	mimeType, err := os.ReadFile(b.typePath(hash))
+	if err != nil {
+		// Blobs stored before the type was kept with them are sniffed again
+		mimeType = []byte(b.sniff(hash))
+	}
+	return uint64(info.Size()), string(mimeType), true
+}
+
+// Guesses the MIME type of a stored blob from its first bytes
+func (b *BlobStore) sniff(hash string) string {
+	file, err := os.Open(b.path(hash))
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer file.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	return http.DetectContentType(head[:n])
+}
+
+// Opens a stored blob for reading
+func (b *BlobStore) open(hash string) (*os.File, error) {
+	if !blobName.MatchString(hash) {
+		return nil, status.Errorf(codes.InvalidArgument, "%q is not an attachment hash", hash)
+	}
+	file, err := os.Open(b.path(hash))
+	if os.IsNotExist(err) {
+		return nil, status.Errorf(codes.NotFound, "attachment %s does not exist", hash)
+	}
+	return file, err
+}
+
+// Stores everything written to it in a temporary file while hashing it. Done moves it to its place in the store
+type blobWriter struct {
+	store *BlobStore
+	file  *os.File
+	hash  hash.Hash
+	size  int64
+	// The first bytes of the content, used to guess the MIME type
+	head []byte
+}
+
+func (b *BlobStore) create() (*blobWriter, error) {
+	file, err := os.CreateTemp(b.dir, "upload-*")
+	if err != nil {
+		return nil, err
+	}
+	return &blobWriter{store: b, file: file, hash: sha256.New()}, nil
+}
+
+func (w *blobWriter) Write(data []byte) (int, error) {
+	if w.size+int64(len(data)) > w.store.maxSize {
+		return 0, status.Errorf(codes.ResourceExhausted, "attachments can be at most %d bytes", w.store.maxSize)
+	}
+	if len(w.head) < 512 {
+		w.head = append(w.head, data[:min(len(data), 512-len(w.head))]...)
+	}
+	w.size += int64(len(data))
+	w.hash.Write(data)
+	return w.file.Write(data)
+}
+
+// Throws away what was written
+func (w *blobWriter) abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// Stores what was written and describes it as an attachment with the given name. The MIME type is guessed from
+// the content, never from the name, and stored with the blob, so messages cannot claim another type
+func (w *blobWriter) done(name string) (*proto.Attachment, error) {
+	if err := w.file.Close(); err != nil {
+		os.Remove(w.file.Name())
+		return nil, err
+	}
+	attachment := &proto.Attachment{
+		Name:     filepath.Base(name),
+		Size:     uint64(w.size),
+		Hash:     hex.EncodeToString(w.hash.Sum(nil)),
+		MimeType: http.DetectContentType(w.head),
+	}
+	// The type is stored first, so every stored blob has one
+	if err := os.WriteFile(w.store.typePath(attachment.Hash), []byte(attachment.MimeType), 0644); err != nil {
+		os.Remove(w.file.Name())
+		return nil, err
+	}
+	// The same content has the same name, so an existing blob is simply replaced by an identical one
+	if err := os.Rename(w.file.Name(), w.store.path(attachment.Hash)); err != nil {
+		os.Remove(w.file.Name())
+		return nil, err
+	}
+	return attachment, nil
+}
+
+func min(x, y int) int {
+	if x <= y {
+		return x
+	}
+	return y
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/00kristian/MiniProject_2/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Prefix of the full method names of the chat service
+const chatServicePrefix = "/proto.Chat/"
+
+// Parses the bot users from "id=token,...". Bots are users like any other, but they have to prove who they are
+// with their token, and get rate limits of their own
+func parseBots(list string) (map[string]string, error) {
+	bots := make(map[string]string)
+	for _, bot := range strings.Split(list, ",") {
+		if bot = strings.TrimSpace(bot); bot == "" {
+			continue
+		}
+		parts := strings.SplitN(bot, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("bot %q must be id=token", bot)
+		}
+		bots[parts[0]] = parts[1]
+	}
+	return bots, nil
+}
+
+// Checks if the user is a bot
+func (s *Server) isBot(id string) bool {
+	_, found := s.bots[id]
+	return found
+}
+
+// Checks that a call may be made as the user. Integration users only post through their incoming webhook,
+// and bots have to carry their token as "authorization: Bearer <token>" metadata.
+// Anybody else could otherwise join and publish as them
+func (s *Server) authenticate(ctx context.Context, id string) error {
+	if s.incomingWebhooks.isIntegration(id) {
+		return status.Errorf(codes.PermissionDenied, "%s is an integration, it can only post through its incoming webhook", id)
+	}
+	token, found := s.bots[id]
+	if !found {
+		return nil
+	}
+	if !hasBearerToken(ctx, token) {
+		return status.Errorf(codes.Unauthenticated, "%s is a bot, missing or invalid bot token", id)
+	}
+	return nil
+}
+
+// The user a call to the chat service is made as, empty if the call is not made as a user
+func callerOf(req interface{}) string {
+	switch r := req.(type) {
+	case *proto.Message:
+		return r.Id
+	case *proto.Id:
+		return r.Id
+	case *proto.RoomRequest:
+		return r.Actor
+	case *proto.RoleRequest:
+		return r.Actor
+	}
+	return ""
+}
+
+// Unary interceptor that only lets calls to the chat service made as a user through if they carry the session of the user,
+// and the token of the user if it is a bot. Calls made as an integration user are never let through.
+// Join is a stream, so it checks itself
+func (s *Server) userAuthInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if !strings.HasPrefix(info.FullMethod, chatServicePrefix) {
+			return handler(ctx, req)
+		}
+		caller := callerOf(req)
+		if caller == "" {
+			if actingMethods[info.FullMethod] {
+				return nil, status.Errorf(codes.Unauthenticated, "the call must be made as a user")
+			}
+			return handler(ctx, req)
+		}
+		if err := s.authenticate(ctx, caller); err != nil {
+			return nil, err
+		}
+		if err := s.checkSession(ctx, caller); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/00kristian/MiniProject_2/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Prefix of the full method names of the cluster service
+const clusterServicePrefix = "/proto.Cluster/"
+
+// Number of messages waiting to be forwarded to a peer before new messages are dropped
+const forwardQueue = 1000
+
+// How long a peer has to accept a forwarded message
+const forwardTimeout = 5 * time.Second
+
+// The other server nodes of the cluster. Every node forwards the messages published on it to every peer,
+// and the peers send them to their own users. Nodes do not forward what they got from a peer, so a message
+// never goes around in circles as long as every node has every other node as peer
+type Cluster struct {
+	// Name of this node, so peers can tell where a message comes from
+	node  string
+	token string
+	peers []*clusterPeer
+}
+
+// A peer node with the messages waiting to be sent to it. Messages are sent one at a time, so they arrive in order
+type clusterPeer struct {
+	address string
+	client  proto.ClusterClient
+	queue   chan *proto.Message
+}
+
+// Implementation of the Cluster service - receives messages from the other nodes
+type ClusterServer struct {
+	// Has to be implemented, otherwise the grpc cannot register
+	proto.UnimplementedClusterServer
+	chat *Server
+}
+
+// Connects to the peers. Connections are made lazily by grpc, so peers that are not up yet are fine
+func newCluster(node string, token string, addresses []string) (*Cluster, error) {
+	c := &Cluster{node: node, token: token}
+	for _, address := range addresses {
+		conn, err := grpc.Dial(address, grpc.WithInsecure())
+		if err != nil {
+			return nil, err
+		}
+		peer := &clusterPeer{address: address, client: proto.NewClusterClient(conn), queue: make(chan *proto.Message, forwardQueue)}
+		c.peers = append(c.peers, peer)
+		go c.send(peer)
+	}
+	return c, nil
+}
+
+// Queues a message, edit, delete or reaction published on this node for every peer
+func (c *Cluster) forward(msg *proto.Message) {
+	for _, peer := range c.peers {
+		select {
+		case peer.queue <- msg:
+		default:
+			log.Printf("[Cluster] Too many messages waiting for %s, dropping a message from %s", peer.address, msg.Id)
+		}
+	}
+}
+
+// Sends the queued messages to the peer. A peer that is down misses the messages sent while it is down
+func (c *Cluster) send(peer *clusterPeer) {
+	for msg := range peer.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), forwardTimeout)
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+c.token)
+		_, err := peer.client.Forward(ctx, &proto.Forwarded{Node: c.node, Message: msg})
+		cancel()
+		if err != nil {
+			log.Printf("[Cluster] Could not forward a message to %s: %v", peer.address, err)
+		}
+	}
+}
+
+// Unary interceptor that only lets calls to the cluster and raft services through if they carry the cluster token.
+// The services are disabled if no token is configured
+func clusterAuthInterceptor(token string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if !strings.HasPrefix(info.FullMethod, clusterServicePrefix) && !strings.HasPrefix(info.FullMethod, raftServicePrefix) {
+			return handler(ctx, req)
+		}
+		if token == "" {
+			return nil, status.Error(codes.PermissionDenied, "clustering is disabled on this server")
+		}
+		if !hasBearerToken(ctx, token) {
+			return nil, status.Error(codes.Unauthenticated, "missing or invalid cluster token")
+		}
+		return handler(ctx, req)
+	}
+}
+
+// Implementation of the Forward rpc - a peer sends a message that was published on it to our users.
+// The lamport time of the message is merged into ours, so timestamps stay consistent across the cluster
+func (c *ClusterServer) Forward(ctx context.Context, req *proto.Forwarded) (*proto.Empty, error) {
+	s := c.chat
+	if req.Message == nil {
+		return nil, status.Error(codes.InvalidArgument, "message must be set")
+	}
+	if req.Node == s.cluster.node {
+		return nil, status.Errorf(codes.FailedPrecondition, "%s is forwarding to itself", req.Node)
+	}
+	msg := req.Message
+
+	mu.Lock()
+	lamport = max(lamport, msg.Lamport) + 1
+	msg.Lamport = lamport
+	mu.Unlock()
+
+	// Sequence numbers refer to the history of the node the message was published on, so the message
+	// an event changes and the message a reply is to are found by their uid here
+	msg.Seq, msg.Ref, msg.Parent = 0, 0, 0
+	if msg.RefUid != "" {
+		target, found := s.history.byUid(msg.RefUid)
+		if !found {
+			return nil, status.Errorf(codes.NotFound, "message %s does not exist on %s", msg.RefUid, s.cluster.node)
+		}
+		msg.Ref = target.Seq
+	}
+	// A reply to a message that is no longer kept here is shown as a message of its own
+	if parent, found := s.history.byUid(msg.ParentUid); msg.ParentUid != "" && found {
+		msg.Parent = parent.Seq
+	}
+	log.Printf("[Server: %d] Got a message from %s through %s: %s", msg.Lamport, msg.Id, req.Node, msg.Text)
+
+	s.deliver(ctx, msg)
+	return &proto.Empty{}, nil
+}
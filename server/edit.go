@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/00kristian/MiniProject_2/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Implementation of the Edit rpc - lets the author change the text of a message.
+// The request is a message from the author with the new text, referring to the message by its sequence number
+func (s *Server) Edit(ctx context.Context, req *proto.Message) (*proto.Empty, error) {
+	if err := s.validateMessage(req); err != nil {
+		return nil, err
+	}
+	target, err := s.editable(req)
+	if err != nil {
+		return nil, err
+	}
+	if target.Id != req.Id {
+		return nil, status.Errorf(codes.PermissionDenied, "%s can only edit own messages", req.Id)
+	}
+	// An edit says something new, so only users that may still publish in the room can edit
+	if err := s.authorize(req.Id, target.Room, PermissionPublish); err != nil {
+		return nil, err
+	}
+
+	if err := s.publishEvent(ctx, req, target, proto.EventType_EVENT_EDIT); err != nil {
+		return nil, err
+	}
+	return &proto.Empty{}, nil
+}
+
+// Implementation of the Delete rpc - lets the author or a moderator delete a message
+func (s *Server) Delete(ctx context.Context, req *proto.Message) (*proto.Empty, error) {
+	target, err := s.editable(req)
+	if err != nil {
+		return nil, err
+	}
+	if target.Id != req.Id {
+		if err := s.authorize(req.Id, target.Room, PermissionModerate); err != nil {
+			return nil, err
+		}
+	}
+
+	req.Text = ""
+	if err := s.publishEvent(ctx, req, target, proto.EventType_EVENT_DELETE); err != nil {
+		return nil, err
+	}
+	return &proto.Empty{}, nil
+}
+
+// Implementation of the Revisions rpc - lets moderators see the earlier versions of an edited or deleted message
+func (s *Server) Revisions(ctx context.Context, req *proto.Message) (*proto.MessageList, error) {
+	target, found := s.history.get(req.Ref)
+	if !found {
+		return nil, status.Errorf(codes.NotFound, "message %d does not exist", req.Ref)
+	}
+	if err := s.checkMember(req.Id, target.Room); err != nil {
+		return nil, err
+	}
+	if err := s.authorize(req.Id, target.Room, PermissionModerate); err != nil {
+		return nil, err
+	}
+	return &proto.MessageList{Messages: s.history.revisionsOf(req.Ref)}, nil
+}
+
+// Finds the message an edit or delete refers to, and checks that it can be changed
+func (s *Server) editable(req *proto.Message) (*proto.Message, error) {
+	if req.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "id must not be empty")
+	}
+	if reason, banned := s.isBanned(req.Id); banned {
+		return nil, status.Errorf(codes.PermissionDenied, "%s is banned: %s", req.Id, reason)
+	}
+	target, found := s.history.get(req.Ref)
+	if !found {
+		return nil, status.Errorf(codes.NotFound, "message %d does not exist", req.Ref)
+	}
+	// Join and leave messages belong to nobody
+	if target.Id == "" || target.Deleted {
+		return nil, status.Errorf(codes.FailedPrecondition, "message %d cannot be changed", req.Ref)
+	}
+	// Users that left or were kicked from the room can not change its messages anymore, not even their own
+	if err := s.checkMember(req.Id, target.Room); err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+// Checks that the user is connected and in the room
+func (s *Server) checkMember(id string, room string) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if conn, found := s.connections[id]; !found || !conn.user.Active || !conn.rooms[room] {
+		return status.Errorf(codes.PermissionDenied, "%s is not in %s", id, room)
+	}
+	return nil
+}
+
+// Stamps the edit or delete with its own lamport time, stores it in the history and sends it to the room.
+// The target is named by its uid as well, so the other nodes of the cluster can find it in their own history
+func (s *Server) publishEvent(ctx context.Context, req *proto.Message, target *proto.Message, event proto.EventType) error {
+	s.touch(req.Id)
+	mu.Lock()
+	lamport = max(lamport, req.Lamport) + 1
+	mu.Unlock()
+
+	log.Printf("[Server: %d] %s changed message %d (%s)", lamport, req.Id, target.Seq, event)
+	return s.publish(ctx, &proto.Message{
+		Id:      req.Id,
+		Text:    req.Text,
+		Lamport: lamport,
+		Room:    target.Room,
+		Event:   event,
+		Ref:     target.Seq,
+		RefUid:  target.Uid,
+	})
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/00kristian/MiniProject_2/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+// Prefix of the full method names of the federation service
+const federationServicePrefix = "/proto.Federation/"
+
+// Number of relayed messages remembered, so a message reaching us on two paths is only delivered once
+const relayedRemembered = 10000
+
+// Independent servers that trust each other. Messages published in a shared room are relayed to the trusted peers,
+// with the id of the sender qualified by the server it is on, like alice@serverA. Every relayed message records
+// the servers it went through, and is never relayed to them again, so messages do not go around in circles
+type Federation struct {
+	// Name of this server in the federation, used to qualify the ids of our users
+	name  string
+	token string
+	rooms map[string]bool
+	peers map[string]*federationPeer
+
+	// Uids of the messages relayed to us most recently. Protected by mu
+	mu    sync.Mutex
+	seen  map[string]bool
+	order []string
+}
+
+// A trusted server with the messages waiting to be relayed to it
+type federationPeer struct {
+	name    string
+	address string
+	client  proto.FederationClient
+	queue   chan *proto.Relayed
+}
+
+// Implementation of the Federation service - receives messages from the trusted servers
+type FederationServer struct {
+	// Has to be implemented, otherwise the grpc cannot register
+	proto.UnimplementedFederationServer
+	chat *Server
+}
+
+// Connects to the trusted servers given as "name=address,name=address"
+func newFederation(name string, token string, peers string, rooms string) (*Federation, error) {
+	f := &Federation{
+		name:  name,
+		token: token,
+		rooms: make(map[string]bool),
+		peers: make(map[string]*federationPeer),
+		seen:  make(map[string]bool),
+	}
+	for _, room := range strings.Split(rooms, ",") {
+		if room = strings.TrimSpace(room); room != "" {
+			f.rooms[roomName(room)] = true
+		}
+	}
+	for _, peer := range strings.Split(peers, ",") {
+		if peer = strings.TrimSpace(peer); peer == "" {
+			continue
+		}
+		parts := strings.SplitN(peer, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.New("federated servers must be given as name=address")
+		}
+		if parts[0] == name {
+			return nil, fmt.Errorf("%s can not federate with itself", name)
+		}
+		conn, err := grpc.Dial(parts[1], grpc.WithInsecure())
+		if err != nil {
+			return nil, err
+		}
+		p := &federationPeer{name: parts[0], address: parts[1], client: proto.NewFederationClient(conn), queue: make(chan *proto.Relayed, forwardQueue)}
+		f.peers[p.name] = p
+		go f.send(p)
+	}
+	return f, nil
+}
+
+// Checks if federation is turned on
+func (f *Federation) enabled() bool {
+	return f != nil && len(f.peers) > 0
+}
+
+// Qualifies the id of one of our users with the name of this server. Ids from other servers are qualified already
+func (f *Federation) qualify(id string) string {
+	if id == "" || strings.Contains(id, "@") {
+		return id
+	}
+	return id + "@" + f.name
+}
+
+// Relays a message published on this server to the trusted servers, if it is in a shared room.
+// Edits, deletes, reactions and replies refer to messages by their sequence number on this server, so they stay here
+func (f *Federation) relay(msg *proto.Message) {
+	if !f.enabled() || msg.Id == "" || msg.Event != proto.EventType_EVENT_MESSAGE || !f.rooms[msg.Room] {
+		return
+	}
+	relayed := protobuf.Clone(msg).(*proto.Message)
+	relayed.Id = f.qualify(msg.Id)
+	relayed.Parent, relayed.ParentUid = 0, ""
+	// Attachments are stored on this server only
+	relayed.Attachment = nil
+	f.pass(&proto.Relayed{Origin: f.name, Via: []string{f.name}, Message: relayed})
+}
+
+// Queues a relayed message for every trusted server it has not been through yet
+func (f *Federation) pass(req *proto.Relayed) {
+	visited := make(map[string]bool)
+	for _, name := range req.Via {
+		visited[name] = true
+	}
+	for name, peer := range f.peers {
+		if visited[name] {
+			continue
+		}
+		select {
+		case peer.queue <- req:
+		default:
+			log.Printf("[Federation] Too many messages waiting for %s, dropping a message from %s", name, req.Message.Id)
+		}
+	}
+}
+
+// Sends the queued messages to the trusted server. A server that is down misses the messages sent while it is down
+func (f *Federation) send(peer *federationPeer) {
+	for req := range peer.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), forwardTimeout)
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+f.token)
+		_, err := peer.client.Relay(ctx, req)
+		cancel()
+		if err != nil {
+			log.Printf("[Federation] Could not relay a message to %s: %v", peer.name, err)
+		}
+	}
+}
+
+// Remembers that a message was relayed to us. Returns false if we got it before. Messages are known by their uid,
+// which names the node and the run of it that published the message, so restarted servers and the nodes of a cluster never reuse one
+func (f *Federation) remember(uid string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.seen[uid] {
+		return false
+	}
+	f.seen[uid] = true
+	f.order = append(f.order, uid)
+	if len(f.order) > relayedRemembered {
+		delete(f.seen, f.order[0])
+		f.order = f.order[1:]
+	}
+	return true
+}
+
+// Unary interceptor that only lets calls to the federation service through if they carry the federation token.
+// The service is disabled if no token is configured
+func federationAuthInterceptor(token string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if !strings.HasPrefix(info.FullMethod, federationServicePrefix) {
+			return handler(ctx, req)
+		}
+		if token == "" {
+			return nil, status.Error(codes.PermissionDenied, "federation is disabled on this server")
+		}
+		if !hasBearerToken(ctx, token) {
+			return nil, status.Error(codes.Unauthenticated, "missing or invalid federation token")
+		}
+		return handler(ctx, req)
+	}
+}
+
+// Implementation of the Relay rpc - a trusted server sends a message published in a shared room.
+// The message is sent to our users in the room, and relayed on to the trusted servers it has not been through.
+// The lamport time of the message is merged into ours, so timestamps stay consistent across the servers
+func (fs *FederationServer) Relay(ctx context.Context, req *proto.Relayed) (*proto.Empty, error) {
+	s := fs.chat
+	f := s.federation
+	msg := req.Message
+	if msg == nil || msg.Uid == "" || len(req.Via) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "message, its uid and via must be set")
+	}
+	from := req.Via[len(req.Via)-1]
+	if _, trusted := f.peers[from]; !trusted {
+		return nil, status.Errorf(codes.PermissionDenied, "%s is not a trusted server", from)
+	}
+	// Servers can only speak for their own users
+	if req.Origin == f.name || !strings.HasSuffix(msg.Id, "@"+req.Origin) {
+		return nil, status.Errorf(codes.InvalidArgument, "%s can not send messages from %s", req.Origin, msg.Id)
+	}
+	msg.Room = roomName(msg.Room)
+	if !f.rooms[msg.Room] {
+		return nil, status.Errorf(codes.FailedPrecondition, "%s is not shared with %s", msg.Room, f.name)
+	}
+	if reason, banned := s.isBanned(msg.Id); banned {
+		return nil, status.Errorf(codes.PermissionDenied, "%s is banned: %s", msg.Id, reason)
+	}
+
+	if !f.remember(msg.Uid) {
+		return &proto.Empty{}, nil
+	}
+
+	// Pass it on before it is changed for our users
+	f.pass(&proto.Relayed{Origin: req.Origin, Via: append(append([]string{}, req.Via...), f.name), Message: protobuf.Clone(msg).(*proto.Message)})
+
+	mu.Lock()
+	lamport = max(lamport, msg.Lamport) + 1
+	msg.Lamport = lamport
+	mu.Unlock()
+
+	// Sequence numbers refer to the history of the server the message was published on
+	msg.Seq = 0
+	msg.Parent, msg.ParentUid, msg.RefUid = 0, "", ""
+	msg.Event = proto.EventType_EVENT_MESSAGE
+	log.Printf("[Server: %d] Got a message from %s through %s: %s", msg.Lamport, msg.Id, from, msg.Text)
+
+	s.cluster.forward(s.deliver(ctx, msg))
+	return &proto.Empty{}, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// How often a raft node checks if it still knows a leader
+const healthInterval = 200 * time.Millisecond
+
+// Registers the standard grpc health service, which clients with a list of servers use to skip the servers that are down.
+// The server reports serving both overall ("") and for the chat service
+func (s *Server) serveHealth(grpcServer *grpc.Server) {
+	checker := health.NewServer()
+	healthpb.RegisterHealthServer(grpcServer, checker)
+	if s.raft != nil {
+		go s.watchLeader(checker)
+		return
+	}
+	checker.SetServingStatus("proto.Chat", healthpb.HealthCheckResponse_SERVING)
+}
+
+// A raft node that does not know a leader can not take messages, so it reports not serving until a leader is elected
+func (s *Server) watchLeader(checker *health.Server) {
+	ticker := time.NewTicker(healthInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		status := healthpb.HealthCheckResponse_SERVING
+		if _, _, leader := s.raft.Status(); leader == "" {
+			status = healthpb.HealthCheckResponse_NOT_SERVING
+		}
+		checker.SetServingStatus("", status)
+		checker.SetServingStatus("proto.Chat", status)
+	}
+}
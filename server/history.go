@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/00kristian/MiniProject_2/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+// Number of messages returned by History if the caller does not ask for a specific number
+const defaultHistoryPage = 50
+
+// Log of published messages. Every message gets a sequence number, which is its position in the log and its id.
+// Edits and deletes are events in the log too, and are applied to the message they refer to.
+// If a file is given, every message and event is appended to it as a line of JSON, so history survives restarts
+type History struct {
+	mu       sync.Mutex
+	messages []*proto.Message
+	// Earlier versions of edited and deleted messages, by sequence number of the message
+	revisions map[uint64][]*proto.Message
+	// Max number of messages kept in memory
+	limit   int
+	nextSeq uint64
+	file    *os.File
+	// The words of the messages, for searching
+	index *index
+}
+
+// Opens the history, loading the messages already in the file. An empty path keeps the history in memory only
+func openHistory(path string, limit int) (*History, error) {
+	h := &History{limit: limit, nextSeq: 1, revisions: make(map[uint64][]*proto.Message), index: newIndex()}
+	if path == "" {
+		return h, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		msg := &proto.Message{}
+		if err := protojson.Unmarshal(scanner.Bytes(), msg); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("corrupt history file %s: %v", path, err)
+		}
+		h.keep(msg)
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	h.file = file
+	return h, nil
+}
+
+// Adds the message to the log, and returns the stored copy with its sequence number
+func (h *History) append(msg *proto.Message) *proto.Message {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stored := protobuf.Clone(msg).(*proto.Message)
+	stored.Seq = h.nextSeq
+	// Unix time in milliseconds, so history can be searched by time
+	stored.Time = time.Now().UnixMilli()
+	h.keep(stored)
+
+	if h.file != nil {
+		line, err := protojson.Marshal(stored)
+		if err == nil {
+			_, err = h.file.Write(append(line, '\n'))
+		}
+		// Losing a line of history is bad, but not bad enough to stop the chat
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing history: %v\n", err)
+		}
+	}
+	// The stored message can be changed by edits, so the caller gets its own copy
+	return protobuf.Clone(stored).(*proto.Message)
+}
+
+// Keeps the message in memory, dropping the oldest message if there are too many.
+// Edits and deletes are applied to the message they refer to instead. The caller must hold h.mu
+func (h *History) keep(msg *proto.Message) {
+	if msg.Seq >= h.nextSeq {
+		h.nextSeq = msg.Seq + 1
+	}
+
+	if msg.Event != proto.EventType_EVENT_MESSAGE {
+		target := h.find(msg.Ref)
+		if target == nil {
+			return
+		}
+		// Reactions are counted on the message, and the event carries the new counts
+		if msg.Event == proto.EventType_EVENT_REACT || msg.Event == proto.EventType_EVENT_UNREACT {
+			target.Reactions = react(target.Reactions, msg.Id, msg.Text, msg.Event == proto.EventType_EVENT_REACT)
+			msg.Reactions = nil
+			for _, reaction := range target.Reactions {
+				msg.Reactions = append(msg.Reactions, protobuf.Clone(reaction).(*proto.Reaction))
+			}
+			return
+		}
+		// Moderators can still see what the message said before
+		h.revisions[target.Seq] = append(h.revisions[target.Seq], protobuf.Clone(target).(*proto.Message))
+		h.index.remove(target)
+		defer h.index.add(target)
+		switch msg.Event {
+		case proto.EventType_EVENT_EDIT:
+			target.Text = msg.Text
+			target.Edited = true
+		case proto.EventType_EVENT_DELETE:
+			target.Text = ""
+			target.Deleted = true
+		}
+		return
+	}
+
+	h.messages = append(h.messages, msg)
+	h.index.add(msg)
+	if h.limit > 0 && len(h.messages) > h.limit {
+		for _, dropped := range h.messages[:len(h.messages)-h.limit] {
+			delete(h.revisions, dropped.Seq)
+			h.index.remove(dropped)
+		}
+		h.messages = h.messages[len(h.messages)-h.limit:]
+	}
+}
+
+// Finds the message with the given sequence number. The caller must hold h.mu
+func (h *History) find(seq uint64) *proto.Message {
+	i := sort.Search(len(h.messages), func(i int) bool { return h.messages[i].Seq >= seq })
+	if i < len(h.messages) && h.messages[i].Seq == seq {
+		return h.messages[i]
+	}
+	return nil
+}
+
+// Returns a copy of the message with the given uid. The newest messages are the ones asked for most, so it looks from the end
+func (h *History) byUid(uid string) (*proto.Message, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := len(h.messages) - 1; i >= 0; i-- {
+		if h.messages[i].Uid == uid {
+			return protobuf.Clone(h.messages[i]).(*proto.Message), true
+		}
+	}
+	return nil, false
+}
+
+// Returns a copy of the message with the given sequence number
+func (h *History) get(seq uint64) (*proto.Message, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	msg := h.find(seq)
+	if msg == nil {
+		return nil, false
+	}
+	return protobuf.Clone(msg).(*proto.Message), true
+}
+
+// Returns copies of the earlier versions of the message with the given sequence number, oldest first
+func (h *History) revisionsOf(seq uint64) []*proto.Message {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var revisions []*proto.Message
+	for _, revision := range h.revisions[seq] {
+		revisions = append(revisions, protobuf.Clone(revision).(*proto.Message))
+	}
+	return revisions
+}
+
+// Returns copies of the thread the message with the given sequence number is in: the first message of the thread
+// and every reply below it, oldest first
+func (h *History) thread(seq uint64) []*proto.Message {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// Walk up to the first message of the thread. Parents that are no longer kept end the walk
+	root := h.find(seq)
+	if root == nil {
+		return nil
+	}
+	for parent := h.find(root.Parent); root.Parent != 0 && parent != nil; parent = h.find(root.Parent) {
+		root = parent
+	}
+
+	// A reply always comes after its parent, so one pass in sequence order finds the whole thread
+	inThread := map[uint64]bool{root.Seq: true}
+	thread := []*proto.Message{protobuf.Clone(root).(*proto.Message)}
+	for _, msg := range h.messages {
+		if msg.Parent != 0 && inThread[msg.Parent] {
+			inThread[msg.Seq] = true
+			thread = append(thread, protobuf.Clone(msg).(*proto.Message))
+		}
+	}
+	return thread
+}
+
+// Returns up to limit messages from the room with a sequence number lower than before, oldest first.
+// before = 0 means the newest messages
+func (h *History) page(room string, before uint64, limit int) []*proto.Message {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// Messages are kept in sequence order, so find where to start and walk backwards
+	end := len(h.messages)
+	if before > 0 {
+		end = sort.Search(len(h.messages), func(i int) bool { return h.messages[i].Seq >= before })
+	}
+	var page []*proto.Message
+	for i := end - 1; i >= 0 && len(page) < limit; i-- {
+		// Copies, since edits change the stored messages
+		if h.messages[i].Room == room {
+			page = append(page, protobuf.Clone(h.messages[i]).(*proto.Message))
+		}
+	}
+	for i, j := 0, len(page)-1; i < j; i, j = i+1, j-1 {
+		page[i], page[j] = page[j], page[i]
+	}
+	return page
+}
+
+// Implementation of the History rpc - lets users read what was said in a room before they joined
+func (s *Server) History(ctx context.Context, req *proto.HistoryRequest) (*proto.MessageList, error) {
+	limit := int(req.Limit)
+	if limit <= 0 {
+		limit = defaultHistoryPage
+	}
+	if limit > 1000 {
+		return nil, status.Error(codes.InvalidArgument, "limit must be at most 1000")
+	}
+	return &proto.MessageList{Messages: s.history.page(roomName(req.Room), req.Before, limit)}, nil
+}
+
+// Implementation of the ListUsers rpc - lists the active users in a room, or on the whole server if no room is given
+func (s *Server) ListUsers(ctx context.Context, req *proto.RoomRequest) (*proto.UserList, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	list := &proto.UserList{}
+	for _, conn := range s.connections {
+		if conn.user.Active && (req.Room == "" || conn.rooms[req.Room]) {
+			list.Users = append(list.Users, protobuf.Clone(conn.user).(*proto.User))
+		}
+	}
+	sort.Slice(list.Users, func(i, j int) bool {
+		return list.Users[i].Id < list.Users[j].Id
+	})
+	return list, nil
+}
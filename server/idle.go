@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+)
+
+// How the server keeps connections alive, and how it finds the ones that died without closing
+type KeepaliveConfig struct {
+	// How long a connection can be quiet before the server pings the client, and how long the client has to answer
+	Time    time.Duration
+	Timeout time.Duration
+	// Clients pinging more often than this are disconnected
+	MinTime time.Duration
+}
+
+// When users that do nothing are marked away, and when they are disconnected. Zero turns it off
+type IdleConfig struct {
+	AwayAfter   time.Duration
+	IdleTimeout time.Duration
+}
+
+// The grpc server options enforcing the keepalive config. A client that does not answer the pings is disconnected,
+// which ends its Join stream, so the Connection is cleaned up even if the TCP connection died without a word
+func keepaliveOptions(config KeepaliveConfig) []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.KeepaliveParams(keepalive.ServerParameters{Time: config.Time, Timeout: config.Timeout}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{MinTime: config.MinTime, PermitWithoutStream: true}),
+	}
+}
+
+// Tells the server that the user did something, so the user is not idle. A user that was away is back
+func (s *Server) touch(id string) {
+	s.lock.Lock()
+	conn, found := s.connections[id]
+	back := found && conn.user.Away
+	var rooms []string
+	if found {
+		conn.lastActive = time.Now()
+		conn.user.Away = false
+		rooms = roomsOf(conn)
+	}
+	s.lock.Unlock()
+	if back {
+		log.Printf("[Server: %d] %s is back", lamport, id)
+		s.announceRooms(rooms, fmt.Sprintf("%s is back", id))
+	}
+}
+
+// Marks the users that have done nothing for a while as away, and disconnects those that have been idle for too long
+func (s *Server) watchIdle(config IdleConfig) {
+	shortest := config.IdleTimeout
+	if config.AwayAfter > 0 && (shortest == 0 || config.AwayAfter < shortest) {
+		shortest = config.AwayAfter
+	}
+	if shortest == 0 {
+		return
+	}
+	// Users are at most a tenth late marked away or disconnected, but the users are not checked more than once a second
+	interval := shortest / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	for range time.Tick(interval) {
+		now := time.Now()
+		away := make(map[string][]string)
+		idle := make(map[*Connection][]string)
+		s.lock.Lock()
+		for id, conn := range s.connections {
+			quiet := now.Sub(conn.lastActive)
+			switch {
+			// Bots wait for commands, doing nothing in between is what they do
+			case !conn.user.Active || conn.user.Bot:
+			case config.IdleTimeout > 0 && quiet >= config.IdleTimeout:
+				conn.user.Active = false
+				delete(s.connections, id)
+				s.members.Remove(id)
+				idle[conn] = roomsOf(conn)
+			case config.AwayAfter > 0 && quiet >= config.AwayAfter && !conn.user.Away:
+				conn.user.Away = true
+				away[id] = roomsOf(conn)
+			}
+		}
+		s.lock.Unlock()
+
+		for id, rooms := range away {
+			log.Printf("[Server: %d] %s is away", lamport, id)
+			s.announceRooms(rooms, fmt.Sprintf("%s is away", id))
+		}
+		for conn, rooms := range idle {
+			log.Printf("[Server: %d] %s was disconnected for being idle", lamport, conn.user.Id)
+			conn.close(status.Errorf(codes.Aborted, "you were disconnected after being idle for %v", config.IdleTimeout))
+			s.announceRooms(rooms, fmt.Sprintf("%s was disconnected after being idle for %v", conn.user.Id, config.IdleTimeout))
+		}
+	}
+}
+
+// The rooms the user of the connection is in. The caller must hold s.lock
+func roomsOf(conn *Connection) []string {
+	rooms := make([]string, 0, len(conn.rooms))
+	for room := range conn.rooms {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+// Tells every one of the rooms
+func (s *Server) announceRooms(rooms []string, text string) {
+	for _, room := range rooms {
+		s.roomEvent(context.Background(), room, 0, text)
+	}
+}
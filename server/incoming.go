@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/00kristian/MiniProject_2/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// Path the incoming webhooks are posted to, followed by the room
+const incomingPath = "/hooks/"
+
+// Largest body an incoming webhook accepts
+const maxIncomingBody = 64 * 1024
+
+// HTTP status for each gRPC error code Publish returns
+var httpStatus = map[codes.Code]int{
+	codes.InvalidArgument:    http.StatusBadRequest,
+	codes.Unauthenticated:    http.StatusUnauthorized,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.NotFound:           http.StatusNotFound,
+	codes.FailedPrecondition: http.StatusConflict,
+	codes.ResourceExhausted:  http.StatusTooManyRequests,
+	codes.Unavailable:        http.StatusServiceUnavailable,
+}
+
+// An incoming webhook: whoever has the token can post to the room as the integration user, without joining.
+// Configured in the incoming webhooks file: [{"room": "builds", "user": "ci", "token": "..."}]
+type incomingWebhook struct {
+	Room  string `json:"room"`
+	User  string `json:"user"`
+	Token string `json:"token"`
+}
+
+// What is posted to an incoming webhook
+type incomingMessage struct {
+	Text string `json:"text"`
+	// Message the posted message replies to
+	Parent uint64 `json:"parent"`
+}
+
+// The incoming webhooks. Integration users can only post through them, never over gRPC. A nil IncomingWebhooks has none
+type IncomingWebhooks struct {
+	hooks []*incomingWebhook
+	users map[string]bool
+}
+
+// Reads the incoming webhooks. Returns nil if there are none
+func openIncomingWebhooks(path string) (*IncomingWebhooks, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	in := &IncomingWebhooks{users: make(map[string]bool)}
+	if err := json.Unmarshal(data, &in.hooks); err != nil {
+		return nil, fmt.Errorf("invalid incoming webhooks file %s: %v", path, err)
+	}
+	for _, hook := range in.hooks {
+		if hook.User == "" || hook.Token == "" {
+			return nil, fmt.Errorf("incoming webhook for %s needs a user and a token", roomName(hook.Room))
+		}
+		hook.Room = roomName(hook.Room)
+		in.users[hook.User] = true
+	}
+	return in, nil
+}
+
+// Checks if the user is an integration user
+func (in *IncomingWebhooks) isIntegration(id string) bool {
+	return in != nil && in.users[id]
+}
+
+// Checks if the integration user has a webhook posting to the room
+func (in *IncomingWebhooks) allows(id string, room string) bool {
+	if in == nil {
+		return false
+	}
+	for _, hook := range in.hooks {
+		if hook.User == id && hook.Room == room {
+			return true
+		}
+	}
+	return false
+}
+
+// The webhook of the room the request carries the token of, as "Authorization: Bearer <token>". Nil if there is none
+func (in *IncomingWebhooks) find(room string, r *http.Request) *incomingWebhook {
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	for _, hook := range in.hooks {
+		// Constant time comparison, so the token cannot be guessed by timing the requests
+		if hook.Room == room && subtle.ConstantTimeCompare([]byte(given), []byte(hook.Token)) == 1 {
+			return hook
+		}
+	}
+	return nil
+}
+
+// Serves the incoming webhooks over HTTP. Never returns
+func (s *Server) serveIncoming(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(incomingPath, s.incoming)
+	server := &http.Server{Addr: address, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	log.Printf("[Server: %d] Accepting incoming webhooks on %s", lamport, address)
+	log.Fatalf("Error serving incoming webhooks: %v", server.ListenAndServe())
+}
+
+// POST /hooks/<room> with {"text": "..."} as body - publishes the text to the room as the integration user of the token.
+// The message goes through Publish like any other, so it is validated, rate limited and stamped with a lamport time
+func (s *Server) incoming(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	room := roomName(strings.TrimPrefix(r.URL.Path, incomingPath))
+	hook := s.incomingWebhooks.find(room, r)
+	if hook == nil {
+		writeError(w, status.Errorf(codes.Unauthenticated, "missing or invalid token for the incoming webhook of %s", room))
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxIncomingBody))
+	if err != nil {
+		writeError(w, status.Errorf(codes.InvalidArgument, "the body could not be read: %v", err))
+		return
+	}
+	posted := &incomingMessage{}
+	if err := json.Unmarshal(body, posted); err != nil {
+		writeError(w, status.Errorf(codes.InvalidArgument, "the body must be JSON like {\"text\": \"...\"}: %v", err))
+		return
+	}
+
+	// gRPC calls are rate limited by the interceptor, which this call does not pass through
+	if seconds, err := s.takeToken(r.Context(), s.limiter, hook.User); err != nil {
+		w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+		writeError(w, err)
+		return
+	}
+	msg := &proto.Message{Id: hook.User, Text: posted.Text, Room: room, Parent: posted.Parent}
+	if _, err := s.Publish(r.Context(), msg); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"room": msg.Room, "lamport": msg.Lamport})
+}
+
+// Writes the status of a failed call as JSON, with the matching HTTP status
+func writeError(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	code, found := httpStatus[st.Code()]
+	if !found {
+		code = http.StatusInternalServerError
+	}
+	data, _ := protojson.Marshal(st.Proto())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
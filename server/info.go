@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+
+	"github.com/00kristian/MiniProject_2/proto"
+)
+
+// Version of this server build
+const serverVersion = "0.3.0"
+
+// Version of the protocol spoken by the server. Bumped whenever a change would break older clients
+const protocolVersion = 2
+
+// Optional features every server supports. Clients only use a feature if the server lists it
+var features = []string{
+	"rate-limit",
+	"validation",
+	"server-info",
+	"rooms",
+	"roles",
+	"history",
+	"users",
+	"edit",
+	"threads",
+	"reactions",
+	"mentions",
+	"search",
+	"attachments",
+	"health",
+	"presence",
+	"away",
+	// Calls made as a user must carry the session from the header of the Join stream
+	"sessions",
+}
+
+// The features of this server: those of every server and those it is configured to have
+func (s *Server) features() []string {
+	supported := append([]string{}, features...)
+	configured := []struct {
+		name string
+		on   bool
+	}{
+		{"admin", s.admin},
+		{"federation", s.federation.enabled()},
+		{"bots", len(s.bots) > 0},
+		{"webhooks", s.webhooks != nil},
+		{"incoming-webhooks", s.incomingWebhooks != nil},
+		// With raft every node has the same history
+		{"replication", s.raft != nil},
+	}
+	for _, feature := range configured {
+		if feature.on {
+			supported = append(supported, feature.name)
+		}
+	}
+	return supported
+}
+
+// Implementation of the GetServerInfo rpc - tells the client who we are and what the server accepts
+func (s *Server) GetServerInfo(ctx context.Context, _ *proto.Empty) (*proto.ServerInfo, error) {
+	mu.Lock()
+	current := lamport
+	mu.Unlock()
+
+	return &proto.ServerInfo{
+		MaxMessageLength: uint32(s.limits.MaxMessageLength),
+		MaxNameLength:    uint32(s.limits.MaxNameLength),
+		ServerVersion:    serverVersion,
+		ProtocolVersion:  protocolVersion,
+		Features:         s.features(),
+		Lamport:          current,
+		// Attachments are checked by the server too, but this saves uploading a file that is too big
+		MaxAttachmentSize: uint64(s.blobs.maxSize),
+	}, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/00kristian/MiniProject_2/proto"
+)
+
+// Finds the names mentioned with @name in the text, in the order they are mentioned
+func parseMentions(text string) []string {
+	var names []string
+	for _, word := range strings.Fields(text) {
+		at := strings.IndexRune(word, '@')
+		// An @ inside a word is an e-mail address, not a mention
+		if at < 0 {
+			continue
+		}
+		if before, _ := utf8.DecodeLastRuneInString(word[:at]); at > 0 && !unicode.IsPunct(before) {
+			continue
+		}
+		name := strings.TrimRightFunc(word[at+1:], func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Resolves the mentions in the text to the ids of the users they mention. A mention matches the id
+// or the name of a user, ignoring case. Users mentioning themselves are left out
+func (s *Server) resolveMentions(sender string, text string) []string {
+	names := parseMentions(text)
+	if len(names) == 0 {
+		return nil
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var ids []string
+	seen := map[string]bool{sender: true}
+	for _, name := range names {
+		for id, conn := range s.connections {
+			if !seen[id] && (strings.EqualFold(id, name) || strings.EqualFold(conn.user.Name, name)) {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// Tells the mentioned users that they were mentioned, even if they are not in the room of the message.
+// The notification refers to the mentioning message with its sequence number
+func (s *Server) notifyMentions(ctx context.Context, msg *proto.Message) {
+	if len(msg.Mentions) == 0 {
+		return
+	}
+	mu.Lock()
+	lamport += 1
+	mu.Unlock()
+	s.broadcast(ctx, &proto.Message{
+		Id:       msg.Id,
+		Text:     msg.Text,
+		Lamport:  lamport,
+		Room:     msg.Room,
+		Event:    proto.EventType_EVENT_MENTION,
+		Ref:      msg.Seq,
+		Mentions: msg.Mentions,
+	})
+}
+
+// Checks if the connection should get the message. Mention notifications go to the mentioned users wherever they are,
+// presence events to everybody but the user they are about, messages without a room to everybody and other messages
+// only to the users in the room
+func receives(conn *Connection, msg *proto.Message) bool {
+	if msg.Event == proto.EventType_EVENT_PRESENCE {
+		return msg.Id != conn.user.Id
+	}
+	if msg.Event == proto.EventType_EVENT_MENTION {
+		for _, id := range msg.Mentions {
+			if id == conn.user.Id {
+				return true
+			}
+		}
+		return false
+	}
+	return msg.Room == "" || conn.rooms[msg.Room]
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/00kristian/MiniProject_2/membership"
+	"github.com/00kristian/MiniProject_2/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Implementation of the Heartbeat rpc - the user answers the heartbeats sent over its Join stream.
+// The first heartbeat tells us that the client answers them, and from then on a client that stops answering
+// is suspected and later disconnected. Clients that never send one are only disconnected when sending to them fails
+func (s *Server) Heartbeat(ctx context.Context, id *proto.Id) (*proto.Empty, error) {
+	s.lock.RLock()
+	conn, found := s.connections[id.Id]
+	s.lock.RUnlock()
+	if !found || !conn.user.Active {
+		return nil, status.Errorf(codes.NotFound, "%s has not joined Chitty-Chat", id.Id)
+	}
+	s.members.Heartbeat(id.Id)
+	return &proto.Empty{}, nil
+}
+
+// Sends a heartbeat to every user that answers them, and acts on the users whose status changed
+func (s *Server) monitor(interval time.Duration) {
+	heartbeat := &proto.Message{Event: proto.EventType_EVENT_HEARTBEAT}
+	for range time.Tick(interval) {
+		for _, id := range s.members.Members() {
+			s.lock.RLock()
+			conn, found := s.connections[id]
+			s.lock.RUnlock()
+			if !found {
+				s.members.Remove(id)
+				continue
+			}
+			// A heartbeat that can not be sent means the user is gone, no need to wait for the detector
+			if err := conn.send(heartbeat); err != nil {
+				s.members.Remove(id)
+				s.presence(id, membership.Dead)
+			}
+		}
+		for _, change := range s.members.Check() {
+			log.Printf("[Server: %d] %s is %s (phi %.1f)", lamport, change.ID, change.To, change.Phi)
+			s.presence(change.ID, change.To)
+		}
+	}
+}
+
+// Tells everybody that the status of the user changed. Dead users are disconnected and their connection is cleaned up
+func (s *Server) presence(id string, to membership.Status) {
+	if to == membership.Dead {
+		s.lock.Lock()
+		if conn, found := s.connections[id]; found {
+			conn.user.Active = false
+			delete(s.connections, id)
+			conn.close(status.Error(codes.Unavailable, "no heartbeats were received, the connection is closed"))
+		}
+		s.lock.Unlock()
+	}
+
+	mu.Lock()
+	lamport += 1
+	current := lamport
+	mu.Unlock()
+	s.broadcast(context.Background(), &proto.Message{
+		Id:      id,
+		Text:    to.String(),
+		Lamport: current,
+		Event:   proto.EventType_EVENT_PRESENCE,
+	})
+}
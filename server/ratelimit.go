@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/00kristian/MiniProject_2/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Name of the trailer key telling the client how many seconds to wait before trying again
+const retryAfterKey = "retry-after"
+
+// How often the buckets, strikes and mutes that ran out are removed, so users that come and go are not kept forever
+const sweepInterval = time.Minute
+
+// The rpcs that are rate limited - everything that ends up being broadcasted to everybody
+var rateLimitedMethods = map[string]bool{
+	"/proto.Chat/Publish": true,
+	"/proto.Chat/Edit":    true,
+	"/proto.Chat/Delete":  true,
+	"/proto.Chat/React":   true,
+}
+
+// Settings for the rate limiter. Burst is the size of a bucket, refill is tokens added per second
+type RateLimitConfig struct {
+	UserBurst    float64
+	UserRefill   float64
+	GlobalBurst  float64
+	GlobalRefill float64
+	// Bots get a bucket of their own size, since answering commands for everybody takes more than one user chatting
+	BotBurst  float64
+	BotRefill float64
+	// Number of rejected publishes within StrikeWindow before a user is muted
+	MuteStrikes  int
+	StrikeWindow time.Duration
+	MuteDuration time.Duration
+}
+
+// A classic token bucket - every publish takes one token, and tokens are refilled over time
+type tokenBucket struct {
+	tokens float64
+	burst  float64
+	refill float64
+	last   time.Time
+}
+
+func newTokenBucket(burst, refill float64, now time.Time) *tokenBucket {
+	return &tokenBucket{tokens: burst, burst: burst, refill: refill, last: now}
+}
+
+// Takes a token if one is available. If not, returns how long until the next token is available
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.refill)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens -= 1
+		return true, 0
+	}
+	if b.refill <= 0 {
+		return false, time.Duration(math.MaxInt64)
+	}
+	return false, time.Duration((1 - b.tokens) / b.refill * float64(time.Second))
+}
+
+// Keeps a bucket per user, a global bucket and the strikes of users that exceeds their limit
+type rateLimiter struct {
+	mu      sync.Mutex
+	config  RateLimitConfig
+	global  *tokenBucket
+	users   map[string]*tokenBucket
+	strikes map[string][]time.Time
+	muted   map[string]time.Time
+	// The users that get the bot limits
+	bots map[string]bool
+	// When the limiter was last swept
+	swept time.Time
+}
+
+func newRateLimiter(config RateLimitConfig, bots map[string]string) *rateLimiter {
+	isBot := make(map[string]bool)
+	for id := range bots {
+		isBot[id] = true
+	}
+	return &rateLimiter{
+		config:  config,
+		bots:    isBot,
+		global:  newTokenBucket(config.GlobalBurst, config.GlobalRefill, time.Now()),
+		users:   make(map[string]*tokenBucket),
+		strikes: make(map[string][]time.Time),
+		muted:   make(map[string]time.Time),
+		swept:   time.Now(),
+	}
+}
+
+// Checks if the user is allowed to publish right now.
+// Returns how long the user has to wait if not, and whether the user was muted by this call
+func (l *rateLimiter) allow(user string, now time.Time) (ok bool, retryAfter time.Duration, mutedNow bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.swept) >= sweepInterval {
+		l.sweep(now)
+	}
+
+	// Muted users are rejected until their mute runs out
+	if until, found := l.muted[user]; found {
+		if now.Before(until) {
+			return false, until.Sub(now), false
+		}
+		delete(l.muted, user)
+	}
+
+	bucket, found := l.users[user]
+	if !found {
+		burst, refill := l.config.UserBurst, l.config.UserRefill
+		if l.bots[user] {
+			burst, refill = l.config.BotBurst, l.config.BotRefill
+		}
+		bucket = newTokenBucket(burst, refill, now)
+		l.users[user] = bucket
+	}
+
+	if ok, wait := bucket.take(now); !ok {
+		return false, wait, l.strike(user, now)
+	}
+	// The global bucket is only touched when the user had a token, so one user cannot drain it alone
+	if ok, wait := l.global.take(now); !ok {
+		return false, wait, false
+	}
+	return true, 0, false
+}
+
+// Records a strike for the user and mutes the user if there has been too many recently
+func (l *rateLimiter) strike(user string, now time.Time) bool {
+	if l.config.MuteStrikes <= 0 {
+		return false
+	}
+	recent := l.strikes[user][:0]
+	for _, t := range l.strikes[user] {
+		if now.Sub(t) < l.config.StrikeWindow {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	if len(recent) < l.config.MuteStrikes {
+		l.strikes[user] = recent
+		return false
+	}
+	delete(l.strikes, user)
+	l.muted[user] = now.Add(l.config.MuteDuration)
+	return true
+}
+
+// Removes the buckets that have refilled completely, since a new bucket is the same, and the strikes and mutes that ran out
+func (l *rateLimiter) sweep(now time.Time) {
+	l.swept = now
+	for user, bucket := range l.users {
+		if bucket.refill > 0 && now.Sub(bucket.last).Seconds()*bucket.refill >= bucket.burst {
+			delete(l.users, user)
+		}
+	}
+	for user, strikes := range l.strikes {
+		if len(strikes) == 0 || now.Sub(strikes[len(strikes)-1]) >= l.config.StrikeWindow {
+			delete(l.strikes, user)
+		}
+	}
+	for user, until := range l.muted {
+		if !now.Before(until) {
+			delete(l.muted, user)
+		}
+	}
+}
+
+// Unary interceptor that enforces the rate limits on Publish and the other rpcs that send messages.
+// It must come after the interceptor authenticating the user, so a user can only use up its own bucket
+func (s *Server) rateLimitInterceptor(l *rateLimiter) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		msg, isMessage := req.(*proto.Message)
+		if !rateLimitedMethods[info.FullMethod] || !isMessage {
+			return handler(ctx, req)
+		}
+
+		if seconds, err := s.takeToken(ctx, l, msg.Id); err != nil {
+			grpc.SetTrailer(ctx, metadata.Pairs(retryAfterKey, strconv.FormatInt(seconds, 10)))
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// Takes a token from the bucket of the user. If there is none, it returns the number of seconds to wait
+// and the error to give the user. A user that is muted for flooding just now is announced to everybody.
+// Every way into the server that sends messages goes through here, so they all behave the same
+func (s *Server) takeToken(ctx context.Context, l *rateLimiter, user string) (int64, error) {
+	ok, retryAfter, mutedNow := l.allow(user, time.Now())
+	if ok {
+		return 0, nil
+	}
+	if mutedNow {
+		log.Printf("[Server: %d] %s was muted for flooding", lamport, user)
+		s.announce(ctx, fmt.Sprintf("%s has been muted for %v for flooding the chat", user, l.config.MuteDuration))
+	}
+	// Round up, so the client never retries too early
+	seconds := int64(math.Ceil(retryAfter.Seconds()))
+	return seconds, status.Errorf(codes.ResourceExhausted, "rate limit exceeded, retry after %d seconds", seconds)
+}
+
+// Mutes the user until the given time, no matter how many tokens the user has left
+func (l *rateLimiter) mute(user string, until time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.muted[user] = until
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"unicode"
+
+	"github.com/00kristian/MiniProject_2/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+)
+
+// The longest emoji code accepted, like ":thumbsup:"
+const maxEmojiLength = 32
+
+// Implementation of the React rpc - adds or removes a reaction on a message.
+// The request is a message from the user with the emoji as text, the event says if it is added (EVENT_REACT)
+// or removed (EVENT_UNREACT), and ref is the sequence number of the message
+func (s *Server) React(ctx context.Context, req *proto.Message) (*proto.Empty, error) {
+	if err := validateReaction(req); err != nil {
+		return nil, err
+	}
+	target, err := s.editable(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkPublish(req.Id, target.Room); err != nil {
+		return nil, err
+	}
+
+	// Reacting twice with the same emoji, or removing a reaction that is not there, changes nothing
+	if hasReacted(target, req.Id, req.Text) == (req.Event == proto.EventType_EVENT_REACT) {
+		return &proto.Empty{}, nil
+	}
+	if err := s.publishEvent(ctx, req, target, req.Event); err != nil {
+		return nil, err
+	}
+	return &proto.Empty{}, nil
+}
+
+// Checks that the reaction is either added or removed, and that the emoji is a short code without spaces
+func validateReaction(req *proto.Message) error {
+	var violations []*errdetails.BadRequest_FieldViolation
+	if req.Event != proto.EventType_EVENT_REACT && req.Event != proto.EventType_EVENT_UNREACT {
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{Field: "event", Description: "must be EVENT_REACT or EVENT_UNREACT"})
+	}
+	violations = append(violations, checkText("text", req.Text, maxEmojiLength)...)
+	for _, r := range req.Text {
+		if unicode.IsSpace(r) {
+			violations = append(violations, &errdetails.BadRequest_FieldViolation{Field: "text", Description: "must not contain spaces"})
+			break
+		}
+	}
+	return invalidArgument("invalid reaction", violations)
+}
+
+// Checks if the user has reacted to the message with the emoji
+func hasReacted(msg *proto.Message, user string, emoji string) bool {
+	for _, reaction := range msg.Reactions {
+		if reaction.Emoji != emoji {
+			continue
+		}
+		for _, id := range reaction.Users {
+			if id == user {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Adds or removes the reaction of the user, and returns the new reactions.
+// Emojis keep the order they were first used in, and disappear when nobody uses them anymore
+func react(reactions []*proto.Reaction, user string, emoji string, add bool) []*proto.Reaction {
+	var updated []*proto.Reaction
+	found := false
+	for _, reaction := range reactions {
+		if reaction.Emoji == emoji {
+			found = true
+			reaction.Users = without(reaction.Users, user)
+			if add {
+				reaction.Users = append(reaction.Users, user)
+			}
+			reaction.Count = uint32(len(reaction.Users))
+		}
+		if reaction.Count > 0 {
+			updated = append(updated, reaction)
+		}
+	}
+	if !found && add {
+		updated = append(updated, &proto.Reaction{Emoji: emoji, Count: 1, Users: []string{user}})
+	}
+	return updated
+}
+
+// The ids without the given id
+func without(ids []string, id string) []string {
+	var rest []string
+	for _, other := range ids {
+		if other != id {
+			rest = append(rest, other)
+		}
+	}
+	return rest
+}
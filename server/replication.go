@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/00kristian/MiniProject_2/proto"
+	"github.com/00kristian/MiniProject_2/raft"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+// Prefix of the full method names of the raft service
+const raftServicePrefix = "/proto.Raft/"
+
+// Name of the trailer key telling the client the address of the leader
+const leaderKey = "leader"
+
+// How long a message can wait for a quorum before the publisher is told to try again
+const commitTimeout = 5 * time.Second
+
+// Gives the message its uid, unless it has one. The uid is what every server knows the message by, since the sequence number
+// and the lamport time change on the way: the name of this node, a random incarnation so a restarted node never reuses a uid,
+// and a counter
+func (s *Server) stamp(msg *proto.Message) {
+	if msg.Uid == "" {
+		msg.Uid = fmt.Sprintf("%s/%d", s.incarnation, atomic.AddUint64(&s.uids, 1))
+	}
+}
+
+// Publishes a message to the users. With raft the message is first committed to a majority of the nodes,
+// and every node sends it to its own users when it is applied. Without raft it is sent right away,
+// and forwarded to the other nodes of the cluster and relayed to the federated servers
+func (s *Server) publish(ctx context.Context, msg *proto.Message) error {
+	s.stamp(msg)
+	if s.raft == nil {
+		stored := s.deliver(ctx, msg)
+		s.cluster.forward(stored)
+		s.federation.relay(stored)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, commitTimeout)
+	defer cancel()
+	_, err := s.raft.Propose(ctx, msg)
+	var notLeader *raft.NotLeaderError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &notLeader):
+		return s.redirect(ctx, notLeader.Leader)
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.Unavailable, "the message could not be replicated to a majority of the servers, try again")
+	}
+	return status.Errorf(codes.Unavailable, "the message could not be replicated: %v", err)
+}
+
+// Stores the message in the history and sends it to the users in its room, and notifies the mentioned users
+func (s *Server) deliver(ctx context.Context, msg *proto.Message) *proto.Message {
+	// Users are mentioned by name, and only users on this node can be found
+	if msg.Id != "" && msg.Event == proto.EventType_EVENT_MESSAGE {
+		msg.Mentions = s.resolveMentions(msg.Id, msg.Text)
+	}
+	stored := s.history.append(msg)
+	s.broadcast(ctx, stored)
+	s.notifyMentions(ctx, stored)
+	return stored
+}
+
+// The prefix of the uids of the messages published by this run of the node
+func newIncarnation(node string) string {
+	random := make([]byte, 8)
+	rand.Read(random)
+	return node + "/" + hex.EncodeToString(random)
+}
+
+// Tells the client that this node is not the leader. The address of the leader is sent in the "leader" trailer
+func (s *Server) redirect(ctx context.Context, leader string) error {
+	address, found := s.raftAddresses[leader]
+	if !found {
+		return status.Error(codes.Unavailable, "no leader is elected right now, try again")
+	}
+	grpc.SetTrailer(ctx, metadata.Pairs(leaderKey, address))
+	return status.Errorf(codes.Unavailable, "this server is not the leader, the leader is at %s", address)
+}
+
+// Called on every node with every committed message, in the same order on every node.
+// The lamport time of the message is merged into ours, so timestamps stay consistent across the nodes.
+// The entry stays in the raft log and is sent to the followers, so the message is copied before it is changed
+func (s *Server) apply(entry *proto.LogEntry) {
+	msg := protobuf.Clone(entry.Message).(*proto.Message)
+	mu.Lock()
+	lamport = max(lamport, msg.Lamport) + 1
+	mu.Unlock()
+	s.deliver(context.Background(), msg)
+}
+
+// Starts the raft node from "-raft-nodes id=address,id=address". The node with our id is us, the others are peers
+func (s *Server) startRaft(id string, nodes string, dir string, token string, grpcServer *grpc.Server) error {
+	s.raftAddresses = make(map[string]string)
+	var peers []string
+	for _, node := range strings.Split(nodes, ",") {
+		parts := strings.SplitN(strings.TrimSpace(node), "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return errors.New("raft nodes must be given as id=address")
+		}
+		s.raftAddresses[parts[0]] = parts[1]
+		if parts[0] != id {
+			peers = append(peers, parts[0])
+		}
+	}
+	if _, found := s.raftAddresses[id]; !found {
+		return errors.New("the raft nodes must include this node")
+	}
+
+	// The node must remember its term, vote and log across restarts, or it could break its promises to the others
+	if dir == "" {
+		dir = "raft-" + id
+	}
+	storage, err := raft.OpenFileStorage(dir)
+	if err != nil {
+		return err
+	}
+	s.raft, err = raft.New(raft.Config{
+		ID:        id,
+		Peers:     peers,
+		Apply:     s.apply,
+		Transport: raft.NewGRPCTransport(s.raftAddresses, token),
+		Storage:   storage,
+	})
+	if err != nil {
+		return err
+	}
+	proto.RegisterRaftServer(grpcServer, &raft.Server{Node: s.raft})
+	s.raft.Start()
+	log.Printf("[Server: %d] Replicating messages with raft as %s with peers %v", lamport, id, peers)
+	return nil
+}
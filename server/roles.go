@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/00kristian/MiniProject_2/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Room everybody joins if they do not ask for a specific room
+const defaultRoom = "lobby"
+
+// Something a user can do in a room
+type Permission int
+
+const (
+	PermissionPublish Permission = iota
+	PermissionInvite
+	PermissionKick
+	PermissionTopic
+	PermissionSetRole
+	PermissionModerate
+)
+
+// The lowest role allowed to do each thing in a room
+var requiredRole = map[Permission]proto.Role{
+	PermissionPublish: proto.Role_ROLE_MEMBER,
+	PermissionInvite:  proto.Role_ROLE_MODERATOR,
+	PermissionKick:    proto.Role_ROLE_MODERATOR,
+	PermissionTopic:   proto.Role_ROLE_MODERATOR,
+	PermissionSetRole: proto.Role_ROLE_ADMIN,
+	// Deleting messages of others and reading the earlier versions of messages
+	PermissionModerate: proto.Role_ROLE_MODERATOR,
+}
+
+// A chat room. The server keeps the topic and the roles given in the room
+type Room struct {
+	name  string
+	topic string
+	// Roles given in this room - these override the server wide roles
+	roles map[string]proto.Role
+}
+
+// Parses a role name like "moderator" into a role
+func parseRole(name string) (proto.Role, error) {
+	role, found := proto.Role_value["ROLE_"+strings.ToUpper(name)]
+	if !found || role == int32(proto.Role_ROLE_UNSPECIFIED) {
+		return proto.Role_ROLE_UNSPECIFIED, fmt.Errorf("unknown role %q", name)
+	}
+	return proto.Role(role), nil
+}
+
+// The short lower case name of a role, like "moderator"
+func roleName(role proto.Role) string {
+	return strings.ToLower(strings.TrimPrefix(role.String(), "ROLE_"))
+}
+
+// The room a message or user belongs to - empty means the default room
+func roomName(room string) string {
+	if room == "" {
+		return defaultRoom
+	}
+	return room
+}
+
+// Returns the room with the given name, and creates it with the given user as owner if it does not exist.
+// The caller must hold s.lock
+func (s *Server) room(name string, creator string) *Room {
+	room, found := s.rooms[name]
+	if !found {
+		room = &Room{name: name, roles: make(map[string]proto.Role)}
+		if creator != "" {
+			room.roles[creator] = proto.Role_ROLE_OWNER
+		}
+		s.rooms[name] = room
+	}
+	return room
+}
+
+// The role of the user in the given room. Roles in the room wins over server wide roles,
+// and users without any role gets the default role. The caller must hold s.lock
+func (s *Server) roleOf(id string, room string) proto.Role {
+	if r, found := s.rooms[room]; found {
+		if role, found := r.roles[id]; found {
+			return role
+		}
+	}
+	if role, found := s.roles[id]; found {
+		return role
+	}
+	return s.defaultRole
+}
+
+// Checks that the user is allowed to do the given thing in the room. Returns a PermissionDenied error if not
+func (s *Server) authorize(id string, room string, permission Permission) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.authorizeLocked(id, room, permission)
+}
+
+// Same as authorize, but the caller must hold s.lock
+func (s *Server) authorizeLocked(id string, room string, permission Permission) error {
+	role := s.roleOf(id, room)
+	if role < requiredRole[permission] {
+		return status.Errorf(codes.PermissionDenied, "%s is %s in %s, at least %s is required", id, roleName(role), room, roleName(requiredRole[permission]))
+	}
+	return nil
+}
+
+// Implementation of the Invite rpc - brings a connected user into a room
+func (s *Server) Invite(ctx context.Context, req *proto.RoomRequest) (*proto.Empty, error) {
+	room := roomName(req.Room)
+
+	s.lock.Lock()
+	if err := s.authorizeLocked(req.Actor, room, PermissionInvite); err != nil {
+		s.lock.Unlock()
+		return nil, err
+	}
+	target, found := s.connections[req.Target]
+	if !found || !target.user.Active {
+		s.lock.Unlock()
+		return nil, status.Errorf(codes.NotFound, "%s is not connected", req.Target)
+	}
+	s.room(room, "")
+	target.rooms[room] = true
+	s.lock.Unlock()
+
+	s.roomEvent(ctx, room, req.Lamport, fmt.Sprintf("%s invited %s to %s", req.Actor, req.Target, room))
+	return &proto.Empty{}, nil
+}
+
+// Implementation of the Kick rpc - removes a user from a room. The user stays connected to the server
+func (s *Server) Kick(ctx context.Context, req *proto.RoomRequest) (*proto.Empty, error) {
+	room := roomName(req.Room)
+
+	s.lock.Lock()
+	if err := s.authorizeLocked(req.Actor, room, PermissionKick); err != nil {
+		s.lock.Unlock()
+		return nil, err
+	}
+	// Nobody can kick a user with the same or a higher role
+	if s.roleOf(req.Target, room) >= s.roleOf(req.Actor, room) {
+		s.lock.Unlock()
+		return nil, status.Errorf(codes.PermissionDenied, "%s cannot kick %s", req.Actor, req.Target)
+	}
+	target, found := s.connections[req.Target]
+	if !found || !target.rooms[room] {
+		s.lock.Unlock()
+		return nil, status.Errorf(codes.NotFound, "%s is not in %s", req.Target, room)
+	}
+	s.lock.Unlock()
+
+	// Announce before removing the user, so the user gets to know
+	s.roomEvent(ctx, room, req.Lamport, fmt.Sprintf("%s was kicked from %s by %s", req.Target, room, req.Actor))
+
+	s.lock.Lock()
+	delete(target.rooms, room)
+	s.lock.Unlock()
+	return &proto.Empty{}, nil
+}
+
+// Implementation of the SetTopic rpc - changes the topic of a room
+func (s *Server) SetTopic(ctx context.Context, req *proto.RoomRequest) (*proto.Empty, error) {
+	room := roomName(req.Room)
+	if err := invalidArgument("invalid topic", checkText("topic", req.Topic, s.limits.MaxMessageLength)); err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	if err := s.authorizeLocked(req.Actor, room, PermissionTopic); err != nil {
+		s.lock.Unlock()
+		return nil, err
+	}
+	s.room(room, "").topic = req.Topic
+	s.lock.Unlock()
+
+	s.roomEvent(ctx, room, req.Lamport, fmt.Sprintf("%s changed the topic of %s to: %s", req.Actor, room, req.Topic))
+	return &proto.Empty{}, nil
+}
+
+// Implementation of the GetRoles rpc - lists the roles of everybody in a room and everybody given a role
+func (s *Server) GetRoles(ctx context.Context, req *proto.RoomRequest) (*proto.RoleList, error) {
+	room := roomName(req.Room)
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	r, found := s.rooms[room]
+	if !found {
+		return nil, status.Errorf(codes.NotFound, "%s does not exist", room)
+	}
+
+	// Everybody in the room, and everybody with a role that is not the default
+	ids := make(map[string]bool)
+	for id := range r.roles {
+		ids[id] = true
+	}
+	for id := range s.roles {
+		ids[id] = true
+	}
+	for id, conn := range s.connections {
+		if conn.user.Active && conn.rooms[room] {
+			ids[id] = true
+		}
+	}
+
+	list := &proto.RoleList{Room: room, Topic: r.topic}
+	for id := range ids {
+		list.Roles = append(list.Roles, &proto.RoleAssignment{Id: id, Role: s.roleOf(id, room)})
+	}
+	// Highest role first, then by id
+	sort.Slice(list.Roles, func(i, j int) bool {
+		if list.Roles[i].Role != list.Roles[j].Role {
+			return list.Roles[i].Role > list.Roles[j].Role
+		}
+		return list.Roles[i].Id < list.Roles[j].Id
+	})
+	return list, nil
+}
+
+// Implementation of the SetRole rpc - gives a user a role in a room.
+// Users can only give roles below their own, and only to users below them
+func (s *Server) SetRole(ctx context.Context, req *proto.RoleRequest) (*proto.Empty, error) {
+	room := roomName(req.Room)
+	// Roles are compared by their number, so a number that is not a role could rank above or below every role
+	if _, known := proto.Role_name[int32(req.Role)]; !known || req.Role == proto.Role_ROLE_UNSPECIFIED {
+		return nil, status.Errorf(codes.InvalidArgument, "role must be one of the roles, not %d", req.Role)
+	}
+	if req.Target == "" {
+		return nil, status.Error(codes.InvalidArgument, "target must not be empty")
+	}
+
+	s.lock.Lock()
+	if err := s.authorizeLocked(req.Actor, room, PermissionSetRole); err != nil {
+		s.lock.Unlock()
+		return nil, err
+	}
+	actorRole := s.roleOf(req.Actor, room)
+	// Owners can hand out ownership, everybody else only roles below their own
+	if actorRole != proto.Role_ROLE_OWNER && (req.Role >= actorRole || s.roleOf(req.Target, room) >= actorRole) {
+		s.lock.Unlock()
+		return nil, status.Errorf(codes.PermissionDenied, "%s cannot make %s %s", req.Actor, req.Target, roleName(req.Role))
+	}
+	s.room(room, "").roles[req.Target] = req.Role
+	s.lock.Unlock()
+
+	log.Printf("[Server: %d] %s made %s %s in %s", lamport, req.Actor, req.Target, roleName(req.Role), room)
+	s.roomEvent(ctx, room, req.Lamport, fmt.Sprintf("%s made %s %s", req.Actor, req.Target, roleName(req.Role)))
+	return &proto.Empty{}, nil
+}
+
+// Broadcasts a system message to a room, as the result of a request with the given lamport time
+func (s *Server) roomEvent(ctx context.Context, room string, requestLamport uint64, text string) {
+	mu.Lock()
+	lamport = max(lamport, requestLamport) + 1
+	current := lamport
+	mu.Unlock()
+	s.broadcast(ctx, &proto.Message{
+		Id:      "",
+		Text:    text,
+		Lamport: current,
+		Room:    room,
+	})
+	s.webhooks.fire(&webhookEvent{Event: "room", Room: room, Text: text, Lamport: current})
+}
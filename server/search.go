@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/00kristian/MiniProject_2/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+// Number of hits returned by Search if the caller does not ask for a specific number, and the most it returns at once
+const defaultSearchPage = 20
+const maxSearchPage = 100
+
+// Inverted index from the words in messages to the sequence numbers of the messages they are in.
+// It is kept by the history, which holds the lock
+type index struct {
+	terms map[string]map[uint64]bool
+}
+
+func newIndex() *index {
+	return &index{terms: make(map[string]map[uint64]bool)}
+}
+
+// Adds the words of the message to the index. System messages are not indexed
+func (idx *index) add(msg *proto.Message) {
+	if msg.Id == "" {
+		return
+	}
+	for _, term := range terms(msg.Text) {
+		if idx.terms[term] == nil {
+			idx.terms[term] = make(map[uint64]bool)
+		}
+		idx.terms[term][msg.Seq] = true
+	}
+}
+
+// Removes the words of the message from the index
+func (idx *index) remove(msg *proto.Message) {
+	for _, term := range terms(msg.Text) {
+		delete(idx.terms[term], msg.Seq)
+		if len(idx.terms[term]) == 0 {
+			delete(idx.terms, term)
+		}
+	}
+}
+
+// Sequence numbers of the messages that have all the terms
+func (idx *index) lookup(terms []string) []uint64 {
+	// Start with the rarest term, then every other term can only remove messages
+	sort.Slice(terms, func(i, j int) bool { return len(idx.terms[terms[i]]) < len(idx.terms[terms[j]]) })
+	var seqs []uint64
+	for seq := range idx.terms[terms[0]] {
+		found := true
+		for _, term := range terms[1:] {
+			if !idx.terms[term][seq] {
+				found = false
+				break
+			}
+		}
+		if found {
+			seqs = append(seqs, seq)
+		}
+	}
+	return seqs
+}
+
+// Splits a text into lower case words. Everything that is not a letter or a digit separates words
+func terms(text string) []string {
+	seen := make(map[string]bool)
+	var terms []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), isSeparator) {
+		if !seen[word] {
+			seen[word] = true
+			terms = append(terms, word)
+		}
+	}
+	return terms
+}
+
+func isSeparator(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+// Marks the words of the text that are search terms with ** on both sides
+func highlight(text string, terms []string) string {
+	matches := make(map[string]bool)
+	for _, term := range terms {
+		matches[term] = true
+	}
+	var b strings.Builder
+	runes := []rune(text)
+	for i := 0; i < len(runes); {
+		if isSeparator(runes[i]) {
+			b.WriteRune(runes[i])
+			i++
+			continue
+		}
+		end := i
+		for end < len(runes) && !isSeparator(runes[end]) {
+			end++
+		}
+		word := string(runes[i:end])
+		if matches[strings.ToLower(word)] {
+			word = "**" + word + "**"
+		}
+		b.WriteString(word)
+		i = end
+	}
+	return b.String()
+}
+
+// Finds the messages matching the request, newest first. Returns a page of them and the number of messages matching
+func (h *History) search(req *proto.SearchRequest, queryTerms []string, offset int, limit int) ([]*proto.Message, int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var candidates []*proto.Message
+	if len(queryTerms) > 0 {
+		for _, seq := range h.index.lookup(queryTerms) {
+			if msg := h.find(seq); msg != nil {
+				candidates = append(candidates, msg)
+			}
+		}
+		sort.Slice(candidates, func(i, j int) bool { return candidates[i].Seq > candidates[j].Seq })
+	} else {
+		// Without words every message is a candidate
+		for i := len(h.messages) - 1; i >= 0; i-- {
+			if h.messages[i].Id != "" && !h.messages[i].Deleted {
+				candidates = append(candidates, h.messages[i])
+			}
+		}
+	}
+
+	var page []*proto.Message
+	total := 0
+	for _, msg := range candidates {
+		if !matches(msg, req) {
+			continue
+		}
+		if total >= offset && len(page) < limit {
+			page = append(page, protobuf.Clone(msg).(*proto.Message))
+		}
+		total++
+	}
+	return page, total
+}
+
+// Checks the message against the filters of the request. Zero values do not filter
+func matches(msg *proto.Message, req *proto.SearchRequest) bool {
+	switch {
+	case req.Sender != "" && !strings.EqualFold(msg.Id, req.Sender):
+		return false
+	case req.Room != "" && msg.Room != req.Room:
+		return false
+	case req.FromLamport != 0 && msg.Lamport < req.FromLamport:
+		return false
+	case req.ToLamport != 0 && msg.Lamport > req.ToLamport:
+		return false
+	case req.FromTime != 0 && msg.Time < req.FromTime:
+		return false
+	case req.ToTime != 0 && msg.Time > req.ToTime:
+		return false
+	}
+	return true
+}
+
+// Implementation of the Search rpc - finds messages by the words in them, filtered by sender, room and lamport or unix time
+// (in milliseconds). The hits are newest first, with the words that matched marked with ** in the highlighted text
+func (s *Server) Search(ctx context.Context, req *proto.SearchRequest) (*proto.SearchResult, error) {
+	queryTerms := terms(req.Query)
+	if len(queryTerms) == 0 && req.Sender == "" && req.Room == "" {
+		return nil, status.Error(codes.InvalidArgument, "give words to search for, a sender or a room")
+	}
+	limit := int(req.Limit)
+	if limit <= 0 {
+		limit = defaultSearchPage
+	}
+	if limit > maxSearchPage {
+		return nil, status.Errorf(codes.InvalidArgument, "limit must be at most %d", maxSearchPage)
+	}
+
+	messages, total := s.history.search(req, queryTerms, int(req.Offset), limit)
+	result := &proto.SearchResult{Total: uint32(total)}
+	for _, msg := range messages {
+		result.Hits = append(result.Hits, &proto.SearchHit{Message: msg, Highlighted: highlight(msg.Text, queryTerms)})
+	}
+	return result, nil
+}
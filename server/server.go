@@ -2,13 +2,24 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/00kristian/MiniProject_2/membership"
 	"github.com/00kristian/MiniProject_2/proto"
+	"github.com/00kristian/MiniProject_2/raft"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	protobuf "google.golang.org/protobuf/proto"
 )
 
 // Mutex for locking lamport
@@ -21,72 +32,252 @@ type Connection struct {
 	stream proto.Chat_JoinServer
 	user *proto.User
 	error chan error 
+	// Rooms the user is in - the user only receives messages from these rooms
+	rooms map[string]bool
+	// Metadata about the connection, shown to admins
+	address string
+	userAgent string
+	connectedAt time.Time
+	// When the user last published something, to find the users that are away or idle. Protected by the server lock
+	lastActive time.Time
+	// Only one message can be sent on the stream at a time
+	sending sync.Mutex
+	// Calls made as the user must carry it, see session.go. Set before the connection is added and never changed
+	session string
+}
+
+// Sends a message on the Join stream of the connection
+func (c *Connection) send(msg *proto.Message) error {
+	c.sending.Lock()
+	defer c.sending.Unlock()
+	return c.stream.Send(msg)
+}
+
+// Ends the Join stream of the connection with the given error. Never blocks, and only the first error is used
+func (c *Connection) close(err error) {
+	select {
+	case c.error <- err:
+	default:
+	}
 }
 
 type Server struct {
 	// Has to be implemented, otherwise the grpc cannot register
 	proto.UnimplementedChatServer
+	// Protects the connections map and the banned users
+	lock sync.RWMutex
 	connections map[string]*Connection
+	// Banned user ids mapped to the reason they were banned
+	banned map[string]string
+	// Rate limiter for publishing - also used by admins to mute users
+	limiter *rateLimiter
+	// Chat rooms by name, protected by lock
+	rooms map[string]*Room
+	// Server wide roles, and the role of everybody else. Protected by lock
+	roles map[string]proto.Role
+	defaultRole proto.Role
+	// Limits on messages and names, enforced by the server instead of trusting the client
+	limits MessageLimits
+	// Every published message
+	history *History
+	// Files attached to messages
+	blobs *BlobStore
+	// The other nodes of the cluster, if any
+	cluster *Cluster
+	// The replicated log, if messages are replicated with raft. Nil otherwise
+	raft *raft.Node
+	// Address of every raft node by id, so clients can be sent to the leader
+	raftAddresses map[string]string
+	// The independent servers we share rooms with, if any
+	federation *Federation
+	// Failure detector for the users answering heartbeats
+	members *membership.Detector
+	// Token of every bot user by id. Set at startup and never changed
+	bots map[string]string
+	// The URLs the events of the chat are sent to, if any
+	webhooks *Webhooks
+	// The tokens integrations post to rooms with, if any
+	incomingWebhooks *IncomingWebhooks
+	// Prefix of the uids given to the messages published here, and the number of the last one. Uids is used atomically
+	incarnation string
+	uids uint64
+	// Whether the admin service is enabled
+	admin bool
 }
 
 func (s *Server) Leave(ctx context.Context, Id *proto.Id) (*proto.Empty, error){
+	s.lock.Lock()
+	temp, found := s.connections[Id.Id]
+	if found {
+		temp.user.Active = false
+	}
+	s.lock.Unlock()
+	if !found {
+		return nil, status.Errorf(codes.NotFound, "%s has not joined Chitty-Chat", Id.Id)
+	}
+	s.members.Remove(Id.Id)
+
 	mu.Lock()
 	lamport = max(lamport, Id.Lamport) + 1
 	mu.Unlock()
-	temp := s.connections[Id.Id]
-	temp.user.Active = false
-	s.connections[Id.Id] = temp
 	leaveMessage := &proto.Message{
 		Id: "",
 		Text: Id.Id + " left Chitty-Chat at Lamport time " + fmt.Sprintf("%d", lamport),
+		Lamport: lamport,
 	}
-	s.Broadcast(ctx, leaveMessage)
+	s.broadcast(ctx, leaveMessage)
+	s.cluster.forward(leaveMessage)
+	s.userEvent("leave", temp.user)
 	return &proto.Empty{}, nil
 }
 
 // Implementation of the Publish rpc - Allows users to publish messages to be broadcasted
 func (s *Server) Publish(ctx context.Context, msg *proto.Message) (*proto.Empty,error){
+	// Never trust the client - reject the message before it affects the lamport time
+	if err := s.validateMessage(msg); err != nil {
+		return nil, err
+	}
+	if reason, banned := s.isBanned(msg.Id); banned {
+		return nil, status.Errorf(codes.PermissionDenied, "%s is banned: %s", msg.Id, reason)
+	}
+	msg.Room = roomName(msg.Room)
+	// Only the server gives messages their uid
+	msg.Uid = ""
+	if err := s.checkPublish(msg.Id, msg.Room); err != nil {
+		return nil, err
+	}
+	if err := s.checkParent(msg); err != nil {
+		return nil, err
+	}
+	if err := s.checkAttachment(msg); err != nil {
+		return nil, err
+	}
+	// The user is not idle, and is back if away
+	s.touch(msg.Id)
+
 	mu.Lock()
 	lamport = max(lamport, msg.Lamport) + 1
 	mu.Unlock()
 	
-	// if id == "", it is a join or leave message
-	if msg.Id == ""{
-		updatedMsg := &proto.Message{
-			Id: msg.Id,
-			Text: msg.Text + fmt.Sprintf("%d", lamport),
-			Lamport: lamport,
-		}
-		log.Printf("[Server: %d] A message was published with following content: %s", lamport, updatedMsg.Text)
-		s.Broadcast(ctx, updatedMsg)
-	}else{
-		log.Printf("[Server: %d] A message was published by %s with following content: %s", lamport, msg.Id, msg.Text)
-		s.Broadcast(ctx, msg)
+	log.Printf("[Server: %d] A message was published by %s with following content: %s", lamport, msg.Id, msg.Text)
+	msg.Lamport = lamport
+	if err := s.publish(ctx, msg); err != nil {
+		return nil, err
 	}
+	s.webhooks.fire(&webhookEvent{Event: "message", Room: msg.Room, User: msg.Id, Text: msg.Text, Lamport: msg.Lamport, Parent: msg.Parent})
 
 	return &proto.Empty{}, nil
 }
 
 // Implementation of the Join rpc - alllows user to join the server
 func (s *Server) Join(user *proto.User, stream proto.Chat_JoinServer) error{
+	if err := s.validateUser(user); err != nil {
+		return err
+	}
+	if reason, banned := s.isBanned(user.Id); banned {
+		return status.Errorf(codes.PermissionDenied, "%s is banned: %s", user.Id, reason)
+	}
+	if err := s.authenticate(stream.Context(), user.Id); err != nil {
+		return err
+	}
+	// Only the server decides who is a bot
+	user.Bot = s.isBot(user.Id)
+	// The join message can only be published on the leader, so users join the leader
+	if s.raft != nil {
+		if state, _, leader := s.raft.Status(); state != raft.Leader {
+			return s.redirect(stream.Context(), leader)
+		}
+	}
+
 	// Create a connection to server	
+	user.Room = roomName(user.Room)
 	conn := &Connection{
 		stream: stream,
 		user: user,
-		error: make(chan error),
+		error: make(chan error, 1),
+		rooms: map[string]bool{user.Room: true},
+		connectedAt: time.Now(),
+		lastActive: time.Now(),
+		session: newSession(),
+	}
+	if p, found := peer.FromContext(stream.Context()); found {
+		conn.address = p.Addr.String()
+	}
+	if md, found := metadata.FromIncomingContext(stream.Context()); found {
+		conn.userAgent = strings.Join(md.Get("user-agent"), " ")
 	}
 	
 	// Make the user active
 	conn.user.Active = true
 
-	// Add the connection to the map of connections
+	// Nothing is sent on the stream before the header with the session
+	conn.sending.Lock()
+
+	// Add the connection to the map of connections. The first user in a room becomes its owner.
+	// A user that is still connected can only join again with the session of its connection, like a client
+	// that lost its connection before the server noticed
+	s.lock.Lock()
+	if old, found := s.connections[user.Id]; found && old.user.Active && !hasSession(stream.Context(), old.session) {
+		s.lock.Unlock()
+		conn.sending.Unlock()
+		return status.Errorf(codes.AlreadyExists, "%s is already connected", user.Id)
+	}
 	s.connections[conn.user.Id] = conn
+	s.room(user.Room, user.Id)
+	s.lock.Unlock()
+
+	// The client attaches the session to its calls as the user. A failed header means the stream is gone,
+	// which is handled below
+	stream.SendHeader(metadata.Pairs(sessionKey, conn.session))
+	conn.sending.Unlock()
 
-	// Return whatever error that is in the conn error field
-	return <- conn.error
+	// The server tells the room that the user joined - system messages can not be published by clients
+	mu.Lock()
+	lamport += 1
+	joinMessage := &proto.Message{
+		Id: "",
+		Text: user.Name + " joined Chitty-Chat at Lamport time " + fmt.Sprintf("%d", lamport),
+		Lamport: lamport,
+		Room: user.Room,
+	}
+	mu.Unlock()
+	log.Printf("[Server: %d] A message was published with following content: %s", joinMessage.Lamport, joinMessage.Text)
+	if err := s.publish(stream.Context(), joinMessage); err != nil {
+		s.lock.Lock()
+		if s.connections[user.Id] == conn {
+			conn.user.Active = false
+		}
+		s.lock.Unlock()
+		return err
+	}
+	s.userEvent("join", user)
+
+	// Return whatever error that is in the conn error field, or stop if the client cancels the stream
+	select {
+	case err := <- conn.error:
+		// The user was disconnected
+		s.userEvent("leave", user)
+		return err
+	case <- stream.Context().Done():
+		// The user is only gone if nobody joined with the same id since, and went away without leaving
+		s.lock.Lock()
+		left := false
+		if s.connections[user.Id] == conn {
+			left = conn.user.Active
+			conn.user.Active = false
+			s.members.Remove(user.Id)
+		}
+		s.lock.Unlock()
+		if left {
+			s.userEvent("leave", user)
+		}
+		return stream.Context().Err()
+	}
 }
 
-func (s *Server) Broadcast(ctx context.Context, msg *proto.Message) (*proto.Empty, error){
+// Sends the message to every active user that receives it. Only the server fans messages out, after the message
+// passed the checks of the rpc that created it
+func (s *Server) broadcast(ctx context.Context, msg *proto.Message) {
 	// Allows counting of go routines. Go routines can be added to the wait group, and it is possible to decrease the counter when a go routine finishes its job.
 	// This makes it possible to block the method from exiting before all go routines finishes their job.
 	wait := sync.WaitGroup{}
@@ -97,14 +288,23 @@ func (s *Server) Broadcast(ctx context.Context, msg *proto.Message) (*proto.Empt
 	// Status message to indicate start of broadcasting
 	log.Printf("[Server: %d] Broadcasting message to active users:", lamport)
 
-	//Loop through all connections
+	//Loop through all connections - messages without a room goes to everybody, others only to the users in the room
+	// and mention notifications only to the mentioned users
+	s.lock.RLock()
+	connections := make(map[string]*Connection, len(s.connections))
 	for name, conn := range s.connections {
+		if receives(conn, msg) {
+			connections[name] = conn
+		}
+	}
+	s.lock.RUnlock()
+	for name, conn := range connections {
 		//Increments the counter of the wait group - increments by one for each connection
 		wait.Add(1)
 		// Gather active users
 		
 		// Go routine that spawn an anonymous function
-		go func (msg *proto.Message, conn *Connection){
+		go func (name string, msg *proto.Message, conn *Connection){
 			// When the method exits, decrement the wait group by one
 			defer wait.Done()
 			
@@ -113,25 +313,22 @@ func (s *Server) Broadcast(ctx context.Context, msg *proto.Message) (*proto.Empt
 			if conn.user.Active {
 				mu.Lock()
 				lamport += 1
-				updatedMsg := &proto.Message{
-					Id: msg.Id,
-					Text: msg.Text,
-					Lamport: lamport,
-				}
+				updatedMsg := protobuf.Clone(msg).(*proto.Message)
+				updatedMsg.Lamport = lamport
 				mu.Unlock()
 				log.Printf("[Server: %d] Sending message to %s.", lamport, conn.user.Id)
 				// Send message to the client which is attached to given connection
-				err := conn.stream.Send(updatedMsg)
+				err := conn.send(updatedMsg)
 				
 				// If an error occurs - print the error and terminate the conneciton making the user go offline
 				if err != nil {
-					log.Fatalf("Error sending message %s - Error: %v", name, err)
+					log.Printf("Error sending message %s - Error: %v", name, err)
 					conn.user.Active = false
 					// Pass the error to the error chan for the connection
-					conn.error <- err
+					conn.close(err)
 				}
 			}
-		}(msg, conn)
+		}(name, msg, conn)
 	}
 
 	// Go routine that spawns anonymous function that ensures that the wait group waits for the go routines to exit
@@ -143,24 +340,228 @@ func (s *Server) Broadcast(ctx context.Context, msg *proto.Message) (*proto.Empt
 
 	// Acts as a blocker - code will not proceed from this until our done channel has been closed. That happens after all our go routines are done.
 	<- done
-	
-	// Method can exit, and nothing with no error
-	return &proto.Empty{}, nil
 }
 
 
+// Checks if the user id is banned, and returns the reason if it is
+func (s *Server) isBanned(id string) (string, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	reason, banned := s.banned[id]
+	return reason, banned
+}
+
+// Checks that the user is in the room and is allowed to publish there
+func (s *Server) checkPublish(id string, room string) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	// Integrations post to the rooms of their webhooks without joining
+	if s.incomingWebhooks.allows(id, room) {
+		return nil
+	}
+	if conn, found := s.connections[id]; !found || !conn.rooms[room] {
+		return status.Errorf(codes.PermissionDenied, "%s is not in %s", id, room)
+	}
+	return s.authorizeLocked(id, room, PermissionPublish)
+}
+
+// Broadcasts a system message to all active users. System messages has no id
+func (s *Server) announce(ctx context.Context, text string) {
+	mu.Lock()
+	lamport += 1
+	mu.Unlock()
+	msg := &proto.Message{
+		Id: "",
+		Text: text,
+		Lamport: lamport,
+	}
+	s.broadcast(ctx, msg)
+	s.cluster.forward(msg)
+}
+
 func main(){
+	// Rate limits for publishing messages
+	var rateLimits RateLimitConfig
+	flag.Float64Var(&rateLimits.UserBurst, "user-burst", 5, "Number of messages a single user can publish in a burst")
+	flag.Float64Var(&rateLimits.UserRefill, "user-refill", 1, "Number of messages per second a single user is allowed to publish")
+	flag.Float64Var(&rateLimits.GlobalBurst, "global-burst", 100, "Number of messages all users together can publish in a burst")
+	flag.Float64Var(&rateLimits.GlobalRefill, "global-refill", 50, "Number of messages per second all users together are allowed to publish")
+	flag.Float64Var(&rateLimits.BotBurst, "bot-burst", 20, "Number of messages a single bot can publish in a burst")
+	flag.Float64Var(&rateLimits.BotRefill, "bot-refill", 5, "Number of messages per second a single bot is allowed to publish")
+	flag.IntVar(&rateLimits.MuteStrikes, "mute-strikes", 5, "Number of rate limit violations before a user is muted (0 disables muting)")
+	flag.DurationVar(&rateLimits.StrikeWindow, "strike-window", time.Minute, "Window in which rate limit violations are counted")
+	flag.DurationVar(&rateLimits.MuteDuration, "mute-duration", time.Minute, "How long a flooding user is muted")
+	// Limits on what users can send
+	var limits MessageLimits
+	flag.IntVar(&limits.MaxMessageLength, "max-message-length", 128, "Max number of characters in a message")
+	flag.IntVar(&limits.MaxNameLength, "max-name-length", 32, "Max number of characters in a user name")
+	// Roles of the users
+	owners := flag.String("owners", "", "Comma separated ids of users that are owners on the whole server")
+	defaultRoleName := flag.String("default-role", "member", "Role of users that has not been given a role (guest, member, moderator, admin or owner)")
+	// History of published messages
+	historyFile := flag.String("history-file", "", "File to persist the message history in (history is kept in memory only if empty)")
+	historyLimit := flag.Int("history-limit", 10000, "Max number of messages kept in memory")
+	// Attachments
+	blobDir := flag.String("blob-dir", "blobs", "Directory to store attachments in")
+	maxAttachmentSize := flag.Int64("max-attachment-size", 10<<20, "Max size of an attachment in bytes")
+	// Credential for the admin service
+	adminToken := flag.String("admin-token", os.Getenv("CHITTY_ADMIN_TOKEN"), "Token required to call the ChatAdmin service (admin service is disabled if empty)")
+	// Address to listen on, and the other nodes of the cluster
+	address := flag.String("listen", ":8080", "Address to listen on")
+	node := flag.String("node", "", "Name of this node in the cluster (defaults to the listen address)")
+	peers := flag.String("peers", "", "Comma separated addresses of the other nodes in the cluster")
+	clusterToken := flag.String("cluster-token", os.Getenv("CHITTY_CLUSTER_TOKEN"), "Token the nodes of the cluster use to talk to each other (clustering is disabled if empty)")
+	// Replication of the messages with raft, instead of forwarding them to peers
+	raftID := flag.String("raft-id", "", "Id of this node in the raft cluster (raft is disabled if empty)")
+	raftNodes := flag.String("raft-nodes", "", "Comma separated id=address of every node in the raft cluster, including this one")
+	raftDir := flag.String("raft-dir", "", "Directory the raft node stores its term, vote and log in (defaults to raft-<raft id>)")
+	// Federation with independent servers
+	serverName := flag.String("server-name", "", "Name of this server in the federation, users are known as id@name on the other servers")
+	federationPeers := flag.String("federation-peers", "", "Comma separated name=address of the trusted servers to federate with")
+	federationToken := flag.String("federation-token", os.Getenv("CHITTY_FEDERATION_TOKEN"), "Token the federated servers use to talk to each other (federation is disabled if empty)")
+	sharedRooms := flag.String("shared-rooms", "", "Comma separated rooms shared with the federated servers")
+	// Failure detection for users that answer heartbeats
+	var detector membership.Config
+	flag.DurationVar(&detector.HeartbeatInterval, "heartbeat-interval", time.Second, "How often users are sent a heartbeat")
+	flag.Float64Var(&detector.SuspectPhi, "suspect-phi", 5, "Phi above which a user that stopped answering heartbeats is suspected to be gone")
+	flag.Float64Var(&detector.DeadPhi, "dead-phi", 12, "Phi above which a user that stopped answering heartbeats is disconnected")
+	flag.IntVar(&detector.WindowSize, "heartbeat-window", 100, "Number of heartbeats per user the failure detector learns from")
+	// Webhooks the events of the chat are sent to
+	var webhooks WebhookConfig
+	flag.StringVar(&webhooks.File, "webhooks-file", "", "JSON file with the webhooks to send the events of the chat to (webhooks are disabled if empty)")
+	flag.StringVar(&webhooks.QueueDir, "webhook-queue-dir", "webhook-queue", "Directory to queue webhook deliveries in until they are delivered")
+	flag.IntVar(&webhooks.MaxAttempts, "webhook-attempts", 10, "Number of times a webhook delivery is tried before it is given up")
+	// Webhooks integrations post messages through
+	incomingFile := flag.String("incoming-webhooks-file", "", "JSON file with the rooms, integration users and tokens of the incoming webhooks (incoming webhooks are disabled if empty)")
+	incomingAddress := flag.String("incoming-webhook-listen", ":8090", "Address to accept incoming webhooks on")
+	// Bot users, which have to present their token on every call
+	botList := flag.String("bots", os.Getenv("CHITTY_BOTS"), "Comma separated id=token of the bot users")
+	// Keepalive of the grpc connections, which finds the clients whose connection died without closing
+	var keepalive KeepaliveConfig
+	flag.DurationVar(&keepalive.Time, "keepalive-time", 30*time.Second, "How long a connection can be quiet before the server pings the client")
+	flag.DurationVar(&keepalive.Timeout, "keepalive-timeout", 10*time.Second, "How long the client has to answer a ping before it is disconnected")
+	flag.DurationVar(&keepalive.MinTime, "keepalive-min-time", 10*time.Second, "Clients pinging the server more often than this are disconnected")
+	// Users that do nothing
+	var idle IdleConfig
+	flag.DurationVar(&idle.AwayAfter, "away-after", 5*time.Minute, "How long a user can publish nothing before being marked away (0 disables)")
+	flag.DurationVar(&idle.IdleTimeout, "idle-timeout", 0, "How long a user can publish nothing before being disconnected (0 disables)")
+	flag.Parse()
+
+	if detector.HeartbeatInterval <= 0 {
+		log.Fatalf("The heartbeat interval must be positive")
+	}
+	if webhooks.MaxAttempts < 1 {
+		log.Fatalf("Webhook deliveries must be tried at least once")
+	}
+	hooks, err := openWebhooks(webhooks)
+	if err != nil {
+		log.Fatalf("Could not start the webhooks: %v", err)
+	}
+	bots, err := parseBots(*botList)
+	if err != nil {
+		log.Fatalf("Invalid bots: %v", err)
+	}
+	incoming, err := openIncomingWebhooks(*incomingFile)
+	if err != nil {
+		log.Fatalf("Could not read the incoming webhooks: %v", err)
+	}
+	for id := range bots {
+		if incoming.isIntegration(id) {
+			log.Fatalf("%s cannot be both a bot and an integration", id)
+		}
+	}
+	defaultRole, err := parseRole(*defaultRoleName)
+	if err != nil {
+		log.Fatalf("Invalid default role: %v", err)
+	}
+	history, err := openHistory(*historyFile, *historyLimit)
+	if err != nil {
+		log.Fatalf("Could not open history: %v", err)
+	}
+	blobs, err := openBlobStore(*blobDir, *maxAttachmentSize)
+	if err != nil {
+		log.Fatalf("Could not open attachment store: %v", err)
+	}
+	var peerAddresses []string
+	for _, peer := range strings.Split(*peers, ",") {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			peerAddresses = append(peerAddresses, peer)
+		}
+	}
+	if (len(peerAddresses) > 0 || *raftID != "") && *clusterToken == "" {
+		log.Fatalf("A cluster token is required to talk to peers")
+	}
+	// Raft sends every message to every node, so forwarding would send them twice. And the raft log is the history
+	if *raftID != "" && (len(peerAddresses) > 0 || *historyFile != "") {
+		log.Fatalf("Raft cannot be used together with -peers or -history-file")
+	}
+	if *node == "" {
+		*node = *address
+	}
+	if *federationPeers != "" && (*serverName == "" || *federationToken == "") {
+		log.Fatalf("A server name and a federation token are required to federate")
+	}
+	// Relayed messages are delivered outside the raft log
+	if *federationPeers != "" && *raftID != "" {
+		log.Fatalf("Federation cannot be used together with raft")
+	}
+	federation, err := newFederation(*serverName, *federationToken, *federationPeers, *sharedRooms)
+	if err != nil {
+		log.Fatalf("Could not connect to the federated servers: %v", err)
+	}
+	cluster, err := newCluster(*node, *clusterToken, peerAddresses)
+	if err != nil {
+		log.Fatalf("Could not connect to the cluster: %v", err)
+	}
+	roles := make(map[string]proto.Role)
+	for _, owner := range strings.Split(*owners, ",") {
+		if owner = strings.TrimSpace(owner); owner != "" {
+			roles[owner] = proto.Role_ROLE_OWNER
+		}
+	}
+
 	// Create the map of connections
 	connections := make(map[string]*Connection)
 
 	// Reference to our server with our connections
-	server := &Server{proto.UnimplementedChatServer{},connections}
+	server := &Server{
+		connections: connections,
+		banned: make(map[string]string),
+		limiter: newRateLimiter(rateLimits, bots),
+		rooms: make(map[string]*Room),
+		roles: roles,
+		defaultRole: defaultRole,
+		limits: limits,
+		history: history,
+		blobs: blobs,
+		cluster: cluster,
+		federation: federation,
+		members: membership.New(detector),
+		bots: bots,
+		webhooks: hooks,
+		incomingWebhooks: incoming,
+		incarnation: newIncarnation(*node),
+		admin: *adminToken != "",
+	}
 
-	// Startup of the grpc server
-	grpcServer := grpc.NewServer()
+	// Startup of the grpc server - every unary call is checked for admin, cluster, federation and user rights,
+	// and then passes through the rate limiter, which trusts the id of the user
+	grpcServer := grpc.NewServer(append(keepaliveOptions(keepalive), grpc.ChainUnaryInterceptor(
+		adminAuthInterceptor(*adminToken),
+		clusterAuthInterceptor(*clusterToken),
+		federationAuthInterceptor(*federationToken),
+		server.userAuthInterceptor(),
+		server.rateLimitInterceptor(server.limiter),
+	))...)
 
-	// Create a listener. This listener listen on our port 8080
-	listener, err := net.Listen("tcp", ":8080")
+	if *raftID != "" {
+		if err := server.startRaft(*raftID, *raftNodes, *raftDir, *clusterToken, grpcServer); err != nil {
+			log.Fatalf("Could not start raft: %v", err)
+		}
+	}
+
+	// Create a listener. This listener listen on our port, 8080 unless told otherwise
+	listener, err := net.Listen("tcp", *address)
 
 	//Check if error occured  when trying to listen on port
 	if err != nil {
@@ -168,10 +569,26 @@ func main(){
 	}
 
 	//Print to show that server has started
-	log.Printf("[Server: %d] Started server on port: 8080", lamport)
+	log.Printf("[Server: %d] Started server on %s as node %s with %d peers", lamport, *address, *node, len(peerAddresses))
 
 	// Register our Chat server on out grpc server, and pass our service which is the server type
 	proto.RegisterChatServer(grpcServer, server)
+	// Register the admin service next to it
+	proto.RegisterChatAdminServer(grpcServer, &AdminServer{chat: server})
+	// And the cluster service the other nodes forward messages through
+	proto.RegisterClusterServer(grpcServer, &ClusterServer{chat: server})
+	// And the federation service the trusted servers relay messages through
+	proto.RegisterFederationServer(grpcServer, &FederationServer{chat: server})
+	// And the health service clients check before they pick a server
+	server.serveHealth(grpcServer)
+	// Send heartbeats to the users, and disconnect those that stopped answering
+	go server.monitor(detector.HeartbeatInterval)
+	// Mark the users that do nothing as away, and disconnect them when they stay idle
+	go server.watchIdle(idle)
+	// Let integrations post messages over HTTP
+	if incoming != nil {
+		go server.serveIncoming(*incomingAddress)
+	}
 
 	// Serve incomming connetions to the listener
 	grpcServer.Serve(listener)
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Metadata key of the session of a user. The server sends it in the header of the Join stream,
+// and every call made as the user has to carry it
+const sessionKey = "chitty-session"
+
+// The rpcs of the chat service that act as a user. They can only be called with the session of the user
+var actingMethods = map[string]bool{
+	chatServicePrefix + "Publish":   true,
+	chatServicePrefix + "Leave":     true,
+	chatServicePrefix + "Invite":    true,
+	chatServicePrefix + "Kick":      true,
+	chatServicePrefix + "SetTopic":  true,
+	chatServicePrefix + "SetRole":   true,
+	chatServicePrefix + "Edit":      true,
+	chatServicePrefix + "Delete":    true,
+	chatServicePrefix + "Revisions": true,
+	chatServicePrefix + "React":     true,
+	chatServicePrefix + "Heartbeat": true,
+}
+
+// A new random session token
+func newSession() string {
+	token := make([]byte, 16)
+	rand.Read(token)
+	return hex.EncodeToString(token)
+}
+
+// Checks if the call carries the session
+func hasSession(ctx context.Context, session string) bool {
+	md, found := metadata.FromIncomingContext(ctx)
+	if !found || session == "" {
+		return false
+	}
+	for _, given := range md.Get(sessionKey) {
+		// Constant time comparison, so the session cannot be guessed by timing the calls
+		if subtle.ConstantTimeCompare([]byte(given), []byte(session)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks that the call is made by the user: it has to carry the session of the Join stream of the user.
+// Ids are chosen by the clients, so without it anybody could act as anybody else
+func (s *Server) checkSession(ctx context.Context, id string) error {
+	s.lock.RLock()
+	conn, found := s.connections[id]
+	active := found && conn.user.Active
+	s.lock.RUnlock()
+	if !active || !hasSession(ctx, conn.session) {
+		return status.Errorf(codes.Unauthenticated, "the call is not made with the session of %s, join first", id)
+	}
+	return nil
+}
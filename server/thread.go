@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/00kristian/MiniProject_2/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Checks that the message a reply is to exists and is in the same room as the reply.
+// The parent is named by its uid as well, since the other nodes of the cluster know it by another sequence number
+func (s *Server) checkParent(msg *proto.Message) error {
+	msg.ParentUid = ""
+	if msg.Parent == 0 {
+		return nil
+	}
+	parent, found := s.history.get(msg.Parent)
+	if !found {
+		return status.Errorf(codes.NotFound, "message %d does not exist", msg.Parent)
+	}
+	if parent.Room != msg.Room {
+		return invalidArgument("the reply is not valid", []*errdetails.BadRequest_FieldViolation{{
+			Field:       "parent",
+			Description: fmt.Sprintf("message %d is in #%s, not #%s", msg.Parent, parent.Room, msg.Room),
+		}})
+	}
+	msg.ParentUid = parent.Uid
+	return nil
+}
+
+// Implementation of the Thread rpc - returns the thread the message with the sequence number in ref is part of,
+// starting with the message that started the thread
+func (s *Server) Thread(ctx context.Context, req *proto.Message) (*proto.MessageList, error) {
+	thread := s.history.thread(req.Ref)
+	if len(thread) == 0 {
+		return nil, status.Errorf(codes.NotFound, "message %d does not exist", req.Ref)
+	}
+	return &proto.MessageList{Messages: thread}, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/00kristian/MiniProject_2/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Limits the server enforces on what users send. They are advertised to clients through GetServerInfo
+type MessageLimits struct {
+	// Max length of a message text, counted in characters (runes) and not bytes
+	MaxMessageLength int
+	// Max length of a user name and id, counted in characters (runes)
+	MaxNameLength int
+}
+
+// Validates a message sent to Publish. Returns an InvalidArgument error describing every violation
+func (s *Server) validateMessage(msg *proto.Message) error {
+	var violations []*errdetails.BadRequest_FieldViolation
+	violations = append(violations, checkText("text", msg.Text, s.limits.MaxMessageLength)...)
+	// Only system messages have no id, and only the server sends them
+	violations = append(violations, checkText("id", msg.Id, s.limits.MaxNameLength)...)
+	return invalidArgument("invalid message", violations)
+}
+
+// Validates a user trying to Join. Returns an InvalidArgument error describing every violation
+func (s *Server) validateUser(user *proto.User) error {
+	var violations []*errdetails.BadRequest_FieldViolation
+	violations = append(violations, checkText("id", user.Id, s.limits.MaxNameLength)...)
+	violations = append(violations, checkText("name", user.Name, s.limits.MaxNameLength)...)
+	// Ids with a server name belong to users on federated servers
+	if s.federation.enabled() && strings.Contains(user.Id, "@") {
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{Field: "id", Description: "must not contain @"})
+	}
+	return invalidArgument("invalid user", violations)
+}
+
+// Checks that a text field is non-empty valid UTF-8 without control characters and at most max characters long
+func checkText(field string, text string, max int) []*errdetails.BadRequest_FieldViolation {
+	violation := func(description string) []*errdetails.BadRequest_FieldViolation {
+		return []*errdetails.BadRequest_FieldViolation{{Field: field, Description: description}}
+	}
+
+	if text == "" {
+		return violation("must not be empty")
+	}
+	if !utf8.ValidString(text) {
+		return violation("must be valid UTF-8")
+	}
+	if length := utf8.RuneCountInString(text); length > max {
+		return violation(fmt.Sprintf("must be at most %d characters, was %d", max, length))
+	}
+	for _, r := range text {
+		if unicode.IsControl(r) {
+			return violation(fmt.Sprintf("must not contain control characters, found %U", r))
+		}
+	}
+	return nil
+}
+
+// Builds an InvalidArgument error with the violations attached as details. Returns nil if there are no violations
+func invalidArgument(description string, violations []*errdetails.BadRequest_FieldViolation) error {
+	if len(violations) == 0 {
+		return nil
+	}
+	st := status.New(codes.InvalidArgument, fmt.Sprintf("%s: %s %s", description, violations[0].Field, violations[0].Description))
+	detailed, err := st.WithDetails(&errdetails.BadRequest{FieldViolations: violations})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/00kristian/MiniProject_2/proto"
+)
+
+// The events webhooks can be sent for
+var webhookEvents = map[string]bool{
+	"message": true,
+	"join":    true,
+	"leave":   true,
+	"room":    true,
+}
+
+// How long a webhook receiver has to answer
+const webhookTimeout = 10 * time.Second
+
+// How long to wait before trying again the first time and at most. Variables, so the tests do not have to wait that long
+var (
+	webhookBackoff    = time.Second
+	webhookMaxBackoff = 5 * time.Minute
+)
+
+// Settings of the outgoing webhooks
+type WebhookConfig struct {
+	// JSON file with the webhooks, webhooks are disabled if empty
+	File string
+	// Directory the deliveries are queued in until they are delivered, so they survive restarts
+	QueueDir string
+	// Number of times a delivery is tried before it is given up
+	MaxAttempts int
+}
+
+// A URL that is sent the events of the chat, as configured in the webhooks file:
+// [{"url": "https://example.com/hook", "secret": "...", "rooms": ["lobby"], "events": ["message", "join"]}]
+// No rooms or no events means all of them
+type webhook struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Rooms  []string `json:"rooms"`
+	Events []string `json:"events"`
+
+	rooms  map[string]bool
+	events map[string]bool
+
+	// The deliveries waiting to be sent, oldest first. The webhook is sent one delivery at a time, in order
+	mu    sync.Mutex
+	queue []*delivery
+	wake  chan struct{}
+}
+
+// Checks if the webhook wants the event
+func (h *webhook) wants(event *webhookEvent) bool {
+	return (len(h.events) == 0 || h.events[event.Event]) && (len(h.rooms) == 0 || h.rooms[event.Room])
+}
+
+// The JSON payload POSTed to the webhooks
+type webhookEvent struct {
+	Event   string    `json:"event"`
+	Time    time.Time `json:"time"`
+	Room    string    `json:"room,omitempty"`
+	User    string    `json:"user,omitempty"`
+	Text    string    `json:"text,omitempty"`
+	Lamport uint64    `json:"lamport"`
+	// Message the published message replies to
+	Parent uint64 `json:"parent,omitempty"`
+}
+
+// An event on its way to a webhook, as stored in the queue directory
+type delivery struct {
+	ID       string          `json:"id"`
+	URL      string          `json:"url"`
+	Event    string          `json:"event"`
+	Attempts int             `json:"attempts"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+// Sends the events of the chat to the webhooks. Every event is written to the queue directory before it is sent,
+// and removed when the webhook accepted it or it was given up. A nil Webhooks sends nothing
+type Webhooks struct {
+	config WebhookConfig
+	hooks  []*webhook
+	client *http.Client
+}
+
+// Reads the webhooks and the deliveries left in the queue, and starts sending them. Returns nil if there are no webhooks
+func openWebhooks(config WebhookConfig) (*Webhooks, error) {
+	if config.File == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(config.File)
+	if err != nil {
+		return nil, err
+	}
+	w := &Webhooks{config: config, client: &http.Client{Timeout: webhookTimeout}}
+	if err := json.Unmarshal(data, &w.hooks); err != nil {
+		return nil, fmt.Errorf("invalid webhooks file %s: %v", config.File, err)
+	}
+	// Queued deliveries find their webhook by URL
+	urls := make(map[string]bool)
+	for _, h := range w.hooks {
+		if !strings.HasPrefix(h.URL, "http://") && !strings.HasPrefix(h.URL, "https://") {
+			return nil, fmt.Errorf("webhook url %q must be http or https", h.URL)
+		}
+		if urls[h.URL] {
+			return nil, fmt.Errorf("webhook %s is configured twice", h.URL)
+		}
+		urls[h.URL] = true
+		h.rooms = make(map[string]bool)
+		for _, room := range h.Rooms {
+			h.rooms[roomName(room)] = true
+		}
+		h.events = make(map[string]bool)
+		for _, event := range h.Events {
+			if !webhookEvents[event] {
+				return nil, fmt.Errorf("webhook %s has unknown event %q", h.URL, event)
+			}
+			h.events[event] = true
+		}
+		h.wake = make(chan struct{}, 1)
+	}
+
+	if err := os.MkdirAll(config.QueueDir, 0755); err != nil {
+		return nil, err
+	}
+	if err := w.load(); err != nil {
+		return nil, err
+	}
+	for _, h := range w.hooks {
+		go w.run(h)
+	}
+	return w, nil
+}
+
+// Queues the deliveries left from the last run, oldest first. Deliveries for webhooks that are not configured anymore are dropped
+func (w *Webhooks) load() error {
+	files, err := filepath.Glob(filepath.Join(w.config.QueueDir, "*.json"))
+	if err != nil {
+		return err
+	}
+	// The ids start with the time they were queued
+	sort.Strings(files)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		d := &delivery{}
+		if err := json.Unmarshal(data, d); err != nil {
+			return fmt.Errorf("corrupt webhook delivery %s: %v", file, err)
+		}
+		h := w.find(d.URL)
+		if h == nil {
+			log.Printf("[Server: %d] Dropped delivery %s, %s is not a webhook anymore", lamport, d.ID, d.URL)
+			os.Remove(file)
+			continue
+		}
+		h.queue = append(h.queue, d)
+	}
+	return nil
+}
+
+// The webhook with the URL, nil if there is none
+func (w *Webhooks) find(url string) *webhook {
+	for _, h := range w.hooks {
+		if h.URL == url {
+			return h
+		}
+	}
+	return nil
+}
+
+// Sends a join or leave of the user to the webhooks
+func (s *Server) userEvent(event string, user *proto.User) {
+	mu.Lock()
+	current := lamport
+	mu.Unlock()
+	s.webhooks.fire(&webhookEvent{Event: event, Room: user.Room, User: user.Id, Lamport: current})
+}
+
+// Queues the event for every webhook that wants it
+func (w *Webhooks) fire(event *webhookEvent) {
+	if w == nil {
+		return
+	}
+	event.Time = time.Now().UTC()
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("[Server: %d] Could not encode webhook event: %v", lamport, err)
+		return
+	}
+	for _, h := range w.hooks {
+		if !h.wants(event) {
+			continue
+		}
+		d := &delivery{ID: newDeliveryID(), URL: h.URL, Event: event.Event, Payload: payload}
+		// A delivery that can not be stored is still sent, it is just lost if we stop before
+		if err := w.save(d); err != nil {
+			log.Printf("[Server: %d] Could not queue webhook delivery %s: %v", lamport, d.ID, err)
+		}
+		h.mu.Lock()
+		h.queue = append(h.queue, d)
+		h.mu.Unlock()
+		select {
+		case h.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Sends the queued deliveries of the webhook, one at a time, forever
+func (w *Webhooks) run(h *webhook) {
+	for {
+		h.mu.Lock()
+		for len(h.queue) == 0 {
+			h.mu.Unlock()
+			<-h.wake
+			h.mu.Lock()
+		}
+		d := h.queue[0]
+		h.mu.Unlock()
+
+		w.deliver(h, d)
+
+		h.mu.Lock()
+		h.queue = h.queue[1:]
+		h.mu.Unlock()
+		os.Remove(w.path(d))
+	}
+}
+
+// Sends the delivery until the webhook accepts it, it is rejected for good, or it has been tried too many times.
+// Between the attempts the wait doubles, so a receiver that is down is not flooded
+func (w *Webhooks) deliver(h *webhook, d *delivery) {
+	for {
+		d.Attempts++
+		retry, wait, err := w.send(h, d)
+		if err == nil {
+			return
+		}
+		if !retry || d.Attempts >= w.config.MaxAttempts {
+			log.Printf("[Server: %d] Gave up delivering %s to %s after %d attempts: %v", lamport, d.ID, h.URL, d.Attempts, err)
+			return
+		}
+		if wait == 0 {
+			wait = backoff(d.Attempts)
+		}
+		log.Printf("[Server: %d] Delivering %s to %s failed, trying again in %v: %v", lamport, d.ID, h.URL, wait.Round(time.Millisecond), err)
+		// Remember the attempts, so a restart does not try forever
+		w.save(d)
+		time.Sleep(wait)
+	}
+}
+
+// POSTs the delivery to the webhook. The body is signed with the secret of the webhook as
+// "X-Chitty-Signature: sha256=<hex of the HMAC-SHA256 of the body>". Returns whether a failed delivery should be
+// tried again, and how long to wait if the receiver told us
+func (w *Webhooks) send(h *webhook, d *delivery) (bool, time.Duration, error) {
+	req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return false, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "chitty-chat/"+serverVersion)
+	req.Header.Set("X-Chitty-Event", d.Event)
+	req.Header.Set("X-Chitty-Delivery", d.ID)
+	if h.Secret != "" {
+		req.Header.Set("X-Chitty-Signature", "sha256="+sign(h.Secret, d.Payload))
+	}
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return true, 0, err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64*1024))
+	res.Body.Close()
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		return false, 0, nil
+	case res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500:
+		// The receiver can ask us to wait, but never longer than we wait at most
+		var wait time.Duration
+		if seconds, err := strconv.ParseInt(res.Header.Get("Retry-After"), 10, 64); err == nil && seconds > 0 {
+			wait = webhookMaxBackoff
+			if seconds < int64(webhookMaxBackoff/time.Second) {
+				wait = time.Duration(seconds) * time.Second
+			}
+		}
+		return true, wait, fmt.Errorf("the webhook answered %s", res.Status)
+	}
+	// The receiver does not want it, sending it again will not change that
+	return false, 0, fmt.Errorf("the webhook answered %s", res.Status)
+}
+
+// Stores the delivery in the queue directory. Written to a temporary file first, so a crash never leaves half a delivery
+func (w *Webhooks) save(d *delivery) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	temp := w.path(d) + ".tmp"
+	if err := ioutil.WriteFile(temp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp, w.path(d))
+}
+
+func (w *Webhooks) path(d *delivery) string {
+	return filepath.Join(w.config.QueueDir, d.ID+".json")
+}
+
+// Hex of the HMAC-SHA256 of the body with the secret
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// How long to wait before the next attempt: doubled for every attempt up to the max, with a bit of jitter
+// so the deliveries to a receiver that comes back are spread out
+func backoff(attempts int) time.Duration {
+	wait := webhookMaxBackoff
+	if attempts < 20 {
+		if doubled := webhookBackoff << (attempts - 1); doubled < wait {
+			wait = doubled
+		}
+	}
+	return wait + time.Duration(mathrand.Int63n(int64(wait/4)+1))
+}
+
+// An id that sorts in the order the deliveries were queued
+func newDeliveryID() string {
+	random := make([]byte, 4)
+	rand.Read(random)
+	return fmt.Sprintf("%020d-%s", time.Now().UnixNano(), hex.EncodeToString(random))
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A webhook receiver that answers with the given statuses in turn, and then with 200, remembering every request
+type receiver struct {
+	server *httptest.Server
+
+	mu       sync.Mutex
+	answers  []int
+	requests []*received
+}
+
+// A request the receiver got
+type received struct {
+	at     time.Time
+	header http.Header
+	body   []byte
+}
+
+func newReceiver(t *testing.T, answers ...int) *receiver {
+	r := &receiver{answers: answers}
+	r.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		r.mu.Lock()
+		r.requests = append(r.requests, &received{at: time.Now(), header: req.Header, body: body})
+		answer := http.StatusOK
+		if len(r.answers) > 0 {
+			answer, r.answers = r.answers[0], r.answers[1:]
+		}
+		r.mu.Unlock()
+		if answer == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "3600")
+		}
+		w.WriteHeader(answer)
+	}))
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+func (r *receiver) got() []*received {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*received(nil), r.requests...)
+}
+
+// Waits until the receiver got the number of requests
+func (r *receiver) waitFor(t *testing.T, count int) []*received {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if got := r.got(); len(got) >= count {
+			return got
+		}
+	}
+	t.Fatalf("the receiver got %d requests, want %d", len(r.got()), count)
+	return nil
+}
+
+// Writes a webhooks file with the webhook and opens it, with the queue in the directory
+func openTestWebhooks(t *testing.T, queueDir string, hook *webhook, maxAttempts int) *Webhooks {
+	t.Helper()
+	data, err := json.Marshal([]*webhook{hook})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "webhooks.json")
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	w, err := openWebhooks(WebhookConfig{File: file, QueueDir: queueDir, MaxAttempts: maxAttempts})
+	if err != nil {
+		t.Fatalf("could not open the webhooks: %v", err)
+	}
+	return w
+}
+
+// Makes the backoff short, so the tests do not wait long
+func shortBackoff(t *testing.T, base time.Duration, most time.Duration) {
+	oldBase, oldMost := webhookBackoff, webhookMaxBackoff
+	webhookBackoff, webhookMaxBackoff = base, most
+	t.Cleanup(func() {
+		webhookBackoff, webhookMaxBackoff = oldBase, oldMost
+	})
+}
+
+// Waits until the queue directory is empty
+func waitForEmptyQueue(t *testing.T, dir string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if files, _ := filepath.Glob(filepath.Join(dir, "*.json")); len(files) == 0 {
+			return
+		}
+	}
+	t.Fatalf("deliveries are still queued in %s", dir)
+}
+
+func TestWebhookSignature(t *testing.T) {
+	r := newReceiver(t)
+	queue := t.TempDir()
+	w := openTestWebhooks(t, queue, &webhook{URL: r.server.URL, Secret: "s3cret"}, 3)
+
+	w.fire(&webhookEvent{Event: "message", Room: "lobby", User: "alice", Text: "hello", Lamport: 7})
+	req := r.waitFor(t, 1)[0]
+
+	if got, want := req.header.Get("X-Chitty-Signature"), "sha256="+sign("s3cret", req.body); got != want {
+		t.Errorf("signature is %q, want %q", got, want)
+	}
+	if got := req.header.Get("X-Chitty-Event"); got != "message" {
+		t.Errorf("event header is %q, want message", got)
+	}
+	event := &webhookEvent{}
+	if err := json.Unmarshal(req.body, event); err != nil {
+		t.Fatalf("the body is not an event: %v", err)
+	}
+	if event.User != "alice" || event.Text != "hello" || event.Room != "lobby" || event.Lamport != 7 {
+		t.Errorf("got event %+v", event)
+	}
+	waitForEmptyQueue(t, queue)
+}
+
+func TestWebhookRetriesWithBackoff(t *testing.T) {
+	shortBackoff(t, 50*time.Millisecond, 300*time.Millisecond)
+	// The second answer asks us to wait an hour, which is more than we wait at most
+	r := newReceiver(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	queue := t.TempDir()
+	w := openTestWebhooks(t, queue, &webhook{URL: r.server.URL}, 5)
+
+	w.fire(&webhookEvent{Event: "join", User: "alice"})
+	requests := r.waitFor(t, 3)
+
+	if id := requests[0].header.Get("X-Chitty-Delivery"); id == "" || requests[2].header.Get("X-Chitty-Delivery") != id {
+		t.Errorf("the delivery id changed between the attempts")
+	}
+	if wait := requests[1].at.Sub(requests[0].at); wait < 50*time.Millisecond {
+		t.Errorf("waited %v after the first attempt, want at least the backoff", wait)
+	}
+	if wait := requests[2].at.Sub(requests[1].at); wait < 300*time.Millisecond || wait > 2*time.Second {
+		t.Errorf("waited %v after Retry-After: 3600, want the max backoff", wait)
+	}
+	waitForEmptyQueue(t, queue)
+	time.Sleep(100 * time.Millisecond)
+	if got := len(r.got()); got != 3 {
+		t.Errorf("the receiver got %d requests, want 3", got)
+	}
+}
+
+func TestWebhookGivesUpAfterMaxAttempts(t *testing.T) {
+	shortBackoff(t, 10*time.Millisecond, 20*time.Millisecond)
+	r := newReceiver(t, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError)
+	queue := t.TempDir()
+	w := openTestWebhooks(t, queue, &webhook{URL: r.server.URL}, 3)
+
+	w.fire(&webhookEvent{Event: "message", Text: "lost"})
+	w.fire(&webhookEvent{Event: "message", Text: "after"})
+	requests := r.waitFor(t, 4)
+
+	// Three attempts for the first delivery, then the queue moves on to the second one
+	for i, want := range []string{"lost", "lost", "lost", "after"} {
+		event := &webhookEvent{}
+		json.Unmarshal(requests[i].body, event)
+		if event.Text != want {
+			t.Errorf("request %d was for %q, want %q", i+1, event.Text, want)
+		}
+	}
+	waitForEmptyQueue(t, queue)
+}
+
+func TestWebhookQueueReloadedAfterRestart(t *testing.T) {
+	r := newReceiver(t)
+	queue := t.TempDir()
+
+	// What a server that stopped while the receiver was down leaves behind
+	stopped := &Webhooks{config: WebhookConfig{QueueDir: queue}}
+	left := &delivery{ID: newDeliveryID(), URL: r.server.URL, Event: "leave", Attempts: 2, Payload: json.RawMessage(`{"event":"leave","user":"bob"}`)}
+	gone := &delivery{ID: newDeliveryID(), URL: "http://gone.example.com/hook", Event: "leave", Payload: json.RawMessage(`{}`)}
+	for _, d := range []*delivery{left, gone} {
+		if err := stopped.save(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	openTestWebhooks(t, queue, &webhook{URL: r.server.URL}, 5)
+	req := r.waitFor(t, 1)[0]
+	if got := req.header.Get("X-Chitty-Delivery"); got != left.ID {
+		t.Errorf("delivered %q, want the queued delivery %q", got, left.ID)
+	}
+	if string(req.body) != string(left.Payload) {
+		t.Errorf("body is %s, want %s", req.body, left.Payload)
+	}
+	// The delivery for the webhook that is not configured anymore is dropped
+	if _, err := os.Stat(stopped.path(gone)); !os.IsNotExist(err) {
+		t.Errorf("the delivery for a removed webhook is still queued")
+	}
+	waitForEmptyQueue(t, queue)
+}